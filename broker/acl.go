@@ -0,0 +1,137 @@
+package broker
+
+import (
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/MajaSuite/mqtt/db"
+)
+
+// ACL is authorizer with topic access rules from broker store. Access is denied unless some rule allows it.
+type ACL struct {
+	mu    sync.RWMutex
+	rules []db.ACLRule
+	store db.Store // nil for fixed rules
+}
+
+// LoadACL read access rules from store
+func LoadACL(store db.Store) (*ACL, error) {
+	a := &ACL{store: store}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// NewACL create authorizer with given access rules
+func NewACL(rules []db.ACLRule) *ACL {
+	return &ACL{rules: rules}
+}
+
+// Reload read access rules from store again, fixed rules are kept
+func (a *ACL) Reload() error {
+	if a.store == nil {
+		return nil
+	}
+
+	rules, err := a.store.FetchACL()
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.rules = rules
+	a.mu.Unlock()
+
+	slog.Info("loaded acl rules", "count", len(rules))
+
+	return nil
+}
+
+// Authorize check if client has access to topic. For read access topic may be topic filter, it is
+// allowed only if every topic matched by the filter is allowed.
+func (a *ACL) Authorize(username string, clientId string, topic string, access int) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	for _, rule := range a.rules {
+		if rule.Access&access != access {
+			continue
+		}
+
+		switch rule.Kind {
+		case db.ACLUser:
+			if username == "" || rule.Name != username {
+				continue
+			}
+		case db.ACLClient:
+			if rule.Name != clientId {
+				continue
+			}
+		case db.ACLPattern:
+		default:
+			continue
+		}
+
+		pattern, ok := substitute(rule.Topic, username, clientId)
+		if !ok {
+			continue
+		}
+
+		if coverFilter(pattern, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// replace %u and %c by username and client id. Rule can't be applied if value is empty or contains
+// wildcards or level separator.
+func substitute(pattern string, username string, clientId string) (string, bool) {
+	if strings.Contains(pattern, "%u") {
+		if username == "" || strings.ContainsAny(username, "+#/") {
+			return "", false
+		}
+		pattern = strings.ReplaceAll(pattern, "%u", username)
+	}
+
+	if strings.Contains(pattern, "%c") {
+		if clientId == "" || strings.ContainsAny(clientId, "+#/") {
+			return "", false
+		}
+		pattern = strings.ReplaceAll(pattern, "%c", clientId)
+	}
+
+	return pattern, true
+}
+
+// check if every topic matched by filter is matched by pattern too
+func coverFilter(pattern string, filter string) bool {
+	p := strings.Split(pattern, "/")
+	f := strings.Split(filter, "/")
+
+	for i, level := range p {
+		if level == "#" {
+			return true
+		}
+
+		if len(f) <= i {
+			return false
+		}
+
+		switch {
+		case f[i] == "#":
+			// filter matches any number of levels, pattern doesn't
+			return false
+		case level == "+":
+			// matches any single level including "+" of filter
+		case level != f[i]:
+			return false
+		}
+	}
+
+	return len(p) == len(f)
+}
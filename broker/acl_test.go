@@ -0,0 +1,195 @@
+package broker
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/MajaSuite/mqtt/db"
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+func TestACLAuthorize(t *testing.T) {
+	acl := NewACL([]db.ACLRule{
+		{Kind: db.ACLUser, Name: "alice", Topic: "home/#", Access: db.AccessRead},
+		{Kind: db.ACLUser, Name: "alice", Topic: "home/alice/#", Access: db.AccessReadWrite},
+		{Kind: db.ACLClient, Name: "dev1", Topic: "dev/+/cmd", Access: db.AccessWrite},
+		{Kind: db.ACLPattern, Topic: "users/%u/#", Access: db.AccessReadWrite},
+		{Kind: db.ACLPattern, Topic: "clients/%c", Access: db.AccessRead},
+	})
+
+	tests := []struct {
+		username string
+		clientId string
+		topic    string
+		access   int
+		want     bool
+	}{
+		// nothing is allowed without rule
+		{"bob", "c1", "other", db.AccessRead, false},
+		{"", "c1", "home/kitchen", db.AccessRead, false},
+
+		// access of rule
+		{"alice", "c1", "home/kitchen", db.AccessRead, true},
+		{"alice", "c1", "home/kitchen", db.AccessWrite, false},
+		{"alice", "c1", "home/alice/desk", db.AccessWrite, true},
+		{"alice", "c1", "home/alice/desk", db.AccessReadWrite, true},
+		{"alice", "c1", "home/bob", db.AccessReadWrite, false},
+		{"dev1", "dev1", "dev/a/cmd", db.AccessWrite, true},
+		{"", "dev1", "dev/a/cmd", db.AccessWrite, true},
+		{"", "dev1", "dev/a/cmd", db.AccessRead, false},
+		{"", "dev2", "dev/a/cmd", db.AccessWrite, false},
+		{"", "dev1", "dev/a/b/cmd", db.AccessWrite, false},
+
+		// subscription filter is allowed if every matched topic is allowed
+		{"alice", "c1", "home/+", db.AccessRead, true},
+		{"alice", "c1", "home/#", db.AccessRead, true},
+		{"alice", "c1", "#", db.AccessRead, false},
+		{"alice", "c1", "+/kitchen", db.AccessRead, false},
+		{"alice", "c1", "home/alice/+/x", db.AccessRead, true},
+
+		// substitution of username and client id
+		{"bob", "c1", "users/bob/inbox", db.AccessWrite, true},
+		{"bob", "c1", "users/bob/#", db.AccessRead, true},
+		{"bob", "c1", "users/alice/inbox", db.AccessRead, false},
+		{"", "c1", "users//inbox", db.AccessRead, false},
+		{"a+b", "c1", "users/a+b/inbox", db.AccessRead, false},
+		{"a/b", "c1", "users/a/b/inbox", db.AccessRead, false},
+		{"a#", "c1", "users/a#", db.AccessRead, false},
+		{"bob", "c1", "clients/c1", db.AccessRead, true},
+		{"bob", "c1", "clients/c2", db.AccessRead, false},
+		{"bob", "c1", "clients/+", db.AccessRead, false},
+		{"bob", "c/1", "clients/c/1", db.AccessRead, false},
+	}
+
+	for _, tt := range tests {
+		if got := acl.Authorize(tt.username, tt.clientId, tt.topic, tt.access); got != tt.want {
+			t.Errorf("user %q client %q %s access %d: got %v, want %v", tt.username, tt.clientId, tt.topic,
+				tt.access, got, tt.want)
+		}
+	}
+}
+
+func TestCoverFilter(t *testing.T) {
+	tests := []struct {
+		pattern string
+		filter  string
+		want    bool
+	}{
+		{"a/#", "a/b/c", true},
+		{"a/#", "a", true},
+		{"a/#", "a/#", true},
+		{"a/#", "b", false},
+		{"#", "#", true},
+		{"a/+", "a/b", true},
+		{"a/+", "a/+", true},
+		{"a/+", "a/#", false},
+		{"a/+", "a/b/c", false},
+		{"a/+", "a", false},
+		{"+/b", "a/b", true},
+		{"a/b", "a/+", false},
+		{"a/b", "a/b/c", false},
+		{"a/b", "a/b", true},
+	}
+
+	for _, tt := range tests {
+		if got := coverFilter(tt.pattern, tt.filter); got != tt.want {
+			t.Errorf("pattern %s filter %s: got %v, want %v", tt.pattern, tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestSubstitute(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		username string
+		clientId string
+		want     string
+		ok       bool
+	}{
+		{"a/%u/%c", "bob", "c1", "a/bob/c1", true},
+		{"a/%u/%u", "bob", "", "a/bob/bob", true},
+		{"a/b", "", "", "a/b", true},
+		{"a/%u", "", "c1", "", false},
+		{"a/%c", "bob", "", "", false},
+		{"a/%u", "b+", "c1", "", false},
+		{"a/%u", "b/c", "c1", "", false},
+		{"a/%c", "bob", "c#", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := substitute(tt.pattern, tt.username, tt.clientId)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s with %q %q: got %q %v, want %q %v", tt.pattern, tt.username, tt.clientId, got, ok,
+				tt.want, tt.ok)
+		}
+	}
+}
+
+// access rules of broker store: denied subscription is refused, denied message is acknowledged but not
+// routed, reloaded rules are applied to existing subscriptions
+func TestACL(t *testing.T) {
+	store := db.NewMemory()
+	store.SaveACL(db.ACLRule{Kind: db.ACLClient, Name: "dev", Topic: "dev/#", Access: db.AccessReadWrite})
+	s, addr := newTestServer(t, []Option{WithStore(store), WithACL(false)})
+
+	watcher := &inbox{}
+	if _, err := s.Subscribe("#", packet.AtMostOnce, watcher.handler); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, _ := rawClient(t, addr, rawConnect("MQTT", 4, 0x02, "dev"))
+	if codes := rawSubscribe(t, conn, 1, "dev/#", "other/#"); len(codes) != 2 || codes[0] != 1 || codes[1] != 0x80 {
+		t.Fatalf("SUBACK return codes %v, want [1 128]", codes)
+	}
+
+	for i, topic := range []string{"other/x", "dev/x"} {
+		publish := packet.NewPublish()
+		publish.Id = uint16(i + 1)
+		publish.Topic = topic
+		publish.Payload = topic
+		publish.QoS = 1
+		packet.WritePacket(conn, publish, false)
+		if puback, ok := readPacket(t, conn).(*packet.PubAckPacket); !ok || puback.Id != publish.Id {
+			t.Fatalf("PUBACK %d expected", publish.Id)
+		}
+	}
+	if publish, ok := readPacket(t, conn).(*packet.PublishPacket); !ok || publish.Topic != "dev/x" {
+		t.Fatal("PUBLISH dev/x expected")
+	}
+	waitFor(t, "routed message", func() bool { return len(watcher.payloads()) == 1 })
+	if got := watcher.payloads(); got[0] != "dev/x" {
+		t.Errorf("routed %v, want only dev/x", got)
+	}
+
+	// rules are swapped
+	store.DeleteACL(db.ACLClient, "dev", "dev/#")
+	store.SaveACL(db.ACLRule{Kind: db.ACLClient, Name: "dev", Topic: "other/#", Access: db.AccessReadWrite})
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if codes := rawSubscribe(t, conn, 1, "other/#"); len(codes) != 1 || codes[0] != 1 {
+		t.Fatalf("SUBACK return codes %v after reload, want [1]", codes)
+	}
+	s.Publish("dev/y", "dev/y", packet.AtMostOnce, false)
+	s.Publish("other/y", "other/y", packet.AtMostOnce, false)
+	if publish, ok := readPacket(t, conn).(*packet.PublishPacket); !ok || publish.Topic != "other/y" {
+		t.Fatal("PUBLISH other/y expected, dev/y is denied by new rules")
+	}
+}
+
+// client publishing to denied topic is disconnected with kick
+func TestACLKick(t *testing.T) {
+	_, addr := newTestServer(t, []Option{WithACL(true)})
+
+	conn, _ := rawClient(t, addr, rawConnect("MQTT", 4, 0x02, "dev"))
+	publish := packet.NewPublish()
+	publish.Topic = "t"
+	packet.WritePacket(conn, publish, false)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if data, err := io.ReadAll(conn); err != nil || len(data) != 0 {
+		t.Errorf("got % x, %v, want connection closed", data, err)
+	}
+}
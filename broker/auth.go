@@ -0,0 +1,48 @@
+package broker
+
+import (
+	"errors"
+	"time"
+
+	"github.com/MajaSuite/mqtt/db"
+)
+
+var ErrNotAuthorized = errors.New("mqtt: not authorized")
+
+// Credentials of connecting client. Authenticator may limit the client by Expires and Authorizer.
+type Credentials struct {
+	ClientID string
+	Username string
+	Password string
+
+	Expires    time.Time  // client is disconnected at this time, zero - never
+	Authorizer Authorizer // check access of the client instead of broker authorizer, if set
+}
+
+// Authenticator check client credentials on connect
+type Authenticator interface {
+	Authenticate(c *Credentials) error
+}
+
+// Authorizer check client access to topic. Access is db.AccessRead (topic may be topic filter when client
+// subscribe) or db.AccessWrite.
+type Authorizer interface {
+	Authorize(username string, clientId string, topic string, access int) bool
+}
+
+// Reloader is implemented by authenticators and authorizers which can reload their data without restart
+type Reloader interface {
+	Reload() error
+}
+
+// DBAuth authenticate users of broker store
+type DBAuth struct {
+	Store db.Store
+}
+
+func (a DBAuth) Authenticate(c *Credentials) error {
+	if err := a.Store.CheckAuth(c.Username, c.Password); err != nil {
+		return ErrNotAuthorized
+	}
+	return nil
+}
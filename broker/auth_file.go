@@ -0,0 +1,90 @@
+package broker
+
+import (
+	"bufio"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/MajaSuite/mqtt/db"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// FileAuth authenticate users of htpasswd-style file: one "username:bcrypt hash" per line (htpasswd -B),
+// empty lines and lines started with # are ignored.
+type FileAuth struct {
+	path  string
+	mu    sync.RWMutex
+	users map[string]string
+}
+
+func NewFileAuth(path string) (*FileAuth, error) {
+	a := &FileAuth{path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Reload read password file again
+func (a *FileAuth) Reload() error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			slog.Warn("wrong format, expect username:hash", "file", a.path, "line", line)
+			continue
+		}
+
+		if _, err := bcrypt.Cost([]byte(parts[1])); err != nil {
+			slog.Warn("only bcrypt hashes are supported", "file", a.path, "line", line)
+			continue
+		}
+
+		users[parts[0]] = parts[1]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.users = users
+	a.mu.Unlock()
+
+	slog.Info("loaded users", "count", len(users), "file", a.path)
+
+	return nil
+}
+
+func (a *FileAuth) Authenticate(c *Credentials) error {
+	a.mu.RLock()
+	hash, ok := a.users[c.Username]
+	a.mu.RUnlock()
+
+	if !ok {
+		bcrypt.CompareHashAndPassword(db.DummyPasswordHash(), []byte(c.Password))
+		return ErrNotAuthorized
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(c.Password)); err != nil {
+		return ErrNotAuthorized
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/MajaSuite/mqtt/db"
+)
+
+// HTTPAuth delegate authentication and authorization to http service. Broker send POST request with json
+// body, status 200 means access is granted, anything else - denied.
+//
+// Authentication request: {"clientid": "...", "username": "...", "password": "..."}
+// Authorization request: {"clientid": "...", "username": "...", "topic": "...", "access": "read"|"write"}
+//
+// Authorization answers are cached, because authorization is checked for every published message.
+type HTTPAuth struct {
+	authURL string
+	aclURL  string
+	ttl     time.Duration
+	client  *http.Client
+
+	mu    sync.Mutex
+	cache map[aclRequest]aclAnswer
+}
+
+type authRequest struct {
+	ClientID string `json:"clientid"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type aclRequest struct {
+	ClientID string `json:"clientid"`
+	Username string `json:"username"`
+	Topic    string `json:"topic"`
+	Access   string `json:"access"`
+}
+
+type aclAnswer struct {
+	allowed bool
+	expires time.Time
+}
+
+// NewHTTPAuth create authenticator (authURL) and authorizer (aclURL) calling http service. Authorization
+// answers are cached for ttl.
+func NewHTTPAuth(authURL string, aclURL string, ttl time.Duration) *HTTPAuth {
+	return &HTTPAuth{
+		authURL: authURL,
+		aclURL:  aclURL,
+		ttl:     ttl,
+		client:  &http.Client{Timeout: time.Second * 5},
+		cache:   make(map[aclRequest]aclAnswer),
+	}
+}
+
+func (a *HTTPAuth) Authenticate(c *Credentials) error {
+	if !a.post(a.authURL, &authRequest{ClientID: c.ClientID, Username: c.Username, Password: c.Password}) {
+		return ErrNotAuthorized
+	}
+	return nil
+}
+
+func (a *HTTPAuth) Authorize(username string, clientId string, topic string, access int) bool {
+	req := aclRequest{ClientID: clientId, Username: username, Topic: topic, Access: "read"}
+	if access == db.AccessWrite {
+		req.Access = "write"
+	}
+
+	a.mu.Lock()
+	answer, ok := a.cache[req]
+	a.mu.Unlock()
+	if ok && time.Now().Before(answer.expires) {
+		return answer.allowed
+	}
+
+	allowed := a.post(a.aclURL, &req)
+
+	a.mu.Lock()
+	if len(a.cache) > 10000 {
+		a.cache = make(map[aclRequest]aclAnswer)
+	}
+	a.cache[req] = aclAnswer{allowed: allowed, expires: time.Now().Add(a.ttl)}
+	a.mu.Unlock()
+
+	return allowed
+}
+
+// Reload drop cached authorization answers
+func (a *HTTPAuth) Reload() error {
+	a.mu.Lock()
+	a.cache = make(map[aclRequest]aclAnswer)
+	a.mu.Unlock()
+
+	return nil
+}
+
+func (a *HTTPAuth) post(url string, body interface{}) bool {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return false
+	}
+
+	resp, err := a.client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		slog.Error("error call auth service", "url", url, "err", err)
+		return false
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode == http.StatusOK
+}
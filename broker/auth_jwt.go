@@ -0,0 +1,373 @@
+package broker
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MajaSuite/mqtt/db"
+)
+
+var ErrInvalidToken = errors.New("mqtt: invalid token")
+
+// JWTAuth authenticate clients by JWT passed in CONNECT password. Token signature (HS256, RS256 or ES256),
+// expiry (exp, nbf) and audience (aud) are checked, subject (sub) is required and must be equal to username.
+// Client is disconnected when token expires. Token may limit client access to topics by claim
+//
+//	"acl": {"publish": ["sensor/%u/#"], "subscribe": ["home/#"]}
+//
+// otherwise access is checked by broker authorizer.
+//
+// Key file is one of: JWKS (json), PEM encoded public keys or certificates (RS256, ES256) or shared
+// secret (HS256, whole file without trailing new line).
+type JWTAuth struct {
+	path     string
+	audience string
+
+	mu   sync.RWMutex
+	keys []jwtKey
+}
+
+type jwtKey struct {
+	id  string
+	key interface{} // []byte, *rsa.PublicKey or *ecdsa.PublicKey
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Subject   string      `json:"sub"`
+	Audience  interface{} `json:"aud"` // string or array of strings
+	ExpiresAt *float64    `json:"exp"`
+	NotBefore *float64    `json:"nbf"`
+	ACL       *struct {
+		Publish   []string `json:"publish"`
+		Subscribe []string `json:"subscribe"`
+	} `json:"acl"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// NewJWTAuth create authenticator checking tokens by keys of the file. Audience isn't checked if empty.
+func NewJWTAuth(path string, audience string) (*JWTAuth, error) {
+	a := &JWTAuth{path: path, audience: audience}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Reload read key file again
+func (a *JWTAuth) Reload() error {
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+
+	var keys []jwtKey
+	text := strings.TrimSpace(string(data))
+	switch {
+	case strings.HasPrefix(text, "{"):
+		keys, err = parseJWKS(data)
+	case strings.HasPrefix(text, "-----BEGIN"):
+		keys, err = parsePEMKeys(data)
+	default:
+		secret := strings.TrimRight(string(data), "\r\n")
+		if secret == "" {
+			return fmt.Errorf("%s: empty secret", a.path)
+		}
+		keys = []jwtKey{{key: []byte(secret)}}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", a.path, err)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("%s: no keys found", a.path)
+	}
+
+	a.mu.Lock()
+	a.keys = keys
+	a.mu.Unlock()
+
+	slog.Info("loaded jwt keys", "count", len(keys), "file", a.path)
+
+	return nil
+}
+
+func (a *JWTAuth) Authenticate(c *Credentials) error {
+	claims, err := a.verify(c.Password)
+	if err != nil {
+		slog.Info("jwt rejected", "client", c.ClientID, "username", c.Username, "err", err)
+		return ErrNotAuthorized
+	}
+
+	// username is bound to token, access rules and sessions of the user are applied to it
+	if claims.Subject == "" || claims.Subject != c.Username {
+		slog.Info("jwt rejected, subject mismatch", "client", c.ClientID, "username", c.Username, "subject", claims.Subject)
+		return ErrNotAuthorized
+	}
+
+	c.Expires = time.Unix(int64(*claims.ExpiresAt), 0)
+
+	if claims.ACL != nil {
+		var rules []db.ACLRule
+		for _, topic := range claims.ACL.Publish {
+			rules = append(rules, db.ACLRule{Kind: db.ACLPattern, Topic: topic, Access: db.AccessWrite})
+		}
+		for _, topic := range claims.ACL.Subscribe {
+			rules = append(rules, db.ACLRule{Kind: db.ACLPattern, Topic: topic, Access: db.AccessRead})
+		}
+		c.Authorizer = NewACL(rules)
+	}
+
+	return nil
+}
+
+// check token signature and claims
+func (a *JWTAuth) verify(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if !a.verifySignature(header, parts[0]+"."+parts[1], signature) {
+		return nil, errors.New("wrong signature")
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	now := float64(time.Now().Unix())
+	if claims.ExpiresAt == nil {
+		return nil, errors.New("no expiration time")
+	}
+	if now >= *claims.ExpiresAt {
+		return nil, errors.New("token expired")
+	}
+	if claims.NotBefore != nil && now < *claims.NotBefore {
+		return nil, errors.New("token not valid yet")
+	}
+
+	if a.audience != "" && !hasAudience(claims.Audience, a.audience) {
+		return nil, errors.New("wrong audience")
+	}
+
+	return &claims, nil
+}
+
+// try keys suitable for the algorithm, only key with the same id if token has it
+func (a *JWTAuth) verifySignature(header jwtHeader, signed string, signature []byte) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	digest := sha256.Sum256([]byte(signed))
+
+	for _, k := range a.keys {
+		if header.Kid != "" && k.id != "" && header.Kid != k.id {
+			continue
+		}
+
+		switch key := k.key.(type) {
+		case []byte:
+			if header.Alg != "HS256" {
+				continue
+			}
+			mac := hmac.New(sha256.New, key)
+			mac.Write([]byte(signed))
+			if hmac.Equal(mac.Sum(nil), signature) {
+				return true
+			}
+		case *rsa.PublicKey:
+			if header.Alg != "RS256" {
+				continue
+			}
+			if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil {
+				return true
+			}
+		case *ecdsa.PublicKey:
+			if header.Alg != "ES256" || key.Curve != elliptic.P256() || len(signature) != 64 {
+				continue
+			}
+			r := new(big.Int).SetBytes(signature[:32])
+			s := new(big.Int).SetBytes(signature[32:])
+			if ecdsa.Verify(key, digest[:], r, s) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return ErrInvalidToken
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+func hasAudience(aud interface{}, audience string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == audience
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func parsePEMKeys(data []byte) ([]jwtKey, error) {
+	var keys []jwtKey
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		var key interface{}
+		switch block.Type {
+		case "PUBLIC KEY":
+			pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			key = pub
+		case "RSA PUBLIC KEY":
+			pub, err := x509.ParsePKCS1PublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			key = pub
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			key = cert.PublicKey
+		default:
+			continue
+		}
+
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+			keys = append(keys, jwtKey{key: key})
+		}
+	}
+
+	return keys, nil
+}
+
+func parseJWKS(data []byte) ([]jwtKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	var keys []jwtKey
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", k.Kid, err)
+		}
+		if key != nil {
+			keys = append(keys, jwtKey{id: k.Kid, key: key})
+		}
+	}
+
+	return keys, nil
+}
+
+// key of json web key, nil if key type is not supported
+func (k *jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil {
+			return nil, err
+		}
+		if len(secret) == 0 {
+			return nil, errors.New("empty secret")
+		}
+		return secret, nil
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("wrong coordinates")
+		}
+		return ecdsa.ParseUncompressedPublicKey(elliptic.P256(), append(append([]byte{4}, x...), y...))
+	}
+
+	return nil, nil
+}
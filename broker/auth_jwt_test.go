@@ -0,0 +1,116 @@
+package broker
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MajaSuite/mqtt/db"
+)
+
+// HS256 token with given claims
+func hs256Token(t *testing.T, secret string, claims map[string]interface{}) string {
+	t.Helper()
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTAuth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := NewJWTAuth(path, "mqtt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := time.Now().Add(time.Hour).Unix()
+	// claims of valid token for alice with changes
+	claims := func(changes ...interface{}) map[string]interface{} {
+		res := map[string]interface{}{"sub": "alice", "exp": exp, "aud": "mqtt"}
+		for i := 0; i < len(changes); i += 2 {
+			if changes[i+1] == nil {
+				delete(res, changes[i].(string))
+			} else {
+				res[changes[i].(string)] = changes[i+1]
+			}
+		}
+		return res
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		token    string
+		ok       bool
+	}{
+		{"valid", "alice", hs256Token(t, "secret", claims()), true},
+		{"audience in list", "alice", hs256Token(t, "secret", claims("aud", []string{"web", "mqtt"})), true},
+		{"no subject", "alice", hs256Token(t, "secret", claims("sub", nil)), false},
+		{"other subject", "bob", hs256Token(t, "secret", claims()), false},
+		{"no expiration", "alice", hs256Token(t, "secret", claims("exp", nil)), false},
+		{"expired", "alice", hs256Token(t, "secret", claims("exp", time.Now().Unix()-1)), false},
+		{"not valid yet", "alice", hs256Token(t, "secret", claims("nbf", exp-60)), false},
+		{"wrong audience", "alice", hs256Token(t, "secret", claims("aud", "web")), false},
+		{"wrong signature", "alice", hs256Token(t, "other", claims()), false},
+		{"not token", "alice", "password", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Credentials{ClientID: "c1", Username: tt.username, Password: tt.token}
+			err := auth.Authenticate(c)
+			if tt.ok && err != nil {
+				t.Fatalf("rejected: %v", err)
+			}
+			if !tt.ok && err != ErrNotAuthorized {
+				t.Fatalf("got %v, want ErrNotAuthorized", err)
+			}
+			if tt.ok && c.Expires.Unix() != exp {
+				t.Errorf("expires %v, want %d", c.Expires, exp)
+			}
+		})
+	}
+
+	// access rules of token
+	acl := map[string][]string{"publish": {"sensor/%u/#"}, "subscribe": {"home/#"}}
+	c := &Credentials{Username: "alice", Password: hs256Token(t, "secret", claims("acl", acl))}
+	if err := auth.Authenticate(c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Authorizer == nil {
+		t.Fatal("no authorizer of token acl")
+	}
+	for _, tt := range []struct {
+		topic  string
+		access int
+		ok     bool
+	}{
+		{"sensor/alice/t", db.AccessWrite, true},
+		{"sensor/bob/t", db.AccessWrite, false},
+		{"sensor/alice/t", db.AccessRead, false},
+		{"home/a", db.AccessRead, true},
+		{"home/a", db.AccessWrite, false},
+	} {
+		if got := c.Authorizer.Authorize("alice", "c1", tt.topic, tt.access); got != tt.ok {
+			t.Errorf("%s access %d: got %v, want %v", tt.topic, tt.access, got, tt.ok)
+		}
+	}
+}
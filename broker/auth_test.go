@@ -0,0 +1,207 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MajaSuite/mqtt/db"
+	"github.com/MajaSuite/mqtt/packet"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHTTPAuth(t *testing.T) {
+	var aclCalls int32
+	allowed := "home/a"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
+		var req authRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Username == "alice" && req.Password == "secret" && req.ClientID == "c1" {
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+	})
+	mux.HandleFunc("/acl", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&aclCalls, 1)
+		var req aclRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Username == "alice" && req.Topic == allowed && req.Access == "write" {
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+	hs := httptest.NewServer(mux)
+	defer hs.Close()
+
+	a := NewHTTPAuth(hs.URL+"/auth", hs.URL+"/acl", time.Minute)
+
+	if err := a.Authenticate(&Credentials{ClientID: "c1", Username: "alice", Password: "secret"}); err != nil {
+		t.Errorf("valid credentials rejected: %v", err)
+	}
+	if err := a.Authenticate(&Credentials{ClientID: "c1", Username: "alice", Password: "wrong"}); err != ErrNotAuthorized {
+		t.Errorf("wrong password: got %v, want ErrNotAuthorized", err)
+	}
+
+	if !a.Authorize("alice", "c1", "home/a", db.AccessWrite) {
+		t.Error("allowed topic denied")
+	}
+	if a.Authorize("alice", "c1", "home/a", db.AccessRead) {
+		t.Error("read access allowed")
+	}
+	if a.Authorize("alice", "c1", "home/b", db.AccessWrite) {
+		t.Error("other topic allowed")
+	}
+	if calls := atomic.LoadInt32(&aclCalls); calls != 3 {
+		t.Errorf("acl service called %d times, want 3", calls)
+	}
+
+	// answers are cached, even after service changed its mind
+	allowed = "home/b"
+	if !a.Authorize("alice", "c1", "home/a", db.AccessWrite) || a.Authorize("alice", "c1", "home/b", db.AccessWrite) {
+		t.Error("cached answers are not used")
+	}
+	if calls := atomic.LoadInt32(&aclCalls); calls != 3 {
+		t.Errorf("acl service called %d times, want 3", calls)
+	}
+
+	// reload clears cache
+	if err := a.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if a.Authorize("alice", "c1", "home/a", db.AccessWrite) || !a.Authorize("alice", "c1", "home/b", db.AccessWrite) {
+		t.Error("cached answers are used after reload")
+	}
+	if calls := atomic.LoadInt32(&aclCalls); calls != 5 {
+		t.Errorf("acl service called %d times, want 5", calls)
+	}
+
+	// service is down
+	hs.Close()
+	a.Reload()
+	if err := a.Authenticate(&Credentials{ClientID: "c1", Username: "alice", Password: "secret"}); err != ErrNotAuthorized {
+		t.Errorf("service down: got %v, want ErrNotAuthorized", err)
+	}
+	if a.Authorize("alice", "c1", "home/b", db.AccessWrite) {
+		t.Error("service down: access allowed")
+	}
+}
+
+func TestFileAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "passwd")
+	data := "# users\n\nalice:" + string(hash) + "\nbob:plaintext\nbroken line\n"
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewFileAuth(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		username string
+		password string
+		ok       bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "plaintext", false}, // only bcrypt hashes are accepted
+		{"broken line", "", false},
+		{"carol", "secret", false},
+	}
+	for _, tt := range tests {
+		err := a.Authenticate(&Credentials{Username: tt.username, Password: tt.password})
+		if tt.ok && err != nil {
+			t.Errorf("%s: rejected: %v", tt.username, err)
+		}
+		if !tt.ok && err != ErrNotAuthorized {
+			t.Errorf("%s: got %v, want ErrNotAuthorized", tt.username, err)
+		}
+	}
+
+	// reload picks up new users
+	if err := os.WriteFile(path, []byte("carol:"+string(hash)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Authenticate(&Credentials{Username: "carol", Password: "secret"}); err != nil {
+		t.Errorf("carol: rejected after reload: %v", err)
+	}
+	if err := a.Authenticate(&Credentials{Username: "alice", Password: "secret"}); err != ErrNotAuthorized {
+		t.Errorf("alice: got %v after reload, want ErrNotAuthorized", err)
+	}
+
+	if _, err := NewFileAuth(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("missing file accepted")
+	}
+}
+
+// broker isn't blocked while slow acl service is asked: other clients subscribe, publish and receive messages
+func TestHTTPAuthSlow(t *testing.T) {
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/acl", func(w http.ResponseWriter, r *http.Request) {
+		var req aclRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Topic == "slow" {
+			<-release
+		}
+	})
+	hs := httptest.NewServer(mux)
+	defer hs.Close()
+	defer close(release)
+
+	s, addr := newTestServer(t, []Option{WithAuthorizer(NewHTTPAuth("", hs.URL+"/acl", time.Minute), false)})
+	watcher := &inbox{}
+	if _, err := s.Subscribe("#", packet.AtMostOnce, watcher.handler); err != nil {
+		t.Fatal(err)
+	}
+
+	slow, _ := rawClient(t, addr, rawConnect("MQTT", 4, 0x02, "slow"))
+	publish := packet.NewPublish()
+	publish.Topic = "slow"
+	publish.Payload = "slow"
+	packet.WritePacket(slow, publish, false)
+
+	start := time.Now()
+	fast, _ := rawClient(t, addr, rawConnect("MQTT", 4, 0x02, "fast"))
+	if codes := rawSubscribe(t, fast, 1, "fast/#"); len(codes) != 1 || codes[0] != 1 {
+		t.Fatalf("SUBACK return codes %v, want [1]", codes)
+	}
+	publish = packet.NewPublish()
+	publish.Id = 1
+	publish.Topic = "fast/x"
+	publish.Payload = "fast"
+	publish.QoS = 1
+	packet.WritePacket(fast, publish, false)
+	if _, ok := readPacket(t, fast).(*packet.PubAckPacket); !ok {
+		t.Fatal("PUBACK expected")
+	}
+	if p, ok := readPacket(t, fast).(*packet.PublishPacket); !ok || p.Topic != "fast/x" {
+		t.Fatal("PUBLISH fast/x expected")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("other client served in %v while acl service is slow", elapsed)
+	}
+	if got := watcher.payloads(); len(got) != 1 || got[0] != "fast" {
+		t.Errorf("routed %v, want only fast", got)
+	}
+
+	// message is routed when acl service answers
+	release <- struct{}{}
+	waitFor(t, "slow message", func() bool { return len(watcher.payloads()) == 2 })
+}
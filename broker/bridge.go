@@ -0,0 +1,411 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MajaSuite/mqtt/client"
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+var ErrInvalidBridge = errors.New("mqtt: invalid bridge config")
+
+// directions of bridge rule
+const (
+	BridgeIn   = "in"   // messages of remote broker are published to local one
+	BridgeOut  = "out"  // messages of local broker are published to remote one
+	BridgeBoth = "both" // both ways
+)
+
+// time to remember message sent to remote broker to recognize it when it comes back
+const bridgeEchoTimeout = time.Minute
+
+// max messages published to remote broker and waiting for acknowledge. Bridge stops to take messages of local
+// broker while window is full, they are queued and dropped as for slow client.
+const bridgeWindow = 100
+
+// time to wait for acknowledge of remote broker, message stays in-flight and is sent after reconnect
+const bridgeAckTimeout = time.Second * 10
+
+// BridgeRule select topics mirrored by bridge. Topic filter is the same on both brokers except prefixes:
+// local topic "home/a/sensor/t" with local prefix "home/a/" and remote prefix "homes/1/" is "homes/1/sensor/t"
+// on remote broker.
+type BridgeRule struct {
+	Topic        string     `json:"topic"`     // topic filter without prefix
+	Direction    string     `json:"direction"` // in, out or both
+	QoS          packet.QoS `json:"qos"`       // max qos of mirrored messages
+	LocalPrefix  string     `json:"local_prefix"`
+	RemotePrefix string     `json:"remote_prefix"`
+}
+
+func (r BridgeRule) in() bool {
+	return r.Direction == BridgeIn || r.Direction == BridgeBoth
+}
+
+func (r BridgeRule) out() bool {
+	return r.Direction == BridgeOut || r.Direction == BridgeBoth
+}
+
+// BridgeConfig describe connection to remote broker. Remote broker keeps session of the bridge unless
+// CleanSession is set (this broker requires username for that).
+type BridgeConfig struct {
+	Name         string       `json:"name"`     // name of the bridge, client id on remote broker by default
+	Address      string       `json:"address"`  // host:port of remote broker
+	ClientID     string       `json:"clientid"` // client id on remote broker
+	Username     string       `json:"username"`
+	Password     string       `json:"password"`
+	CleanSession bool         `json:"clean_session"`
+	TLS          bool         `json:"tls"`    // connect over tls
+	CAFile       string       `json:"cafile"` // CA to verify remote broker, system pool if empty
+	CertFile     string       `json:"cert"`   // client certificate
+	KeyFile      string       `json:"key"`
+	Insecure     bool         `json:"insecure"`      // do not verify remote broker certificate
+	ReconnectMin int          `json:"reconnect_min"` // first reconnect delay in seconds, 1 by default
+	ReconnectMax int          `json:"reconnect_max"` // max reconnect delay in seconds, 60 by default
+	Rules        []BridgeRule `json:"rules"`
+}
+
+// LoadBridges read json array of bridge configs from file
+func LoadBridges(path string) ([]BridgeConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []BridgeConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return configs, nil
+}
+
+// Bridge mirror topics between the server and remote broker
+type Bridge struct {
+	config BridgeConfig
+	server *Server
+	local  *Client        // in-process client subscribed to topics of out rules
+	remote *client.Client // connection to remote broker
+	log    *slog.Logger
+	quit   chan struct{}
+	window chan struct{} // slot of every message waiting for acknowledge of remote broker
+
+	mu     sync.Mutex
+	closed bool
+	echo   map[string][]time.Time // messages sent to remote broker, they are dropped when come back
+}
+
+// Bridge connect the server to remote broker. Connection is established in background and restored with
+// growing delay when lost. Messages published by bridge are not sent back, so rules in both directions
+// don't loop.
+func (s *Server) Bridge(config BridgeConfig) (*Bridge, error) {
+	if config.Name == "" || config.Address == "" {
+		return nil, ErrInvalidBridge
+	}
+	for _, rule := range config.Rules {
+		if rule.Topic == "" || !rule.in() && !rule.out() || !rule.QoS.Valid() {
+			return nil, fmt.Errorf("%w: rule %q %q", ErrInvalidBridge, rule.Topic, rule.Direction)
+		}
+	}
+	if config.ClientID == "" {
+		config.ClientID = config.Name
+	}
+	if config.ReconnectMin <= 0 {
+		config.ReconnectMin = 1
+	}
+	if config.ReconnectMax < config.ReconnectMin {
+		config.ReconnectMax = max(60, config.ReconnectMin)
+	}
+
+	br := &Bridge{
+		config: config,
+		server: s,
+		log:    slog.With("bridge", config.Name, "remote", config.Address),
+		quit:   make(chan struct{}),
+		window: make(chan struct{}, bridgeWindow),
+		echo:   make(map[string][]time.Time),
+	}
+
+	opts := []client.Option{
+		client.WithClientId(config.ClientID),
+		client.WithAuth(config.Username, config.Password),
+		client.WithCleanSession(config.CleanSession),
+		client.WithReconnect(time.Duration(config.ReconnectMin)*time.Second,
+			time.Duration(config.ReconnectMax)*time.Second),
+		client.WithOnConnect(func(bool) {
+			br.log.Info("bridge connected")
+			go br.connected()
+		}),
+	}
+	if config.TLS {
+		tlsConfig, err := client.NewTLSConfig(config.CAFile, config.CertFile, config.KeyFile, config.Insecure)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, client.WithTLS(tlsConfig))
+	}
+	br.remote = client.New(config.Address, opts...)
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, ErrServerClosed
+	}
+	s.bridges = append(s.bridges, br)
+	s.mu.Unlock()
+
+	// local side is ready at once, messages are dropped while remote broker is not connected
+	b := s.broker
+	br.local = newLocalClient("$bridge-"+config.Name, br.toRemote, b)
+	br.local.bridge = true
+
+	topics := []packet.SubscribePayload{}
+	for _, rule := range config.Rules {
+		if rule.out() {
+			topics = append(topics, packet.SubscribePayload{Topic: rule.LocalPrefix + rule.Topic, QoS: rule.QoS})
+		}
+	}
+
+	b.mu.Lock()
+	b.clients[br.local.clientId] = br.local
+	b.subscribe(br.local, topics)
+	b.mu.Unlock()
+
+	go br.local.Start()
+	go br.connect()
+
+	return br, nil
+}
+
+// Close disconnect bridge from remote broker and stop mirroring
+func (br *Bridge) Close() {
+	br.mu.Lock()
+	if br.closed {
+		br.mu.Unlock()
+		return
+	}
+	br.closed = true
+	close(br.quit)
+	br.mu.Unlock()
+
+	br.remote.Disconnect()
+
+	s := br.server
+	s.mu.Lock()
+	for i, other := range s.bridges {
+		if other == br {
+			s.bridges = append(s.bridges[:i], s.bridges[i+1:]...)
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	b := s.broker
+	b.mu.Lock()
+	b.disconnect(br.local)
+	b.mu.Unlock()
+}
+
+// first connect to remote broker, client reconnects by itself after that
+func (br *Bridge) connect() {
+	delay := time.Duration(br.config.ReconnectMin) * time.Second
+	for {
+		err := br.remote.Connect()
+		if err == nil || err == client.ErrClosed {
+			return
+		}
+		br.log.Warn("error connect to remote broker", "err", err)
+
+		select {
+		case <-br.quit:
+			return
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > time.Duration(br.config.ReconnectMax)*time.Second {
+			delay = time.Duration(br.config.ReconnectMax) * time.Second
+		}
+	}
+}
+
+// subscribe to topics of in rules on remote broker and send local retained messages of out rules
+func (br *Bridge) connected() {
+	for i, rule := range br.config.Rules {
+		if !rule.in() {
+			continue
+		}
+
+		if _, err := br.remote.Subscribe(rule.RemotePrefix+rule.Topic, rule.QoS, func(pkt *packet.PublishPacket) {
+			br.toLocal(i, pkt)
+		}); err != nil {
+			br.log.Warn("error subscribe on remote broker", "topic", rule.RemotePrefix+rule.Topic, "err", err)
+		}
+	}
+
+	b := br.server.broker
+	retained := []*packet.PublishPacket{}
+	b.mu.Lock()
+	for _, m := range b.retained.all() {
+		if _, ok := br.local.match(m.Topic); ok {
+			retained = append(retained, m)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, m := range retained {
+		br.toRemote(m)
+	}
+}
+
+// message of remote broker matched rule i
+func (br *Bridge) toLocal(i int, pkt *packet.PublishPacket) {
+	// handler is called for every matched subscription, message is taken by the first rule only
+	rule := br.inRule(pkt.Topic)
+	if rule == nil || rule != &br.config.Rules[i] {
+		return
+	}
+
+	if br.isEcho(pkt) {
+		return
+	}
+
+	publish := packet.NewPublish()
+	publish.Topic = rule.LocalPrefix + strings.TrimPrefix(pkt.Topic, rule.RemotePrefix)
+	publish.Payload = pkt.Payload
+	publish.QoS = min(pkt.QoS, rule.QoS)
+	publish.Retain = pkt.Retain
+	publish.SetSource(br.local.clientId)
+
+	b := br.server.broker
+	b.mu.Lock()
+	if !br.local.Stopped() {
+		b.route(publish)
+	}
+	b.mu.Unlock()
+}
+
+// message of local broker matched out rule
+func (br *Bridge) toRemote(pkt *packet.PublishPacket) {
+	var rule *BridgeRule
+	for i := range br.config.Rules {
+		r := &br.config.Rules[i]
+		if r.out() && packet.MatchTopic(r.LocalPrefix+r.Topic, pkt.Topic) {
+			rule = r
+			break
+		}
+	}
+	if rule == nil {
+		return
+	}
+
+	topic := rule.RemotePrefix + strings.TrimPrefix(pkt.Topic, rule.LocalPrefix)
+	// echo is expected before publish, it may come back before publish returns
+	echo := br.inRule(topic) != nil
+	if echo {
+		br.expectEcho(topic, pkt.Payload)
+	}
+
+	// message is sent at once, acknowledge is waited in background within window
+	select {
+	case br.window <- struct{}{}:
+	case <-br.quit:
+		return
+	}
+
+	done, err := br.remote.PublishAsync(topic, pkt.Payload, min(pkt.QoS, rule.QoS), pkt.Retain)
+	if err != nil {
+		<-br.window
+		br.log.Warn("error publish to remote broker, message dropped", "topic", topic, "err", err)
+		if echo {
+			br.forgetEcho(topic, pkt.Payload)
+		}
+		return
+	}
+
+	go func() {
+		defer func() { <-br.window }()
+
+		select {
+		case <-done:
+		case <-br.quit:
+		case <-time.After(bridgeAckTimeout):
+			// message stays in-flight and is sent after reconnect
+			br.log.Warn("no acknowledge of remote broker, message will be sent again", "topic", topic)
+		}
+	}()
+}
+
+// first in rule matched topic of remote broker
+func (br *Bridge) inRule(topic string) *BridgeRule {
+	for i := range br.config.Rules {
+		r := &br.config.Rules[i]
+		if r.in() && packet.MatchTopic(r.RemotePrefix+r.Topic, topic) {
+			return r
+		}
+	}
+	return nil
+}
+
+// remember message sent to remote broker, it will come back to our subscription. Echo is recognized by
+// topic and payload only: remote message equal to one sent by the bridge within bridgeEchoTimeout is taken
+// for its echo, so when both sides publish the same payload to the same topic at the same time (like
+// repeated "on" commands) one of them is dropped.
+func (br *Bridge) expectEcho(topic string, payload string) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	now := time.Now()
+	for key, sent := range br.echo {
+		for len(sent) > 0 && now.Sub(sent[0]) > bridgeEchoTimeout {
+			sent = sent[1:]
+		}
+		if len(sent) == 0 {
+			delete(br.echo, key)
+		} else {
+			br.echo[key] = sent
+		}
+	}
+
+	key := topic + "\x00" + payload
+	br.echo[key] = append(br.echo[key], now)
+}
+
+// message is not sent to remote broker, it won't come back
+func (br *Bridge) forgetEcho(topic string, payload string) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	key := topic + "\x00" + payload
+	sent := br.echo[key]
+	if len(sent) <= 1 {
+		delete(br.echo, key)
+	} else {
+		br.echo[key] = sent[:len(sent)-1]
+	}
+}
+
+// check if message of remote broker was sent by the bridge
+func (br *Bridge) isEcho(pkt *packet.PublishPacket) bool {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	key := pkt.Topic + "\x00" + pkt.Payload
+	sent := br.echo[key]
+	if len(sent) == 0 {
+		return false
+	}
+
+	if len(sent) == 1 {
+		delete(br.echo, key)
+	} else {
+		br.echo[key] = sent[1:]
+	}
+	return true
+}
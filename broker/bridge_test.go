@@ -0,0 +1,186 @@
+package broker
+
+import (
+	"net"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+// client of the server is connected and subscribed to the filter
+func subscribed(s *Server, clientId string, filter string) bool {
+	for _, info := range s.Clients() {
+		if info.ClientID == clientId && info.Connected {
+			for _, sub := range info.Subscriptions {
+				if sub.Topic == filter {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func TestBridge(t *testing.T) {
+	local, _ := newTestServer(t, nil)
+	remote, addr := newTestServer(t, nil)
+
+	// retained message is pushed to remote broker on connect
+	local.Publish("home/sensor/r", "1", 0, true)
+
+	br, err := local.Bridge(BridgeConfig{
+		Name:         "home-a",
+		Address:      addr,
+		CleanSession: true,
+		Rules: []BridgeRule{
+			{Topic: "sensor/#", Direction: BridgeOut, QoS: 1, LocalPrefix: "home/", RemotePrefix: "homes/a/"},
+			{Topic: "cmd/#", Direction: BridgeIn, QoS: 1, LocalPrefix: "home/", RemotePrefix: "homes/a/"},
+			{Topic: "sync/#", Direction: BridgeBoth, QoS: 1, LocalPrefix: "home/", RemotePrefix: "homes/a/"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer br.Close()
+
+	waitFor(t, "bridge subscriptions", func() bool {
+		return subscribed(remote, "home-a", "homes/a/cmd/#") && subscribed(remote, "home-a", "homes/a/sync/#")
+	})
+	waitFor(t, "retained push", func() bool { return retainedPayload(remote, "homes/a/sensor/r") == "1" })
+
+	var localIn, remoteIn inbox
+	if _, err := local.Subscribe("home/#", 1, localIn.handler); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.Subscribe("homes/#", 1, remoteIn.handler); err != nil {
+		t.Fatal(err)
+	}
+	// retained messages are delivered on subscribe
+	waitFor(t, "retained messages", func() bool {
+		return len(localIn.payloads()) == 1 && len(remoteIn.payloads()) == 1
+	})
+
+	// out: local to remote with prefix remapping
+	local.Publish("home/sensor/t", "21", 1, false)
+	// in: remote to local
+	remote.Publish("homes/a/cmd/light", "on", 1, false)
+	// not mirrored
+	local.Publish("home/cmd/light", "off", 1, false)
+	remote.Publish("homes/a/sensor/t", "0", 1, false)
+	// both: delivered on each side once, echo is not sent back
+	local.Publish("home/sync/a", "local", 1, false)
+	remote.Publish("homes/a/sync/b", "remote", 1, false)
+
+	want := map[*inbox][]string{
+		&localIn:  {"1", "21", "on", "off", "local", "remote"},
+		&remoteIn: {"1", "21", "on", "0", "local", "remote"},
+	}
+	for in, payloads := range want {
+		waitFor(t, "mirrored messages", func() bool { return len(in.payloads()) >= len(payloads) })
+	}
+
+	// give echo time to come back
+	local.Publish("home/sync/end", "end", 1, false)
+	waitFor(t, "last message", func() bool { return slices.Contains(localIn.payloads(), "end") })
+
+	for in, payloads := range want {
+		got := in.payloads()
+		slices.Sort(got)
+		payloads = append(payloads, "end")
+		slices.Sort(payloads)
+		if !slices.Equal(got, payloads) {
+			t.Errorf("got %v, want %v", got, payloads)
+		}
+	}
+
+	localIn.mu.Lock()
+	defer localIn.mu.Unlock()
+	for _, m := range localIn.messages {
+		if m.Topic == "home/cmd/light" && m.Payload == "on" && m.QoS != 1 {
+			t.Errorf("mirrored message qos %d, want 1", m.QoS)
+		}
+	}
+}
+
+func TestBridgeEchoOnError(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+
+	// nobody listens, bridge is never connected
+	br, err := s.Bridge(BridgeConfig{
+		Name:    "down",
+		Address: freeAddr(t),
+		Rules:   []BridgeRule{{Topic: "a/#", Direction: BridgeBoth}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer br.Close()
+
+	pkt := packet.NewPublish()
+	pkt.Topic = "a/b"
+	pkt.Payload = "on"
+	br.toRemote(pkt)
+
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	if len(br.echo) != 0 {
+		t.Errorf("echo of message not sent is expected: %v", br.echo)
+	}
+}
+
+// bridge doesn't wait for acknowledge of every message, but no more than window of messages is in-flight
+func TestBridgeWindow(t *testing.T) {
+	local, _ := newTestServer(t, nil)
+
+	// remote broker accepts connection and never acknowledges messages
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var received int32
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		packet.ReadPacket(conn, false)
+		conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+		for {
+			pkt, err := packet.ReadPacket(conn, false)
+			if err != nil {
+				return
+			}
+			if pkt.Type() == packet.PUBLISH {
+				atomic.AddInt32(&received, 1)
+			}
+		}
+	}()
+
+	br, err := local.Bridge(BridgeConfig{
+		Name:         "home-a",
+		Address:      l.Addr().String(),
+		CleanSession: true,
+		Rules:        []BridgeRule{{Topic: "sensor/#", Direction: BridgeOut, QoS: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer br.Close()
+	waitFor(t, "bridge connected", func() bool { return br.remote.Connected() })
+
+	for i := 0; i < bridgeWindow*2; i++ {
+		local.Publish("sensor/t", strconv.Itoa(i), packet.AtLeastOnce, false)
+	}
+	waitFor(t, "window of messages", func() bool { return atomic.LoadInt32(&received) == bridgeWindow })
+	time.Sleep(time.Millisecond * 100)
+	if n := atomic.LoadInt32(&received); n != bridgeWindow {
+		t.Errorf("remote broker received %d messages, want %d", n, bridgeWindow)
+	}
+}
@@ -2,49 +2,94 @@ package broker
 
 import (
 	"fmt"
-	"github.com/MajaSuite/mqtt/packet"
-	"log"
+	"log/slog"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/MajaSuite/mqtt/packet"
 )
 
+// space of outbound queue reserved for acknowledges and other control packets, they are not dropped
+const queueReserve = 32
+
+// Handler receive messages delivered to in-process subscriber
+type Handler func(pkt *packet.PublishPacket)
+
 type Client struct {
-	debug        bool
+	log          *slog.Logger // logger with client id and remote address
 	conn         net.Conn
 	messageId    uint16
 	clientId     string
+	username     string
+	role         string                    // username to authorize anonymous client
+	keepAlive    uint16                    // keep alive interval of CONNECT, seconds
+	authz        Authorizer                // access rules given to the client on connect
+	expire       *time.Timer               // disconnect client when credentials are expired
 	session      bool                      // persisted session (true) or clean (false)
 	subscription []packet.SubscribePayload // subscribed topics
 	ack          map[string]packet.Packet
 	will         *packet.WillMessage
 	channel      chan packet.Packet // channel to send message to client over connection
-	broker       chan packet.Packet // channel to send message to broker
+	broker       *Broker            // broker to send received messages to
+	handler      Handler            // in-process subscriber (client without connection)
+	restricted   bool               // in-process subscriber with access checked as for network clients
+	bridge       bool               // in-process bridge: its own messages are not sent back, retain flag is kept
+	stopped      int32
 }
 
-func NewClient(conn net.Conn, id string, session bool, broker chan packet.Packet, debug bool) *Client {
+func NewClient(conn net.Conn, id string, session bool, broker *Broker) *Client {
+	log := slog.With("client", id)
+	if conn != nil {
+		log = log.With("remote", conn.RemoteAddr().String())
+	}
+
 	return &Client{
-		debug:        debug,
+		log:          log,
 		conn:         conn,
-		messageId:    1,
+		messageId:    0,
 		clientId:     id,
 		session:      session,
 		subscription: []packet.SubscribePayload{},
 		ack:          make(map[string]packet.Packet),
-		channel:      make(chan packet.Packet),
+		channel:      make(chan packet.Packet, broker.queueSize+queueReserve),
 		broker:       broker,
 	}
 }
 
+// create in-process client, all messages for it passed to handler
+func newLocalClient(id string, handler Handler, broker *Broker) *Client {
+	c := NewClient(nil, id, false, broker)
+	c.handler = handler
+	return c
+}
+
 func (c *Client) Start() {
+	if c.handler != nil {
+		for p := range c.channel {
+			if pub, ok := p.(*packet.PublishPacket); ok {
+				c.handler(pub)
+			}
+		}
+		return
+	}
+
 	go func() {
 		for {
-			if pkt, err := packet.ReadPacket(c.conn, c.debug); err != nil || pkt == nil {
-				c.broker <- &packet.PacketImpl{ClientId: c.clientId}
-				log.Printf("%s error read packet, disconnected: %s", c.clientId, err)
+			if pkt, err := packet.ReadPacket(c.conn, false); err != nil || pkt == nil {
+				if !c.Stopped() {
+					c.toBroker(&packet.PacketImpl{ClientId: c.clientId})
+					c.log.Info("error read packet, disconnected", "err", err)
+				}
 				return
 			} else {
+				c.broker.dumpPacket(c.log, c.clientId, "received", pkt)
+				c.broker.stats.received(pkt)
 				pkt.SetSource(c.clientId)
-				c.broker <- pkt
+				c.toBroker(pkt)
 
 				if pkt.Type() == packet.DISCONNECT {
 					return
@@ -54,32 +99,155 @@ func (c *Client) Start() {
 	}()
 
 	for p := range c.channel {
-		if c.debug {
-			log.Printf("%s message to send %s", c.clientId, p)
-		}
+		c.log.Debug("message to send", "type", p.Type().String(), "packet", p.String())
+		c.broker.dumpPacket(c.log, c.clientId, "sent", p)
 
-		if err := packet.WritePacket(c.conn, p, c.debug); err != nil {
-			c.broker <- &packet.PacketImpl{ClientId: c.clientId} // send to toEngine unexpected disconnect
-			log.Printf("%s disconnect while write to socket %s", c.clientId, err)
+		if err := packet.WritePacket(c.conn, p, false); err != nil {
+			if !c.Stopped() {
+				c.toBroker(&packet.PacketImpl{ClientId: c.clientId}) // send to toEngine unexpected disconnect
+				c.log.Info("disconnect while write to socket", "err", err)
+			}
 			return
 		}
+		c.broker.stats.sent(p)
 	}
-	if c.debug {
-		log.Printf("client %s stopped", c.clientId)
-	}
+	// all queued messages are sent, close connection
+	c.conn.Close()
+
+	c.log.Debug("client stopped")
 }
 
+// Stop close client connection. Must be called with broker lock held. It is safe to call Stop more than once.
 func (c *Client) Stop() {
+	if !atomic.CompareAndSwapInt32(&c.stopped, 0, 1) {
+		return
+	}
+
 	close(c.channel)
-	c.conn.Close()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	if c.expire != nil {
+		c.expire.Stop()
+	}
+}
+
+// Drain stop client gracefully: messages already queued are sent before connection is closed.
+// Must be called with broker lock held.
+func (c *Client) Drain() {
+	if !atomic.CompareAndSwapInt32(&c.stopped, 0, 1) {
+		return
+	}
+
+	close(c.channel)
+}
+
+func (c *Client) Stopped() bool {
+	return atomic.LoadInt32(&c.stopped) == 1
+}
+
+// pass packet to broker engine, give up if broker is closed. Packets of every client are handled in its own
+// goroutine under broker lock.
+func (c *Client) toBroker(pkt packet.Packet) {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+
+	select {
+	case <-c.broker.quit:
+		return
+	default:
+	}
+	c.broker.handle(c, pkt)
+}
+
+// send put packet to the client outbound queue. It never blocks broker: false returned if client is
+// stopped or packet is not queued. PUBLISH is dropped when queue is full, acknowledges and other control
+// packets use space reserved for them, client which doesn't read even them is disconnected. Must be called
+// with broker lock held.
+func (c *Client) send(pkt packet.Packet) bool {
+	if c.Stopped() {
+		return false
+	}
+
+	if pkt.Type() == packet.PUBLISH && len(c.channel) >= c.broker.queueSize {
+		atomic.AddUint64(&c.broker.stats.dropped, 1)
+		c.log.Warn("outbound queue is full, message dropped", "type", pkt.Type().String(), "packet", pkt.String())
+		return false
+	}
+
+	select {
+	case c.channel <- pkt:
+		return true
+	default:
+		atomic.AddUint64(&c.broker.stats.dropped, 1)
+		c.log.Warn("outbound queue is full of control packets, client disconnected", "type", pkt.Type().String())
+		c.broker.disconnect(c)
+		c.broker.sendWill(c)
+		return false
+	}
+}
+
+// username used to check access to topics
+func (c *Client) aclUser() string {
+	if c.username == "" {
+		return c.role
+	}
+	return c.username
+}
+
+// next message id, zero is not allowed
+func (c *Client) nextId() uint16 {
+	c.messageId++
+	if c.messageId == 0 {
+		c.messageId++
+	}
+	return c.messageId
+}
+
+// take over session state of previous connection with the same client id
+func (c *Client) resume(old *Client) {
+	c.messageId = old.messageId
+	c.subscription = old.subscription
+	c.ack = old.ack
+}
+
+// resend unacknowledged PUBLISH and PUBREL packets after session is resumed
+func (c *Client) resend() {
+	keys := []string{}
+	for key := range c.ack {
+		if key[0] == 's' || key[0] == 'l' {
+			keys = append(keys, key)
+		}
+	}
+
+	// keep original order of messages
+	sort.Slice(keys, func(i, j int) bool {
+		a, _ := strconv.Atoi(keys[i][1:])
+		b, _ := strconv.Atoi(keys[j][1:])
+		return a < b
+	})
+
+	for _, key := range keys {
+		id, _ := strconv.Atoi(key[1:])
+
+		switch key[0] {
+		case 's':
+			publish := *c.ack[key].(*packet.PublishPacket)
+			publish.Id = uint16(id)
+			publish.DUP = true
+			c.send(&publish)
+		case 'l':
+			pubrel := packet.NewPubRel()
+			pubrel.Id = uint16(id)
+			c.send(pubrel)
+		}
+	}
 }
 
 func (c *Client) addSubscription(t packet.SubscribePayload) packet.QoS {
-	for _, v := range c.subscription {
+	for i, v := range c.subscription {
 		if v.Topic == t.Topic {
-			if v.QoS != t.QoS {
-				v.QoS = t.QoS
-			}
+			c.subscription[i].QoS = t.QoS
 			return t.QoS
 		}
 	}
@@ -93,7 +261,7 @@ func (c *Client) removeSubscription(t packet.SubscribePayload) bool {
 	}
 
 	for i, v := range c.subscription {
-		if v.Topic == t.Topic && v.QoS == t.QoS {
+		if v.Topic == t.Topic {
 			if len(c.subscription) > i+1 {
 				c.subscription[i] = c.subscription[len(c.subscription)-1]
 			}
@@ -104,59 +272,33 @@ func (c *Client) removeSubscription(t packet.SubscribePayload) bool {
 	return false
 }
 
-func (c *Client) Contains(topic string, qos packet.QoS) bool {
-	if len(c.subscription) == 0 {
-		return false
-	}
-
-	t := strings.Split(topic, "/")
-
-	// searched topic is empty
-	if len(t) == 0 {
-		return false
-	}
-
+// match return maximum granted qos of subscriptions matched the topic, shared subscriptions are skipped
+func (c *Client) match(topic string) (packet.QoS, bool) {
+	var found bool
+	var qos packet.QoS
 	for _, subs := range c.subscription {
-		var i int = 0 // start from first level
-		s := strings.Split(subs.Topic, "/")
-
-		var found bool
-		for {
-			if len(s) <= i || len(t) <= i {
-				break
-			}
-
-			// subscribed to any topic
-			if s[i] == "#" && subs.QoS == qos {
-				found = true
-				break
-			}
-
-			// match at this level
-			if s[i] == "*" || s[i] == t[i] {
-				if len(t) == i+1 {
-					if len(t) == len(s) && subs.QoS == qos {
-						found = true
-						break
-					}
-					break
-				}
-
-				// try next level
-				i++
-				continue
+		if strings.HasPrefix(subs.Topic, sharePrefix) {
+			continue
+		}
+		if packet.MatchTopic(subs.Topic, topic) {
+			if !found || subs.QoS > qos {
+				qos = subs.QoS
 			}
-
-			// doesn't match
-			break
+			found = true
 		}
+	}
+	return qos, found
+}
 
-		if found {
-			return true
+// matchShared return shared subscriptions matched the topic
+func (c *Client) matchShared(topic string) []packet.SubscribePayload {
+	var res []packet.SubscribePayload
+	for _, subs := range c.subscription {
+		if _, filter, ok := parseShared(subs.Topic); ok && packet.MatchTopic(filter, topic) {
+			res = append(res, subs)
 		}
 	}
-
-	return false
+	return res
 }
 
 func (c *Client) String() string {
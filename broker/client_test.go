@@ -0,0 +1,80 @@
+package broker
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+// client stops reading its connection: publishes beyond queue are dropped and forgotten, acknowledges are
+// queued until reserve is full, then client is disconnected
+func TestSlowClient(t *testing.T) {
+	const queueSize = 4
+	s, addr := newTestServer(t, []Option{WithQueueSize(queueSize)})
+	b := s.broker
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write(rawConnect("MQTT", 4, 0x02, "slow"))
+	subscribe := packet.NewSubscribe()
+	subscribe.Id = 1
+	subscribe.Topics = []packet.SubscribePayload{{Topic: "t", QoS: 1}}
+	packet.WritePacket(conn, subscribe, false)
+
+	// CONNACK and SUBACK
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := io.ReadFull(conn, make([]byte, 4+5)); err != nil {
+		t.Fatal(err)
+	}
+
+	client := func() *Client {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.clients["slow"]
+	}
+	waitFor(t, "subscription", func() bool { return subscribed(s, "slow", "t") })
+
+	// large messages fill socket buffers, then the queue
+	payload := strings.Repeat("x", 1<<18)
+	const count = 100
+	for i := 0; i < count; i++ {
+		s.Publish("t", payload, 1, false)
+	}
+
+	c := client()
+	b.mu.Lock()
+	queued := len(c.channel)
+	inflight := len(c.ack)
+	b.mu.Unlock()
+	dropped := int(atomic.LoadUint64(&b.stats.dropped))
+
+	if queued != queueSize {
+		t.Errorf("queued %d, want %d", queued, queueSize)
+	}
+	if dropped == 0 || inflight+dropped != count {
+		t.Errorf("in-flight %d + dropped %d, want %d", inflight, dropped, count)
+	}
+
+	// ping is answered beyond queue size
+	packet.WritePacket(conn, packet.NewPing(), false)
+	waitFor(t, "queued pong", func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return len(c.channel) == queueSize+1
+	})
+
+	// client doesn't read even acknowledges
+	for i := 0; i < queueReserve; i++ {
+		packet.WritePacket(conn, packet.NewPing(), false)
+	}
+	waitFor(t, "disconnect", func() bool { return client() == nil })
+}
@@ -0,0 +1,554 @@
+package broker
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+var ErrInvalidCluster = errors.New("mqtt: invalid cluster config")
+
+// source of messages received from other nodes, they are not forwarded again
+const clusterSource = "$cluster"
+
+// size of queue of messages to every node. Links aren't acknowledged and don't apply backpressure: when queue
+// of slow node is full, messages of any qos (retained changes included) are dropped with warning.
+const clusterQueueSize = 1000
+
+// types of messages between nodes
+const (
+	clusterHello = "hello" // first message of connection, answered by hello of accepting node
+	clusterAuth  = "auth"  // proof of connecting node, follows hello of accepting node
+	clusterSubs  = "subs"  // all topic filters and shared subscriptions of the node
+	clusterPub   = "pub"   // published message
+)
+
+// ClusterConfig describe node of cluster. Nodes are connected to each other (full mesh), so every node
+// lists addresses of all other nodes. Secret is required, both nodes prove they know it when they connect
+// (secret itself isn't sent).
+type ClusterConfig struct {
+	Node   string   // unique name of the node
+	Listen string   // address to accept connections of other nodes
+	Peers  []string // addresses of other nodes
+	Secret string   // shared secret of cluster nodes
+}
+
+// message between nodes, connection carries json messages one after another
+type clusterMessage struct {
+	Type    string     `json:"type"`
+	Node    string     `json:"node,omitempty"`
+	Nonce   string     `json:"nonce,omitempty"` // random challenge of hello
+	Proof   string     `json:"proof,omitempty"` // hmac of secret over nonces of both nodes
+	Filters []string   `json:"filters,omitempty"`
+	Shared  []string   `json:"shared,omitempty"` // shared subscriptions of node or ones message is delivered to
+	Topic   string     `json:"topic,omitempty"`
+	Payload []byte     `json:"payload,omitempty"`
+	QoS     packet.QoS `json:"qos,omitempty"`
+	Retain  bool       `json:"retain,omitempty"`
+	Time    int64      `json:"time,omitempty"` // time of retained change, newest change of topic wins
+	Sync    bool       `json:"sync,omitempty"` // retained change sent on connect, it isn't delivered to clients
+}
+
+// connection to other node, it is used to send messages only
+type clusterPeer struct {
+	addr    string
+	node    string // name of connected node, empty while not connected
+	queue   chan clusterMessage
+	changed chan struct{} // local subscriptions are changed
+}
+
+// interest of other node, received by its connection to us
+type clusterInterest struct {
+	conn    net.Conn
+	filters []string
+	shared  []string // shared subscriptions, $share/{group}/{filter}
+}
+
+type cluster struct {
+	config   ClusterConfig
+	broker   *Broker
+	listener net.Listener
+	quit     chan struct{}
+	wg       sync.WaitGroup
+
+	mu       sync.Mutex
+	peers    []*clusterPeer
+	interest map[string]clusterInterest // topic filters of other nodes by node name
+	conns    map[net.Conn]struct{}      // connections of other nodes
+}
+
+// JoinCluster connect the server to other nodes. Messages published on the node are sent to nodes with
+// matched subscriptions, retained messages are sent to all nodes. Shared subscription gets message once in
+// cluster: node of publisher chooses node having its clients. Sessions are not shared, client connects to
+// one node.
+func (s *Server) JoinCluster(config ClusterConfig) error {
+	if config.Node == "" || config.Listen == "" || config.Secret == "" {
+		return ErrInvalidCluster
+	}
+
+	l, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		return err
+	}
+
+	c := &cluster{
+		config:   config,
+		broker:   s.broker,
+		listener: l,
+		quit:     make(chan struct{}),
+		interest: make(map[string]clusterInterest),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	for _, addr := range config.Peers {
+		c.peers = append(c.peers, &clusterPeer{
+			addr:    addr,
+			queue:   make(chan clusterMessage, clusterQueueSize),
+			changed: make(chan struct{}, 1),
+		})
+	}
+
+	s.mu.Lock()
+	if s.closed || s.cluster != nil {
+		s.mu.Unlock()
+		l.Close()
+		if s.closed {
+			return ErrServerClosed
+		}
+		return ErrInvalidCluster
+	}
+	s.cluster = c
+	s.mu.Unlock()
+
+	s.broker.mu.Lock()
+	s.broker.cluster = c
+	s.broker.mu.Unlock()
+
+	slog.Info("cluster node started", "node", config.Node, "addr", l.Addr().String(), "peers", len(c.peers))
+
+	c.wg.Add(1)
+	go c.accept()
+	for _, p := range c.peers {
+		c.wg.Add(1)
+		go c.connect(p)
+	}
+
+	return nil
+}
+
+// stop accepting nodes and close all connections
+func (c *cluster) close() {
+	close(c.quit)
+	c.listener.Close()
+
+	c.mu.Lock()
+	for conn := range c.conns {
+		conn.Close()
+	}
+	c.mu.Unlock()
+
+	c.wg.Wait()
+}
+
+// random challenge of handshake
+func clusterNonce() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// proof of the secret by node in role "connect" or "accept" for nonces of connecting and accepting nodes.
+// Role is included, so proof of one side can't be sent back as proof of another.
+func clusterProof(secret string, role string, connectNonce string, acceptNonce string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(role + "/" + connectNonce + "/" + acceptNonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (c *cluster) verify(proof string, role string, connectNonce string, acceptNonce string) bool {
+	return hmac.Equal([]byte(proof), []byte(clusterProof(c.config.Secret, role, connectNonce, acceptNonce)))
+}
+
+// choose node for every shared subscription matched the message. Local node is one of choices when shared
+// has clients of the subscription, subscriptions chosen for other nodes are removed from shared and returned
+// by node name. Must be called with broker lock held.
+func (c *cluster) assignShared(pkt *packet.PublishPacket, shared map[string][]sharedMember) map[string][]string {
+	if isSysTopic(pkt.Topic) {
+		return nil
+	}
+
+	nodes := make(map[string][]string)
+	for topic := range shared {
+		nodes[topic] = []string{c.config.Node}
+	}
+
+	c.mu.Lock()
+	for _, p := range c.peers {
+		if p.node == "" {
+			continue
+		}
+		for _, topic := range c.interest[p.node].shared {
+			if _, filter, ok := parseShared(topic); ok && packet.MatchTopic(filter, pkt.Topic) &&
+				!slices.Contains(nodes[topic], p.node) {
+				nodes[topic] = append(nodes[topic], p.node)
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	assigned := make(map[string][]string)
+	for topic, names := range nodes {
+		// node is chosen by strategy of shared subscriptions, its state is kept apart from choice of client
+		sort.Strings(names)
+		node := names[c.broker.shared.choose("node:"+topic, pkt.Source(), names)]
+		if node != c.config.Node {
+			delete(shared, topic)
+			assigned[node] = append(assigned[node], topic)
+		}
+	}
+	return assigned
+}
+
+// send message to nodes interested in it and to nodes chosen for its shared subscriptions (see
+// assignShared). Must be called with broker lock held.
+func (c *cluster) forward(pkt *packet.PublishPacket, assigned map[string][]string) {
+	// every node has own $SYS topics
+	if isSysTopic(pkt.Topic) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, p := range c.peers {
+		groups := assigned[p.node]
+		if p.node == "" || !pkt.Retain && !c.interested(p.node, pkt.Topic) && len(groups) == 0 {
+			continue
+		}
+
+		msg := clusterMessage{Type: clusterPub, Topic: pkt.Topic, Payload: []byte(pkt.Payload), QoS: pkt.QoS,
+			Retain: pkt.Retain, Shared: groups}
+		if pkt.Retain {
+			msg.Time = c.broker.retained.changed[pkt.Topic]
+		}
+		c.enqueue(p, msg)
+	}
+}
+
+// send retained message cleared by administrator to all nodes, like on connect it isn't delivered to their
+// clients. Must be called with broker lock held.
+func (c *cluster) clearRetained(topic string) {
+	if isSysTopic(topic) {
+		return
+	}
+
+	msg := clusterMessage{Type: clusterPub, Topic: topic, Retain: true, Sync: true,
+		Time: c.broker.retained.changed[topic]}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, p := range c.peers {
+		if p.node != "" {
+			c.enqueue(p, msg)
+		}
+	}
+}
+
+// queue message to connected node. Must be called with cluster lock held.
+func (c *cluster) enqueue(p *clusterPeer, msg clusterMessage) {
+	select {
+	case p.queue <- msg:
+	default:
+		slog.Warn("cluster queue is full, message dropped", "node", p.node, "topic", msg.Topic, "qos", msg.QoS)
+	}
+}
+
+func (c *cluster) interested(node string, topic string) bool {
+	for _, filter := range c.interest[node].filters {
+		if packet.MatchTopic(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// notify nodes that local subscriptions are changed. Must be called with broker lock held.
+func (c *cluster) subscriptionsChanged() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, p := range c.peers {
+		select {
+		case p.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// topic filters and shared subscriptions of the node. Must be called with broker lock held.
+func (c *cluster) subscriptions() ([]string, []string) {
+	filters := make(map[string]bool)
+	shared := make(map[string]bool)
+	for _, client := range c.broker.clients {
+		for _, subs := range client.subscription {
+			if _, _, ok := parseShared(subs.Topic); ok {
+				shared[subs.Topic] = true
+			} else if !strings.HasPrefix(subs.Topic, sharePrefix) {
+				filters[subs.Topic] = true
+			}
+		}
+	}
+
+	return slices.Sorted(maps.Keys(filters)), slices.Sorted(maps.Keys(shared))
+}
+
+// keep connection to other node, reconnect with growing delay
+func (c *cluster) connect(p *clusterPeer) {
+	defer c.wg.Done()
+
+	delay := time.Second
+	for {
+		err := c.send(p)
+		select {
+		case <-c.quit:
+			return
+		default:
+		}
+
+		if err != nil {
+			slog.Warn("cluster connection failed", "peer", p.addr, "err", err)
+		} else {
+			delay = time.Second
+		}
+
+		select {
+		case <-c.quit:
+			return
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > time.Second*30 {
+			delay = time.Second * 30
+		}
+	}
+}
+
+// connect to other node and send messages to it until connection is broken
+func (c *cluster) send(p *clusterPeer) error {
+	conn, err := net.DialTimeout("tcp", p.addr, time.Second*10)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	c.mu.Lock()
+	c.conns[conn] = struct{}{}
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.conns, conn)
+		p.node = ""
+		c.mu.Unlock()
+	}()
+
+	// both nodes prove the secret: accepting node in its hello, connecting one in auth
+	nonce := clusterNonce()
+	enc := json.NewEncoder(conn)
+	if err := enc.Encode(clusterMessage{Type: clusterHello, Node: c.config.Node, Nonce: nonce}); err != nil {
+		return err
+	}
+
+	var hello clusterMessage
+	conn.SetReadDeadline(time.Now().Add(time.Second * 10))
+	if err := json.NewDecoder(conn).Decode(&hello); err != nil {
+		return err
+	}
+	if hello.Type != clusterHello || hello.Node == "" || hello.Node == c.config.Node || hello.Nonce == "" {
+		return ErrInvalidCluster
+	}
+	if !c.verify(hello.Proof, "accept", nonce, hello.Nonce) {
+		slog.Warn("cluster node rejected: wrong secret", "node", hello.Node, "peer", p.addr)
+		return ErrInvalidCluster
+	}
+	auth := clusterMessage{Type: clusterAuth, Proof: clusterProof(c.config.Secret, "connect", nonce, hello.Nonce)}
+	if err := enc.Encode(auth); err != nil {
+		return err
+	}
+
+	// messages forwarded after node is set are queued, they are sent after current state
+	b := c.broker
+	b.mu.Lock()
+	filters, shared := c.subscriptions()
+	var retained []clusterMessage
+	for _, m := range b.retained.all() {
+		retained = append(retained, clusterMessage{Type: clusterPub, Topic: m.Topic, Payload: []byte(m.Payload),
+			QoS: m.QoS, Retain: true, Time: b.retained.changed[m.Topic], Sync: true})
+	}
+	for topic, at := range b.retained.tombstones() {
+		retained = append(retained, clusterMessage{Type: clusterPub, Topic: topic, Retain: true, Time: at, Sync: true})
+	}
+	c.mu.Lock()
+	p.node = hello.Node
+	c.mu.Unlock()
+	b.mu.Unlock()
+
+	slog.Info("cluster node connected", "node", hello.Node, "peer", p.addr)
+
+	if err := enc.Encode(clusterMessage{Type: clusterSubs, Filters: filters, Shared: shared}); err != nil {
+		return err
+	}
+	for _, m := range retained {
+		if isSysTopic(m.Topic) {
+			continue
+		}
+		if err := enc.Encode(m); err != nil {
+			return err
+		}
+	}
+
+	for {
+		var msg clusterMessage
+		select {
+		case <-c.quit:
+			return nil
+		case msg = <-p.queue:
+		case <-p.changed:
+			b.mu.Lock()
+			msg = clusterMessage{Type: clusterSubs}
+			msg.Filters, msg.Shared = c.subscriptions()
+			b.mu.Unlock()
+		}
+
+		if err := enc.Encode(msg); err != nil {
+			slog.Warn("cluster node disconnected", "node", hello.Node, "err", err)
+			return nil
+		}
+	}
+}
+
+func (c *cluster) accept() {
+	defer c.wg.Done()
+
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			select {
+			case <-c.quit:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			slog.Error("error accept cluster connection", "err", err)
+			time.Sleep(time.Millisecond * 100)
+			continue
+		}
+
+		c.mu.Lock()
+		c.conns[conn] = struct{}{}
+		c.mu.Unlock()
+
+		c.wg.Add(1)
+		go c.receive(conn)
+	}
+}
+
+// receive messages of other node
+func (c *cluster) receive(conn net.Conn) {
+	defer c.wg.Done()
+	defer conn.Close()
+
+	log := slog.With("remote", conn.RemoteAddr().String())
+	dec := json.NewDecoder(conn)
+
+	var hello clusterMessage
+	conn.SetReadDeadline(time.Now().Add(time.Second * 10))
+	if err := dec.Decode(&hello); err != nil || hello.Type != clusterHello || hello.Node == "" || hello.Nonce == "" {
+		log.Warn("cluster connection rejected: no hello", "err", err)
+		return
+	}
+
+	nonce := clusterNonce()
+	if err := json.NewEncoder(conn).Encode(clusterMessage{Type: clusterHello, Node: c.config.Node, Nonce: nonce,
+		Proof: clusterProof(c.config.Secret, "accept", hello.Nonce, nonce)}); err != nil {
+		return
+	}
+
+	var auth clusterMessage
+	if err := dec.Decode(&auth); err != nil || auth.Type != clusterAuth ||
+		!c.verify(auth.Proof, "connect", hello.Nonce, nonce) {
+		log.Warn("cluster connection rejected: wrong secret", "node", hello.Node, "err", err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	log = log.With("node", hello.Node)
+	defer func() {
+		c.mu.Lock()
+		if c.interest[hello.Node].conn == conn {
+			delete(c.interest, hello.Node)
+		}
+		delete(c.conns, conn)
+		c.mu.Unlock()
+	}()
+
+	b := c.broker
+	for {
+		var msg clusterMessage
+		if err := dec.Decode(&msg); err != nil {
+			log.Info("cluster node connection closed", "err", err)
+			return
+		}
+
+		switch msg.Type {
+		case clusterSubs:
+			c.mu.Lock()
+			c.interest[hello.Node] = clusterInterest{conn: conn, filters: msg.Filters, shared: msg.Shared}
+			c.mu.Unlock()
+		case clusterPub:
+			// nodes never forward $ topics, so they are dropped as well
+			if msg.Topic == "" || strings.ContainsAny(msg.Topic, "+#") || isSysTopic(msg.Topic) ||
+				!msg.QoS.Valid() {
+				log.Warn("wrong message of cluster node", "topic", msg.Topic)
+				continue
+			}
+
+			publish := packet.NewPublish()
+			publish.Topic = msg.Topic
+			publish.Payload = string(msg.Payload)
+			publish.QoS = msg.QoS
+			publish.SetSource(clusterSource)
+
+			// node keeps own retained message if it is changed later (last writer wins), older one is
+			// delivered as live message
+			b.mu.Lock()
+			publish.Retain = msg.Retain && b.retained.newer(msg.Topic, msg.Time)
+			if publish.Retain {
+				b.retained.setAt(publish, msg.Time)
+			}
+			if !msg.Sync {
+				b.publishMessage(publish, msg.Shared)
+			}
+			b.mu.Unlock()
+		default:
+			log.Warn("unknown message of cluster node", "type", msg.Type)
+		}
+	}
+}
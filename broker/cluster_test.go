@@ -0,0 +1,255 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// free local address for cluster listener
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// nodes know filters and shared subscriptions of each other
+func hasInterest(s *Server, node string, filter string) bool {
+	c := s.broker.cluster
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Contains(c.interest[node].filters, filter) || slices.Contains(c.interest[node].shared, filter)
+}
+
+func retainedPayload(s *Server, topic string) string {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	if m := s.broker.retained.get(topic); m != nil {
+		return m.Payload
+	}
+	return ""
+}
+
+func TestCluster(t *testing.T) {
+	addrA, addrB := freeAddr(t), freeAddr(t)
+	a, _ := newTestServer(t, nil)
+	b, _ := newTestServer(t, nil)
+
+	if err := a.JoinCluster(ClusterConfig{Node: "a", Listen: addrA}); err != ErrInvalidCluster {
+		t.Fatalf("cluster without secret: got %v, want ErrInvalidCluster", err)
+	}
+
+	// retained before nodes are connected comes to other node on connect
+	a.Publish("status/a", "up", 0, true)
+
+	if err := a.JoinCluster(ClusterConfig{Node: "a", Listen: addrA, Peers: []string{addrB}, Secret: "s"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.JoinCluster(ClusterConfig{Node: "b", Listen: addrB, Peers: []string{addrA}, Secret: "s"}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "retained sync", func() bool { return retainedPayload(b, "status/a") == "up" })
+
+	// subscription on b is propagated to a, so messages of a are routed to b
+	var in inbox
+	if _, err := b.Subscribe("home/#", 1, in.handler); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "subscription propagation", func() bool { return hasInterest(a, "b", "home/#") })
+
+	a.Publish("home/t", "21", 1, false)
+	a.Publish("other/t", "x", 0, false)
+	waitFor(t, "routed message", func() bool { return slices.Equal(in.payloads(), []string{"21"}) })
+
+	// retained messages are replicated to all nodes, subscribed or not
+	b.Publish("status/b", "up", 0, true)
+	waitFor(t, "retained replication", func() bool { return retainedPayload(a, "status/b") == "up" })
+
+	// message from a is delivered on a only once, it doesn't come back from b
+	var local inbox
+	if _, err := a.Subscribe("home/#", 0, local.handler); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "subscription propagation", func() bool { return hasInterest(b, "a", "home/#") })
+	a.Publish("home/t", "22", 0, false)
+	waitFor(t, "routed message", func() bool { return slices.Equal(in.payloads(), []string{"21", "22"}) })
+	if got := local.payloads(); !slices.Equal(got, []string{"22"}) {
+		t.Errorf("local subscriber got %v, want [22]", got)
+	}
+}
+
+// shared subscription with clients on both nodes gets every message once, whatever node it is published on
+func TestClusterShared(t *testing.T) {
+	addrA, addrB := freeAddr(t), freeAddr(t)
+	a, _ := newTestServer(t, nil)
+	b, _ := newTestServer(t, nil)
+	if err := a.JoinCluster(ClusterConfig{Node: "a", Listen: addrA, Peers: []string{addrB}, Secret: "s"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.JoinCluster(ClusterConfig{Node: "b", Listen: addrB, Peers: []string{addrA}, Secret: "s"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var inA, inB inbox
+	if _, err := a.Subscribe("$share/g/t", 0, inA.handler); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Subscribe("$share/g/t", 0, inB.handler); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "subscription propagation", func() bool {
+		return hasInterest(a, "b", "$share/g/t") && hasInterest(b, "a", "$share/g/t")
+	})
+	if hasInterest(a, "b", "t") {
+		t.Error("filter of shared subscription is advertised as plain one")
+	}
+
+	// last message is retained, its replication doesn't deliver it again
+	var want []string
+	for i := range 10 {
+		a.Publish("t", fmt.Sprint("a", i), 0, i == 9)
+		b.Publish("t", fmt.Sprint("b", i), 0, false)
+		want = append(want, fmt.Sprint("a", i), fmt.Sprint("b", i))
+	}
+
+	got := func() []string { return slices.Sorted(slices.Values(append(inA.payloads(), inB.payloads()...))) }
+	waitFor(t, "shared messages", func() bool { return len(got()) >= len(want) })
+	time.Sleep(time.Millisecond * 100)
+	slices.Sort(want)
+	if !slices.Equal(got(), want) {
+		t.Errorf("got %v, want every message once %v", got(), want)
+	}
+	if len(inA.payloads()) == 0 || len(inB.payloads()) == 0 {
+		t.Errorf("messages aren't spread over nodes: a got %v, b got %v", inA.payloads(), inB.payloads())
+	}
+}
+
+// newest change of retained message wins when nodes connect, clears included
+func TestClusterRetainedClear(t *testing.T) {
+	addrA, addrB := freeAddr(t), freeAddr(t)
+	a, _ := newTestServer(t, nil)
+	b, _ := newTestServer(t, nil)
+
+	// changes made while nodes are disconnected: stale message of b, cleared later on a
+	b.Publish("r/cleared", "stale", 0, true)
+	a.Publish("r/cleared", "a", 0, true)
+	a.DeleteRetained("r/cleared")
+	a.Publish("r/changed", "old", 0, true)
+	b.Publish("r/changed", "new", 0, true)
+
+	if err := a.JoinCluster(ClusterConfig{Node: "a", Listen: addrA, Peers: []string{addrB}, Secret: "s"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.JoinCluster(ClusterConfig{Node: "b", Listen: addrB, Peers: []string{addrA}, Secret: "s"}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "retained sync", func() bool {
+		return retainedPayload(a, "r/changed") == "new" && retainedPayload(b, "r/cleared") == ""
+	})
+	time.Sleep(time.Millisecond * 100)
+	if p := retainedPayload(a, "r/cleared"); p != "" {
+		t.Errorf("cleared message came back: %q", p)
+	}
+	if p := retainedPayload(b, "r/changed"); p != "new" {
+		t.Errorf("newer message is replaced by %q", p)
+	}
+
+	// clear of connected node is replicated
+	b.DeleteRetained("r/changed")
+	waitFor(t, "clear replication", func() bool { return retainedPayload(a, "r/changed") == "" })
+}
+
+func TestClusterReject(t *testing.T) {
+	addr := freeAddr(t)
+	s, _ := newTestServer(t, nil)
+	if err := s.JoinCluster(ClusterConfig{Node: "a", Listen: addr, Secret: "s"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var in inbox
+	if _, err := s.Subscribe("#", 0, in.handler); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(secret string, messages ...clusterMessage) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		enc := json.NewEncoder(conn)
+		enc.Encode(clusterMessage{Type: clusterHello, Node: "x", Nonce: "n"})
+		var hello clusterMessage
+		json.NewDecoder(conn).Decode(&hello)
+		enc.Encode(clusterMessage{Type: clusterAuth, Proof: clusterProof(secret, "connect", "n", hello.Nonce)})
+		for _, msg := range messages {
+			enc.Encode(msg)
+		}
+	}
+
+	send("wrong", clusterMessage{Type: clusterPub, Topic: "a/b", Payload: []byte("wrong secret"), Retain: true})
+	send("", clusterMessage{Type: clusterPub, Topic: "a/b", Payload: []byte("no secret"), Retain: true})
+	send("s",
+		clusterMessage{Type: clusterPub, Topic: "$SYS/broker/version", Payload: []byte("fake"), Retain: true},
+		clusterMessage{Type: clusterPub, Topic: "a/c", Payload: []byte("ok")})
+
+	waitFor(t, "message of node", func() bool { return len(in.payloads()) > 0 })
+	if got := in.payloads(); !slices.Equal(got, []string{"ok"}) {
+		t.Errorf("got %v, want [ok]", got)
+	}
+	if p := retainedPayload(s, "$SYS/broker/version"); p != "" {
+		t.Errorf("$SYS topic is retained from cluster: %q", p)
+	}
+}
+
+// connecting node drops link to node which doesn't prove the secret, nothing is sent to it
+func TestClusterRejectAccepting(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s, _ := newTestServer(t, nil)
+	s.Publish("status/a", "up", 0, true)
+	if err := s.JoinCluster(ClusterConfig{Node: "a", Listen: freeAddr(t), Peers: []string{l.Addr().String()},
+		Secret: "s"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, proof := range []string{"", "wrong"} {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second * 5))
+
+		dec := json.NewDecoder(conn)
+		var hello clusterMessage
+		if err := dec.Decode(&hello); err != nil || hello.Nonce == "" {
+			t.Fatalf("hello %+v, %v", hello, err)
+		}
+		if proof == "wrong" {
+			proof = clusterProof("wrong", "accept", hello.Nonce, "n")
+		}
+		json.NewEncoder(conn).Encode(clusterMessage{Type: clusterHello, Node: "x", Nonce: "n", Proof: proof})
+
+		var msg clusterMessage
+		if err := dec.Decode(&msg); err != io.EOF {
+			t.Errorf("proof %q: got %+v, %v, want connection closed", proof, msg, err)
+		}
+		conn.Close()
+	}
+}
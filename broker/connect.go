@@ -1,119 +1,217 @@
 package broker
 
 import (
-	"log"
+	"fmt"
+	"log/slog"
 	"net"
+	"sync/atomic"
+	"time"
 
-	"github.com/MajaSuite/mqtt/db"
 	"github.com/MajaSuite/mqtt/packet"
 )
 
-func (b *Broker) newConnection(conn net.Conn) {
-	pkt, err := packet.ReadPacket(conn, b.debug)
-	if err != nil {
-		log.Println("new connection: error read packet", err)
+// time to wait for CONNECT after connection is accepted
+const connectTimeout = time.Second * 10
+
+func (b *Broker) newConnection(conn net.Conn, l *listener) {
+	log := slog.With("remote", conn.RemoteAddr().String())
+
+	conn.SetReadDeadline(time.Now().Add(connectTimeout))
+	pkt, err := packet.ReadPacket(conn, false)
+	conn.SetReadDeadline(time.Time{})
+	if pkt != nil {
+		b.stats.received(pkt)
+	}
+
+	if pkt == nil || pkt.Type() != packet.CONNECT {
+		if err != nil {
+			log.Info("new connection: error read packet", "err", err)
+		} else {
+			log.Info("new connection: wrong packet, expect CONNECT", "type", pkt.Type().String())
+		}
 		conn.Close()
 		return
 	}
 
-	if pkt.Type() == packet.CONNECT {
-		res := packet.NewConnAck()
-		connPacket := pkt.(*packet.ConnPacket)
+	res := packet.NewConnAck()
+	connPacket := pkt.(*packet.ConnPacket)
+	log = log.With("client", connPacket.ClientID)
+	b.dumpPacket(log, connPacket.ClientID, "received", pkt)
 
-		// check version, now only 4 (3.11)
-		if connPacket.Version != 4 {
-			res.ReturnCode = uint8(packet.ConnectUnacceptableProtocol)
+	switch {
+	case err == packet.ErrUnsupportedVersion:
+		// only 4 (3.1.1) is supported
+		log.Info("new connection: unsupported protocol level", "version", connPacket.Version)
+		b.decline(log, conn, connPacket.ClientID, res, packet.ConnectUnacceptableProtocol)
+		return
+	case err != nil:
+		// malformed packet is not answered
+		log.Info("new connection: error decode CONNECT", "err", err)
+		conn.Close()
+		return
+	}
+
+	if connPacket.ClientID == "" {
+		if !connPacket.CleanSession {
+			log.Info("new connection: empty client id of stateful session")
+			b.decline(log, conn, connPacket.ClientID, res, packet.ConnectIndentifierRejected)
 			return
 		}
+		connPacket.ClientID = fmt.Sprintf("auto-%d", atomic.AddUint64(&b.autoId, 1))
+		log = slog.With("remote", conn.RemoteAddr().String(), "client", connPacket.ClientID)
+	}
 
-		res.ReturnCode = uint8(packet.ConnectAccepted)
+	// check authorization
+	identity := ""
+	var credentials *Credentials
+	if l.certIdentity != "" {
+		identity = certIdentity(conn, l.certIdentity)
+	}
 
-		// check authorization
-		if len(connPacket.Username) > 0 {
-			err := db.CheckAuth(connPacket.Username, connPacket.Password)
-			if err != nil {
-				log.Printf("new connection: authorisation failed: %s", err)
-				res.ReturnCode = uint8(packet.ConnectBadUserPass)
-			}
+	if identity != "" {
+		if connPacket.Username != "" && connPacket.Username != identity {
+			log.Info("new connection: username replaced by certificate identity", "username",
+				connPacket.Username, "identity", identity)
 		}
-
-		if !connPacket.CleanSession {
-			if len(connPacket.ClientID) == 0 {
-				res.ReturnCode = uint8(packet.ConnectIndentifierRejected)
-			} else {
-				if len(connPacket.Username) == 0 {
-					res.ReturnCode = uint8(packet.ConnectNotAuthorized)
-				} else {
-					res.Session = true
-					connPacket.ClientID = connPacket.Username
-				}
-			}
+		connPacket.Username = identity
+	} else if len(connPacket.Username) > 0 {
+		credentials = &Credentials{
+			ClientID: connPacket.ClientID,
+			Username: connPacket.Username,
+			Password: connPacket.Password,
 		}
-
-		err = packet.WritePacket(conn, res, b.debug)
-		if err != nil {
-			log.Println("new connection: error send response packet", err)
-			conn.Close()
+		if err := b.auth.Authenticate(credentials); err != nil {
+			atomic.AddUint64(&b.stats.authFailures, 1)
+			log.Info("new connection: authorisation failed", "username", connPacket.Username, "err", err)
+			b.decline(log, conn, connPacket.ClientID, res, packet.ConnectBadUserPass)
 			return
 		}
+	} else if !l.allowAnonymous {
+		atomic.AddUint64(&b.stats.authFailures, 1)
+		log.Info("new connection: anonymous client rejected")
+		b.decline(log, conn, connPacket.ClientID, res, packet.ConnectNotAuthorized)
+		return
+	}
 
-		// close connection if not authorized
-		if res.ReturnCode != uint8(packet.ConnectAccepted) {
-			log.Println("new connection: error connection declined")
-			conn.Close()
+	if !connPacket.CleanSession {
+		// stateful session is bound to user
+		if len(connPacket.Username) == 0 {
+			log.Info("new connection: stateful session of anonymous client rejected")
+			b.decline(log, conn, connPacket.ClientID, res, packet.ConnectNotAuthorized)
 			return
 		}
+		connPacket.ClientID = connPacket.Username
+	}
 
-		if res.Session { // statefull session
-			if b.clients[connPacket.ClientID] != nil {
-				// session already exists in the broker memory, use it for current connection
-				b.clients[connPacket.ClientID].conn.Close()
-				b.clients[connPacket.ClientID].conn = conn
-			} else {
-				// the new one
-				b.clients[connPacket.ClientID] = NewClient(conn, connPacket.ClientID, res.Session, b.channel, b.debug)
-
-				// and restore subscription
-				if subs, err := db.FetchSubcription(connPacket.ClientID); err == nil {
-					subPayload := []packet.SubscribePayload{}
-					for topic, qos := range subs {
-						subPayload = append(subPayload, packet.SubscribePayload{Topic: topic, QoS: packet.QoS(qos)})
-					}
-					b.clients[connPacket.ClientID].messageId++
-
-					subpkt := packet.NewSubscribe()
-					subpkt.ClientId = connPacket.ClientId
-					subpkt.Id = b.clients[connPacket.ClientID].messageId
-					subpkt.Topics = subPayload
-					b.channel <- subpkt
-				}
+	client := NewClient(conn, connPacket.ClientID, !connPacket.CleanSession, b)
+	client.username = connPacket.Username
+	client.role = l.anonymousRole
+	client.keepAlive = connPacket.KeepAlive
+	client.will = connPacket.Will
+
+	b.mu.Lock()
+	if b.closing {
+		b.mu.Unlock()
+		log.Info("new connection: broker is shutting down")
+		b.decline(client.log, conn, client.clientId, res, packet.ConnectServerUnavailable)
+		return
+	}
 
-				// save will packet
-				if connPacket.Will != nil {
-					b.clients[connPacket.ClientID].will = connPacket.Will
+	old := b.clients[connPacket.ClientID]
+	if old != nil {
+		// the same client id is connected already or its session is kept, close it
+		old.Stop()
+	}
+
+	if client.session { // statefull session
+		if old != nil && old.session {
+			// session already exists in the broker memory, use it for current connection
+			client.resume(old)
+			res.Session = true
+		} else {
+			// the new one, restore subscription
+			if subs, err := b.store.FetchSubscription(connPacket.ClientID); err == nil && len(subs) > 0 {
+				for topic, qos := range subs {
+					client.addSubscription(packet.SubscribePayload{Topic: topic, QoS: packet.QoS(qos)})
 				}
-			}
-		} else { // new clean session
-			// remove all (if we have)
-			if b.clients[connPacket.ClientID] != nil {
-				b.clients[connPacket.ClientID].conn.Close()
-				delete(b.clients, connPacket.ClientID)
+				res.Session = true
 			}
 
-			// and create new one
-			b.clients[connPacket.ClientID] = NewClient(conn, connPacket.ClientID, res.Session, b.channel, b.debug)
+			// and session state saved on shutdown
+			if messageId, inflight, err := b.store.FetchSession(connPacket.ClientID); err == nil {
+				client.messageId = messageId
+				for key, p := range inflight {
+					client.ack[key] = p
+				}
+				b.store.DeleteSession(connPacket.ClientID)
+				res.Session = true
+			}
+		}
+	} else {
+		// clean session discards state of previous one
+		if subs, err := b.store.FetchSubscription(connPacket.ClientID); err == nil && len(subs) > 0 {
+			b.store.DeleteSubscriptions(connPacket.ClientID)
 		}
+		b.store.DeleteSession(connPacket.ClientID)
+	}
 
-		if connPacket.Will != nil {
-			b.clients[connPacket.ClientID].will = connPacket.Will
+	if credentials != nil {
+		client.authz = credentials.Authorizer
+		if !credentials.Expires.IsZero() {
+			client.expire = time.AfterFunc(time.Until(credentials.Expires), func() {
+				b.expire(client)
+			})
 		}
+	}
 
-		// start manage client
-		b.clients[connPacket.ClientID].Start()
-		return
+	b.clients[connPacket.ClientID] = client
+	if client.session {
+		client.resend()
 	}
+	b.subscriptionsChanged()
+	b.mu.Unlock()
+
+	atomic.AddUint64(&b.stats.connections, 1)
+
+	// CONNACK is written before client queue, so it is always the first packet
+	res.ReturnCode = uint8(packet.ConnectAccepted)
+	b.dumpPacket(client.log, client.clientId, "sent", res)
+	if err := packet.WritePacket(conn, res, false); err != nil {
+		client.log.Info("new connection: error send response packet", "err", err)
+	} else {
+		b.stats.sent(res)
+	}
+	client.log.Info("client connected", "username", client.username, "session", client.session)
+
+	// start manage client
+	client.Start()
+}
 
-	log.Println("new connection: wrong packet. expect CONNECT")
+// answer CONNACK with error code and close connection
+func (b *Broker) decline(log *slog.Logger, conn net.Conn, clientId string, res *packet.ConnAckPacket, code int) {
+	res.Session = false
+	res.ReturnCode = uint8(code)
+	b.dumpPacket(log, clientId, "sent", res)
+	if err := packet.WritePacket(conn, res, false); err != nil {
+		log.Info("new connection: error send response packet", "err", err)
+	} else {
+		b.stats.sent(res)
+	}
+
+	log.Info("new connection: connection declined", "code", code)
 	conn.Close()
-	return
+}
+
+// disconnect client when its credentials are expired
+func (b *Broker) expire(client *Client) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if client.Stopped() || b.clients[client.clientId] != client {
+		return
+	}
+
+	client.log.Info("credentials expired, disconnect")
+	b.sendWill(client)
+	b.disconnect(client)
 }
@@ -0,0 +1,201 @@
+package broker
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+// raw CONNECT packet: protocol name and level, connect flags, keep alive 60 and payload strings
+func rawConnect(proto string, level byte, flags byte, payload ...string) []byte {
+	body := rawString(proto)
+	body = append(body, level, flags, 0, 60)
+	for _, s := range payload {
+		body = append(body, rawString(s)...)
+	}
+	return append([]byte{0x10, byte(len(body))}, body...)
+}
+
+func rawString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+func TestConnect(t *testing.T) {
+	_, addr := newTestServer(t, nil)
+
+	// remaining length is right, but client id is shorter than its length
+	truncated := rawConnect("MQTT", 4, 0x02, "client")
+	truncated = truncated[:len(truncated)-3]
+	truncated[1] -= 3
+
+	tests := []struct {
+		name string
+		raw  []byte
+		want []byte // CONNACK, nil when connection is closed without answer
+	}{
+		{"accepted", rawConnect("MQTT", 4, 0x02, "client"), []byte{0x20, 0x02, 0x00, 0x00}},
+		{"reserved header flags", append([]byte{0x11}, rawConnect("MQTT", 4, 0x02, "client")[1:]...), nil},
+		{"reserved connect flag", rawConnect("MQTT", 4, 0x03, "client"), nil},
+		{"mqtt 3.1", rawConnect("MQIsdp", 3, 0x02, "client"), []byte{0x20, 0x02, 0x00, 0x01}},
+		{"mqtt 5", rawConnect("MQTT", 5, 0x02, "client"), []byte{0x20, 0x02, 0x00, 0x01}},
+		{"unknown protocol", rawConnect("MQTX", 4, 0x02, "client"), nil},
+		{"password without username", rawConnect("MQTT", 4, 0x42, "client", "pass"), nil},
+		{"will qos without will", rawConnect("MQTT", 4, 0x0a, "client"), nil},
+		{"will retain without will", rawConnect("MQTT", 4, 0x22, "client"), nil},
+		{"will qos 3", rawConnect("MQTT", 4, 0x1e, "client", "a/b", "x"), nil},
+		{"will topic with wildcard", rawConnect("MQTT", 4, 0x06, "client", "a/#", "x"), nil},
+		{"empty will topic", rawConnect("MQTT", 4, 0x06, "client", "", "x"), nil},
+		{"empty client id with session", rawConnect("MQTT", 4, 0x00, ""), []byte{0x20, 0x02, 0x00, 0x02}},
+		{"empty client id", rawConnect("MQTT", 4, 0x02, ""), []byte{0x20, 0x02, 0x00, 0x00}},
+		{"stateful session of anonymous", rawConnect("MQTT", 4, 0x00, "client"), []byte{0x20, 0x02, 0x00, 0x05}},
+		{"truncated payload", truncated, nil},
+		{"truncated packet", rawConnect("MQTT", 4, 0x02, "client")[:8], nil},
+		{"not connect", []byte{0xc0, 0x00}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if _, err := conn.Write(tt.raw); err != nil {
+				t.Fatal(err)
+			}
+			if tt.want != nil && tt.want[3] == 0 {
+				// accepted client is disconnected to read answer up to the end
+				conn.Write([]byte{0xe0, 0x00})
+			}
+			// packet shorter than its remaining length ends by eof
+			conn.(*net.TCPConn).CloseWrite()
+
+			conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+			got, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatalf("connection is not closed: %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("got % x, want % x", got, tt.want)
+			}
+		})
+	}
+}
+
+// raw SUBSCRIBE packet with given header, id 1 and filters with qos 1
+func rawSubscribePacket(header byte, filters ...string) []byte {
+	body := []byte{0, 1}
+	for _, filter := range filters {
+		body = append(body, rawString(filter)...)
+		body = append(body, 1)
+	}
+	return append([]byte{header, byte(len(body))}, body...)
+}
+
+func TestSubscribeMalformed(t *testing.T) {
+	_, addr := newTestServer(t, nil)
+
+	tests := []struct {
+		name string
+		raw  []byte
+		ok   bool // SUBACK is expected, connection is closed without answer otherwise
+	}{
+		{"accepted", rawSubscribePacket(0x82, "a/+/b", "a/#", "#", "+", "$share/g/a/#"), true},
+		{"reserved header flags", rawSubscribePacket(0x80, "a/b"), false},
+		{"no filters", rawSubscribePacket(0x82), false},
+		{"empty filter", rawSubscribePacket(0x82, "a/b", ""), false},
+		{"multi-level wildcard not last", rawSubscribePacket(0x82, "a/#/b"), false},
+		{"wildcard in level", rawSubscribePacket(0x82, "a/b#"), false},
+		{"single-level wildcard in level", rawSubscribePacket(0x82, "a/+b/c"), false},
+		{"qos 3", []byte{0x82, 0x08, 0x00, 0x01, 0x00, 0x03, 'a', '/', 'b', 0x03}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, _ := rawClient(t, addr, rawConnect("MQTT", 4, 0x02, "client"))
+			conn.Write(tt.raw)
+			if tt.ok {
+				suback, ok := readPacket(t, conn).(*packet.SubAckPacket)
+				if !ok || len(suback.ReturnCodes) != 5 {
+					t.Fatal("SUBACK with 5 return codes expected")
+				}
+				return
+			}
+
+			conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+			if got, err := io.ReadAll(conn); err != nil || len(got) != 0 {
+				t.Errorf("got % x, %v, want connection closed", got, err)
+			}
+		})
+	}
+}
+
+// will of lost client is published with its retain flag, retained will is sent to new subscribers
+func TestWillRetain(t *testing.T) {
+	s, addr := newTestServer(t, nil)
+	watcher := &inbox{}
+	if _, err := s.Subscribe("status/#", packet.AtMostOnce, watcher.handler); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, _ := rawClient(t, addr, rawConnect("MQTT", 4, 0x26, "device", "status/device", "offline"))
+	conn.Close()
+	waitFor(t, "will", func() bool { return len(watcher.payloads()) == 1 })
+
+	sub, _ := rawClient(t, addr, rawConnect("MQTT", 4, 0x02, "watcher"))
+	rawSubscribe(t, sub, 1, "status/#")
+	publish, ok := readPacket(t, sub).(*packet.PublishPacket)
+	if !ok || publish.Topic != "status/device" || publish.Payload != "offline" || !publish.Retain {
+		t.Fatalf("got %v, want retained will", publish)
+	}
+}
+
+// anonymous clients are accepted or rejected by listener policy, stateful session is bound to username
+func TestAnonymous(t *testing.T) {
+	s, allowAddr := newTestServer(t, []Option{WithStore(sessionStore(t))})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l, AllowAnonymous(false))
+	denyAddr := l.Addr().String()
+
+	tests := []struct {
+		name    string
+		addr    string
+		connect []byte
+		code    int // CONNACK return code
+	}{
+		{"anonymous allowed", allowAddr, rawConnect("MQTT", 4, 0x02, "c1"), packet.ConnectAccepted},
+		{"anonymous denied", denyAddr, rawConnect("MQTT", 4, 0x02, "c2"), packet.ConnectNotAuthorized},
+		{"user on denied listener", denyAddr, rawConnect("MQTT", 4, 0xc2, "c3", "alice", "secret"),
+			packet.ConnectAccepted},
+		{"stateful session of anonymous", allowAddr, rawConnect("MQTT", 4, 0x00, "c4"), packet.ConnectNotAuthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, connack := rawClient(t, tt.addr, tt.connect)
+			if want := []byte{0x20, 0x02, 0x00, byte(tt.code)}; !bytes.Equal(connack, want) {
+				t.Errorf("CONNACK % x, want % x", connack, want)
+			}
+		})
+	}
+
+	// client id of stateful session is replaced by username
+	rawClient(t, denyAddr, rawConnect("MQTT", 4, 0xc0, "device", "alice", "secret"))
+	var info *ClientInfo
+	for _, c := range s.Clients() {
+		if c.Username == "alice" && c.Session {
+			info = &c
+		}
+	}
+	if info == nil || info.ClientID != "alice" {
+		t.Errorf("got session %+v, want client id alice", info)
+	}
+}
@@ -0,0 +1,86 @@
+package broker
+
+import (
+	"encoding/hex"
+	"log/slog"
+	"sort"
+	"sync"
+
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+// DumpConfig select packets logged with hex dumps
+type DumpConfig struct {
+	All     bool     `json:"all"`     // packets of all clients
+	Clients []string `json:"clients"` // packets of clients with given ids
+	Topics  []string `json:"topics"`  // publishes to topics matched by given filters
+}
+
+// selection of packets logged with hex dumps: of all clients, of given clients or publishes to topics
+// matched by given filters. It may be changed at runtime.
+type dumpConfig struct {
+	mu      sync.RWMutex
+	all     bool
+	clients map[string]bool
+	topics  []string
+}
+
+func (d *dumpConfig) set(all bool, clients []string, topics []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.all = all
+	d.clients = make(map[string]bool)
+	for _, id := range clients {
+		d.clients[id] = true
+	}
+	d.topics = append([]string{}, topics...)
+}
+
+func (d *dumpConfig) get() DumpConfig {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	clients := []string{}
+	for id := range d.clients {
+		clients = append(clients, id)
+	}
+	sort.Strings(clients)
+
+	return DumpConfig{All: d.all, Clients: clients, Topics: append([]string{}, d.topics...)}
+}
+
+func (d *dumpConfig) match(clientId string, pkt packet.Packet) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.all || d.clients[clientId] {
+		return true
+	}
+
+	if publish, ok := pkt.(*packet.PublishPacket); ok {
+		for _, filter := range d.topics {
+			if packet.MatchTopic(filter, publish.Topic) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// log packet with hex dump if it is selected
+func (b *Broker) dumpPacket(log *slog.Logger, clientId string, direction string, pkt packet.Packet) {
+	if !b.dump.match(clientId, pkt) {
+		return
+	}
+
+	// credentials never get into logs, password is replaced in dump of CONNECT
+	if connect, ok := pkt.(*packet.ConnPacket); ok && connect.Password != "" {
+		redacted := *connect
+		redacted.Password = "***"
+		pkt = &redacted
+	}
+
+	log.Info("packet "+direction, "type", pkt.Type().String(), "packet", pkt.String(), "dump", hex.Dump(pkt.Pack()))
+}
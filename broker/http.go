@@ -0,0 +1,75 @@
+package broker
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/MajaSuite/mqtt/db"
+)
+
+// authenticate http request by basic auth as mqtt client of listener with given options. Returned client
+// isn't registered in the broker, it is used to check access to topics.
+func (b *Broker) httpClient(r *http.Request, opts []ListenerOption) (*Client, *Credentials, error) {
+	l := newListener(opts)
+	client := &Client{
+		clientId: fmt.Sprintf("$http-%d", atomic.AddUint64(&b.autoId, 1)),
+		role:     l.anonymousRole,
+		broker:   b,
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok || username == "" {
+		if !l.allowAnonymous {
+			atomic.AddUint64(&b.stats.authFailures, 1)
+			return nil, nil, ErrNotAuthorized
+		}
+		return client, nil, nil
+	}
+
+	credentials := &Credentials{ClientID: client.clientId, Username: username, Password: password}
+	if err := b.auth.Authenticate(credentials); err != nil {
+		atomic.AddUint64(&b.stats.authFailures, 1)
+		slog.Info("http: authorisation failed", "remote", r.RemoteAddr, "username", username, "err", err)
+		return nil, nil, ErrNotAuthorized
+	}
+
+	client.username = username
+	client.authz = credentials.Authorizer
+
+	return client, credentials, nil
+}
+
+// check bearer token of request, empty token denies everything
+func checkToken(r *http.Request, token string) bool {
+	header := r.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, "Bearer ")), []byte(token)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("error write http response", "err", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeDBError(w http.ResponseWriter, err error) {
+	if err == db.ErrNotFound {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err)
+}
@@ -0,0 +1,168 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/MajaSuite/mqtt/db"
+)
+
+// AdminHandler return http handler of admin api. Every request must have header "Authorization: Bearer
+// <token>", answers are json.
+//
+//	GET    /clients                  connected clients and offline sessions
+//	DELETE /clients/{id}             disconnect client
+//	GET    /retained                 retained messages
+//	DELETE /retained/{topic...}      clear retained message
+//	GET    /subscriptions            persisted subscriptions
+//	GET    /users                    users of broker database
+//	POST   /users                    add user: {"login": "...", "password": "..."}
+//	PUT    /users/{login}            change user: {"password": "...", "enabled": true}
+//	DELETE /users/{login}            delete user
+//	GET    /dump                     packets logged with hex dumps
+//	PUT    /dump                     change it: {"all": false, "clients": ["..."], "topics": ["..."]}
+func (s *Server) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /clients", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Clients())
+	})
+
+	mux.HandleFunc("DELETE /clients/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.Kick(r.PathValue("id")); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /retained", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Retained())
+	})
+
+	mux.HandleFunc("DELETE /retained/{topic...}", func(w http.ResponseWriter, r *http.Request) {
+		if !s.DeleteRetained(r.PathValue("topic")) {
+			writeError(w, http.StatusNotFound, errors.New("no retained message"))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /subscriptions", func(w http.ResponseWriter, r *http.Request) {
+		subs, err := s.store.FetchSubscriptions()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		type subscription struct {
+			ClientID string `json:"clientid"`
+			Topic    string `json:"topic"`
+			QoS      int    `json:"qos"`
+		}
+		res := []subscription{}
+		for _, sub := range subs {
+			res = append(res, subscription{ClientID: sub.ID, Topic: sub.Topic, QoS: sub.QoS})
+		}
+		writeJSON(w, http.StatusOK, res)
+	})
+
+	mux.HandleFunc("GET /dump", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Dump())
+	})
+
+	mux.HandleFunc("PUT /dump", func(w http.ResponseWriter, r *http.Request) {
+		var req DumpConfig
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if err := s.SetDump(req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.Dump())
+	})
+
+	type user struct {
+		Login    string `json:"login"`
+		Password string `json:"password,omitempty"`
+		Enabled  *bool  `json:"enabled,omitempty"`
+	}
+
+	mux.HandleFunc("GET /users", func(w http.ResponseWriter, r *http.Request) {
+		users, err := s.store.FetchUsers()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		res := []user{}
+		for _, u := range users {
+			enabled := u.Enabled
+			res = append(res, user{Login: u.Login, Enabled: &enabled})
+		}
+		writeJSON(w, http.StatusOK, res)
+	})
+
+	mux.HandleFunc("POST /users", func(w http.ResponseWriter, r *http.Request) {
+		var u user
+		if err := json.NewDecoder(r.Body).Decode(&u); err != nil || u.Login == "" || u.Password == "" {
+			writeError(w, http.StatusBadRequest, errors.New("login and password are required"))
+			return
+		}
+
+		if err := s.store.AddUser(u.Login, u.Password); err == db.ErrUserExists {
+			writeError(w, http.StatusConflict, err)
+			return
+		} else if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		if u.Enabled != nil && !*u.Enabled {
+			s.store.EnableUser(u.Login, false)
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	mux.HandleFunc("PUT /users/{login}", func(w http.ResponseWriter, r *http.Request) {
+		var u user
+		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		login := r.PathValue("login")
+		if u.Password != "" {
+			if err := s.store.SetPassword(login, u.Password); err != nil {
+				writeDBError(w, err)
+				return
+			}
+		}
+		if u.Enabled != nil {
+			if err := s.store.EnableUser(login, *u.Enabled); err != nil {
+				writeDBError(w, err)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("DELETE /users/{login}", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.store.DeleteUser(r.PathValue("login")); err != nil {
+			writeDBError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !checkToken(r, token) {
+			writeError(w, http.StatusUnauthorized, ErrNotAuthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,77 @@
+package broker
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdminHandler(t *testing.T) {
+	s, addr := newTestServer(t, nil)
+	hs := httptest.NewServer(s.AdminHandler("secret"))
+	defer hs.Close()
+
+	conn, _ := rawClient(t, addr, rawConnect("MQTT", 4, 0x02, "device"))
+	rawSubscribe(t, conn, 1, "home/#")
+
+	request := func(method, path, token string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, hs.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { res.Body.Close() })
+		return res
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		status int
+	}{
+		{"no token", "GET", "/clients", "", http.StatusUnauthorized},
+		{"wrong token", "GET", "/clients", "wrong", http.StatusUnauthorized},
+		{"no token for unknown path", "GET", "/unknown", "", http.StatusUnauthorized},
+		{"unknown path", "GET", "/unknown", "secret", http.StatusNotFound},
+		{"method not allowed", "POST", "/clients", "secret", http.StatusMethodNotAllowed},
+		{"kick unknown client", "DELETE", "/clients/other", "secret", http.StatusNotFound},
+		{"clear unknown retained", "DELETE", "/retained/home/a", "secret", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if res := request(tt.method, tt.path, tt.token); res.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, res.StatusCode, tt.status)
+		}
+	}
+
+	// connected client with its subscription is listed
+	res := request("GET", "/clients", "secret")
+	var clients []ClientInfo
+	if err := json.NewDecoder(res.Body).Decode(&clients); err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, %v", res.StatusCode, err)
+	}
+	if len(clients) != 1 || clients[0].ClientID != "device" || !clients[0].Connected ||
+		len(clients[0].Subscriptions) != 1 || clients[0].Subscriptions[0].Topic != "home/#" {
+		t.Errorf("got clients %+v, want device subscribed to home/#", clients)
+	}
+
+	// kicked client is disconnected and forgotten
+	if res := request("DELETE", "/clients/device", "secret"); res.StatusCode != http.StatusNoContent {
+		t.Fatalf("kick status %d, want %d", res.StatusCode, http.StatusNoContent)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if data, err := io.ReadAll(conn); err != nil || len(data) != 0 {
+		t.Errorf("got % x, %v, want connection closed", data, err)
+	}
+	if clients := s.Clients(); len(clients) != 0 {
+		t.Errorf("got clients %+v after kick, want none", clients)
+	}
+}
@@ -0,0 +1,96 @@
+package broker
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/MajaSuite/mqtt/db"
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+// max size of message published over http
+const maxHTTPPayload = 1 << 20
+
+// PublishHandler return http handler publishing request body to the topic, handler must be mounted at
+// /publish/:
+//
+//	POST /publish/{topic}?qos=1&retain=true
+//
+// Client is authenticated by basic auth and access to topic is checked as for mqtt clients of listener with
+// given options (see AllowAnonymous and AnonymousRole).
+func (s *Server) PublishHandler(opts ...ListenerOption) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST /publish/{topic...}", func(w http.ResponseWriter, r *http.Request) {
+		client, _, err := s.broker.httpClient(r, opts)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mqtt"`)
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+
+		topic := r.PathValue("topic")
+		if topic == "" || strings.ContainsAny(topic, "+#") {
+			writeError(w, http.StatusBadRequest, ErrInvalidTopic)
+			return
+		}
+
+		qos := packet.AtMostOnce
+		if v := r.URL.Query().Get("qos"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || !packet.QoS(n).Valid() {
+				writeError(w, http.StatusBadRequest, packet.ErrInvalidQos)
+				return
+			}
+			qos = packet.QoS(n)
+		}
+
+		retain := false
+		if v := r.URL.Query().Get("retain"); v != "" {
+			if retain, err = strconv.ParseBool(v); err != nil {
+				writeError(w, http.StatusBadRequest, errors.New("invalid retain"))
+				return
+			}
+		}
+
+		payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxHTTPPayload))
+		if err != nil {
+			writeError(w, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+
+		publish := packet.NewPublish()
+		publish.Topic = topic
+		publish.Payload = string(payload)
+		publish.QoS = qos
+		publish.Retain = retain
+
+		// client isn't registered in broker, access is checked without lock
+		b := s.broker
+		allowed := b.allowed(client, topic, db.AccessWrite)
+		b.mu.Lock()
+		switch {
+		case b.closing:
+			err = ErrServerClosed
+		case !allowed:
+			err = ErrNotAuthorized
+		default:
+			b.route(publish)
+		}
+		b.mu.Unlock()
+
+		switch err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case ErrServerClosed:
+			writeError(w, http.StatusServiceUnavailable, err)
+		default:
+			writeError(w, http.StatusForbidden, err)
+		}
+	})
+
+	return mux
+}
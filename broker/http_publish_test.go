@@ -0,0 +1,77 @@
+package broker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/MajaSuite/mqtt/db"
+	"github.com/MajaSuite/mqtt/packet"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPublishHandler(t *testing.T) {
+	// every request is authenticated, keep it fast
+	defer db.SetPasswordCost(bcrypt.DefaultCost)
+	db.SetPasswordCost(bcrypt.MinCost)
+
+	store := sessionStore(t)
+	store.SaveACL(db.ACLRule{Kind: db.ACLUser, Name: "alice", Topic: "home/#", Access: db.AccessReadWrite})
+	s, _ := newTestServer(t, []Option{WithStore(store), WithACL(false)})
+
+	watcher := &inbox{}
+	if _, err := s.Subscribe("#", packet.AtMostOnce, watcher.handler); err != nil {
+		t.Fatal(err)
+	}
+
+	hs := httptest.NewServer(s.PublishHandler(AllowAnonymous(false)))
+	defer hs.Close()
+
+	tests := []struct {
+		name   string
+		path   string
+		user   string
+		status int
+	}{
+		{"anonymous", "/publish/home/a", "", http.StatusUnauthorized},
+		{"wrong password", "/publish/home/a", "wrong", http.StatusUnauthorized},
+		{"denied topic", "/publish/other", "secret", http.StatusForbidden},
+		{"$ topic", "/publish/$SYS/broker/version", "secret", http.StatusForbidden},
+		{"wildcard topic", "/publish/home/%23", "secret", http.StatusBadRequest},
+		{"qos 3", "/publish/home/a?qos=3", "secret", http.StatusBadRequest},
+		{"qos not number", "/publish/home/a?qos=one", "secret", http.StatusBadRequest},
+		{"retain not bool", "/publish/home/a?retain=yes", "secret", http.StatusBadRequest},
+		{"method not allowed", "/publish/home/a", "secret", http.StatusMethodNotAllowed},
+		{"published", "/publish/home/a?qos=1&retain=true", "secret", http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		method := http.MethodPost
+		if tt.name == "method not allowed" {
+			method = http.MethodGet
+		}
+		req, _ := http.NewRequest(method, hs.URL+tt.path, strings.NewReader(tt.name))
+		if tt.user != "" {
+			req.SetBasicAuth("alice", tt.user)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, res.StatusCode, tt.status)
+		}
+	}
+
+	// only accepted request is published with its qos and retain flag
+	waitFor(t, "published message", func() bool { return len(watcher.payloads()) == 1 })
+	if got := watcher.payloads(); got[0] != "published" {
+		t.Errorf("routed %v, want only published", got)
+	}
+	if retained := s.Retained(); len(retained) != 1 || retained[0].Topic != "home/a" ||
+		retained[0].QoS != packet.AtLeastOnce {
+		t.Errorf("retained %+v, want home/a with qos 1", retained)
+	}
+}
@@ -0,0 +1,146 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/MajaSuite/mqtt/db"
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+// interval of comments sent to keep idle event stream open through proxies
+const sseKeepAlive = time.Second * 30
+
+// SubscribeHandler return http handler streaming messages matched by topic filters as server-sent events,
+// starting with retained ones:
+//
+//	GET /subscribe?filter=home/#&filter=sensor/+/temp
+//
+// Every event is json {"topic", "payload", "qos", "retain"}. Client is authenticated by basic auth and
+// access to filters is checked as for mqtt clients of listener with given options.
+func (s *Server) SubscribeHandler(opts ...ListenerOption) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+
+		b := s.broker
+		template, credentials, err := b.httpClient(r, opts)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mqtt"`)
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+
+		filters := r.URL.Query()["filter"]
+		if len(filters) == 0 {
+			writeError(w, http.StatusBadRequest, errors.New("filter is required"))
+			return
+		}
+
+		topics := []packet.SubscribePayload{}
+		for _, filter := range filters {
+			if !packet.ValidFilter(filter) {
+				writeError(w, http.StatusBadRequest, ErrInvalidTopic)
+				return
+			}
+			topics = append(topics, packet.SubscribePayload{Topic: filter, QoS: packet.ExactlyOnce})
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+			return
+		}
+
+		var mu sync.Mutex // handler and keep alive write concurrently
+		finished := false
+		write := func(text string) {
+			mu.Lock()
+			defer mu.Unlock()
+			if !finished {
+				fmt.Fprint(w, text)
+				flusher.Flush()
+			}
+		}
+
+		client := newLocalClient(template.clientId, func(pkt *packet.PublishPacket) {
+			data, _ := json.Marshal(&Message{Topic: pkt.Topic, Payload: pkt.Payload, QoS: pkt.QoS, Retain: pkt.Retain})
+			write("event: message\ndata: " + string(data) + "\n\n")
+		}, b)
+		client.username = template.username
+		client.role = template.role
+		client.authz = template.authz
+		client.restricted = true
+
+		// client isn't registered in broker yet, access is checked without lock
+		for _, topic := range topics {
+			if !b.allowed(client, topic.Topic, db.AccessRead) {
+				writeError(w, http.StatusForbidden, fmt.Errorf("subscription to %s denied", topic.Topic))
+				return
+			}
+		}
+		b.mu.Lock()
+		closing := b.closing
+		b.mu.Unlock()
+
+		if closing {
+			writeError(w, http.StatusServiceUnavailable, ErrServerClosed)
+			return
+		}
+
+		// slow peer must not block broker, headers are sent without lock
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		b.mu.Lock()
+		if b.closing {
+			// broker is shut down meanwhile, stream is finished at once
+			b.mu.Unlock()
+			return
+		}
+		b.clients[client.clientId] = client
+		b.sendRetained(client, topics, b.subscribe(client, topics))
+		if credentials != nil && !credentials.Expires.IsZero() {
+			client.expire = time.AfterFunc(time.Until(credentials.Expires), func() {
+				b.expire(client)
+			})
+		}
+		b.mu.Unlock()
+
+		// stop client when request is finished, stream is finished when client is stopped
+		done := make(chan struct{})
+		go func() {
+			ticker := time.NewTicker(sseKeepAlive)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ticker.C:
+					write(": keepalive\n\n")
+					continue
+				case <-r.Context().Done():
+					b.mu.Lock()
+					b.disconnect(client)
+					b.mu.Unlock()
+				case <-done:
+				}
+				return
+			}
+		}()
+
+		client.Start()
+
+		mu.Lock()
+		finished = true
+		mu.Unlock()
+		close(done)
+	})
+}
@@ -0,0 +1,47 @@
+package broker
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSubscribeHandler(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	s.Publish("home/a", "retained", 0, true)
+
+	hs := httptest.NewServer(s.SubscribeHandler())
+	defer hs.Close()
+
+	res, err := http.Get(hs.URL + "/subscribe?filter=home/%23")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if ct := res.Header.Get("Content-Type"); res.StatusCode != http.StatusOK || ct != "text/event-stream" {
+		t.Fatalf("status %d, content type %q", res.StatusCode, ct)
+	}
+
+	events := []string{}
+	scanner := bufio.NewScanner(res.Body)
+	for len(events) < 2 && scanner.Scan() {
+		if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			events = append(events, data)
+			if len(events) == 1 {
+				// subscriber is registered when retained message is sent
+				s.Publish("home/b", "live", 0, false)
+			}
+		}
+	}
+
+	want := []string{
+		`{"topic":"home/a","payload":"retained","qos":0,"retain":true}`,
+		`{"topic":"home/b","payload":"live","qos":0,"retain":false}`,
+	}
+	if strings.Join(events, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %v, want %v", events, want)
+	}
+}
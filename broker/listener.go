@@ -1,58 +1,44 @@
 package broker
 
-import (
-	"log"
-	"net"
-)
-
+// settings of single listener
 type listener struct {
-	debug    bool
-	listener net.Listener
-	broker   *Broker
-}
-
-func NewListener(debug bool, key string, cert string) *listener {
-	l, err := net.Listen("tcp", "0.0.0.0:1883")
-	if err != nil {
-		return nil
-	}
-
-	log.Println("listen on address", l.Addr())
-
-	return &listener{debug: debug, listener: l, broker: NewBroker(debug)}
+	allowAnonymous bool   // accept clients without username
+	anonymousRole  string // username used to authorize anonymous clients
+	certIdentity   string // field of client certificate used as username
 }
 
-func (s *listener) Manage() {
-	for {
-		conn, err := s.listener.Accept()
-		if err != nil {
-			log.Println("error accept connection", err)
-			conn.Close()
-			continue
-		}
+// ListenerOption configure single listener
+type ListenerOption func(*listener)
 
-		go s.broker.newConnection(conn)
+// AllowAnonymous accept or reject (with CONNACK "not authorized") clients connected without username.
+// Anonymous clients are accepted by default.
+func AllowAnonymous(allow bool) ListenerOption {
+	return func(l *listener) {
+		l.allowAnonymous = allow
 	}
 }
 
-func (s *listener) Accept() (net.Conn, error) {
-	conn, err := s.listener.Accept()
-	if err != nil {
-		return nil, err
+// AnonymousRole set username used to authorize anonymous clients, so access rules of the role are applied
+// to them. Without role only pattern and client id rules are applied.
+func AnonymousRole(role string) ListenerOption {
+	return func(l *listener) {
+		l.anonymousRole = role
 	}
-
-	if s.debug {
-		log.Println("accept new connection from", conn.RemoteAddr())
-	}
-
-	return conn, nil
 }
 
-func (s *listener) Close() error {
-	log.Println("close listener")
-	return s.listener.Close()
+// CertIdentity take username from verified tls client certificate: IdentityCN or IdentitySAN. Password of
+// such client is not checked, username of CONNECT is ignored. Clients without certificate are authenticated
+// as usual.
+func CertIdentity(field string) ListenerOption {
+	return func(l *listener) {
+		l.certIdentity = field
+	}
 }
 
-func (s *listener) Addr() net.Addr {
-	return s.listener.Addr()
+func newListener(opts []ListenerOption) *listener {
+	l := &listener{allowAnonymous: true}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
 }
@@ -0,0 +1,47 @@
+package broker
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// buffer written by concurrent handlers
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// password of CONNECT doesn't get into debug log and packet dumps, both accepted and refused
+func TestLogPassword(t *testing.T) {
+	out := &logBuffer{}
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(out, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	_, addr := newTestServer(t, []Option{WithStore(sessionStore(t)), WithDump([]string{"c1", "c2"}, nil)})
+	rawClient(t, addr, rawConnect("MQTT", 4, 0xc2, "c1", "alice", "secret"))
+	rawClient(t, addr, rawConnect("MQTT", 4, 0xc2, "c2", "alice", "wrong-secret"))
+	waitFor(t, "client connected", func() bool { return strings.Contains(out.String(), "client connected") })
+
+	log := out.String()
+	if !strings.Contains(log, "packet received") || !strings.Contains(log, "authorisation failed") {
+		t.Fatalf("CONNECT is not logged:\n%s", log)
+	}
+	if strings.Contains(log, "secret") {
+		t.Errorf("password is logged:\n%s", log)
+	}
+}
@@ -0,0 +1,96 @@
+package broker
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+
+	"github.com/MajaSuite/mqtt/db"
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+// MetricsHandler return http handler exposing broker metrics in prometheus text format
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.broker.writeMetrics(w)
+	})
+}
+
+func (b *Broker) writeMetrics(w http.ResponseWriter) {
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	metric := func(name string, kind string, help string) {
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	b.mu.Lock()
+	var connected, sessions, inflight, queued int
+	for _, client := range b.clients {
+		if client.handler != nil {
+			continue
+		}
+		if client.Stopped() {
+			sessions++
+		} else {
+			connected++
+			queued += len(client.channel)
+		}
+		inflight += len(client.ack)
+	}
+	retained := b.retained.count
+	b.mu.Unlock()
+
+	metric("mqtt_connections_total", "counter", "Accepted client connections.")
+	fmt.Fprintf(out, "mqtt_connections_total %d\n", atomic.LoadUint64(&b.stats.connections))
+	metric("mqtt_auth_failures_total", "counter", "Connections refused by authentication.")
+	fmt.Fprintf(out, "mqtt_auth_failures_total %d\n", atomic.LoadUint64(&b.stats.authFailures))
+	metric("mqtt_clients_connected", "gauge", "Connected clients.")
+	fmt.Fprintf(out, "mqtt_clients_connected %d\n", connected)
+	metric("mqtt_sessions_disconnected", "gauge", "Stateful sessions of disconnected clients.")
+	fmt.Fprintf(out, "mqtt_sessions_disconnected %d\n", sessions)
+
+	metric("mqtt_packets_received_total", "counter", "Packets received from clients by type.")
+	for t := packet.CONNECT; t <= packet.DISCONNECT; t++ {
+		fmt.Fprintf(out, "mqtt_packets_received_total{type=%q} %d\n", t.String(),
+			atomic.LoadUint64(&b.stats.packetsReceived[t]))
+	}
+	metric("mqtt_packets_sent_total", "counter", "Packets sent to clients by type.")
+	for t := packet.CONNECT; t <= packet.DISCONNECT; t++ {
+		fmt.Fprintf(out, "mqtt_packets_sent_total{type=%q} %d\n", t.String(), atomic.LoadUint64(&b.stats.packetsSent[t]))
+	}
+
+	metric("mqtt_bytes_received_total", "counter", "Bytes received from clients.")
+	fmt.Fprintf(out, "mqtt_bytes_received_total %d\n", atomic.LoadUint64(&b.stats.bytesReceived))
+	metric("mqtt_bytes_sent_total", "counter", "Bytes sent to clients.")
+	fmt.Fprintf(out, "mqtt_bytes_sent_total %d\n", atomic.LoadUint64(&b.stats.bytesSent))
+
+	metric("mqtt_publish_fanout", "summary", "Number of subscribers every published message is delivered to.")
+	fmt.Fprintf(out, "mqtt_publish_fanout_sum %d\n", atomic.LoadUint64(&b.stats.deliveries))
+	fmt.Fprintf(out, "mqtt_publish_fanout_count %d\n", atomic.LoadUint64(&b.stats.routed))
+	metric("mqtt_messages_dropped_total", "counter", "Messages dropped because client outbound queue is full.")
+	fmt.Fprintf(out, "mqtt_messages_dropped_total %d\n", atomic.LoadUint64(&b.stats.dropped))
+
+	metric("mqtt_messages_inflight", "gauge", "Messages waiting for acknowledge.")
+	fmt.Fprintf(out, "mqtt_messages_inflight %d\n", inflight)
+	metric("mqtt_messages_queued", "gauge", "Packets in client outbound queues.")
+	fmt.Fprintf(out, "mqtt_messages_queued %d\n", queued)
+	metric("mqtt_retained_messages", "gauge", "Retained messages.")
+	fmt.Fprintf(out, "mqtt_retained_messages %d\n", retained)
+
+	stats := db.Stats()
+	ops := make([]string, 0, len(stats))
+	for op := range stats {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	metric("mqtt_db_operation_seconds", "summary", "Duration of database operations.")
+	for _, op := range ops {
+		fmt.Fprintf(out, "mqtt_db_operation_seconds_sum{op=%q} %g\n", op, stats[op].Duration.Seconds())
+		fmt.Fprintf(out, "mqtt_db_operation_seconds_count{op=%q} %d\n", op, stats[op].Count)
+	}
+}
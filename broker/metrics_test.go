@@ -0,0 +1,129 @@
+package broker
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+// scrape metrics, return samples by name with labels and types by metric name. Every metric must have HELP
+// and TYPE lines.
+func scrape(t *testing.T, url string) (map[string]float64, map[string]string) {
+	t.Helper()
+
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); res.StatusCode != http.StatusOK || !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("status %d, content type %q", res.StatusCode, ct)
+	}
+
+	samples := make(map[string]float64)
+	types := make(map[string]string)
+	help := make(map[string]bool)
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) >= 4 && fields[0] == "#" && fields[1] == "HELP":
+			help[fields[2]] = true
+		case len(fields) == 4 && fields[0] == "#" && fields[1] == "TYPE":
+			if !help[fields[2]] {
+				t.Errorf("TYPE of %s without HELP", fields[2])
+			}
+			types[fields[2]] = fields[3]
+		case len(fields) == 2:
+			name, _, _ := strings.Cut(fields[0], "{")
+			if types[strings.TrimSuffix(strings.TrimSuffix(name, "_sum"), "_count")] == "" {
+				t.Errorf("sample %s without TYPE", fields[0])
+			}
+			value, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				t.Errorf("sample %s: %v", fields[0], err)
+			}
+			samples[fields[0]] = value
+		default:
+			t.Errorf("unexpected line %q", scanner.Text())
+		}
+	}
+
+	return samples, types
+}
+
+func TestMetrics(t *testing.T) {
+	s, addr := newTestServer(t, nil)
+	hs := httptest.NewServer(s.MetricsHandler())
+	defer hs.Close()
+
+	sub, _ := rawClient(t, addr, rawConnect("MQTT", 4, 0x02, "sub"))
+	rawSubscribe(t, sub, 0, "t")
+
+	before, types := scrape(t, hs.URL)
+	want := map[string]string{
+		"mqtt_connections_total":      "counter",
+		"mqtt_auth_failures_total":    "counter",
+		"mqtt_clients_connected":      "gauge",
+		"mqtt_sessions_disconnected":  "gauge",
+		"mqtt_packets_received_total": "counter",
+		"mqtt_packets_sent_total":     "counter",
+		"mqtt_bytes_received_total":   "counter",
+		"mqtt_bytes_sent_total":       "counter",
+		"mqtt_publish_fanout":         "summary",
+		"mqtt_messages_dropped_total": "counter",
+		"mqtt_messages_inflight":      "gauge",
+		"mqtt_messages_queued":        "gauge",
+		"mqtt_retained_messages":      "gauge",
+		"mqtt_db_operation_seconds":   "summary",
+	}
+	for name, kind := range want {
+		if types[name] != kind {
+			t.Errorf("type of %s %q, want %q", name, types[name], kind)
+		}
+	}
+	if before["mqtt_clients_connected"] != 1 || before["mqtt_connections_total"] != 1 {
+		t.Errorf("connected %v, connections %v, want 1", before["mqtt_clients_connected"],
+			before["mqtt_connections_total"])
+	}
+
+	pub, _ := rawClient(t, addr, rawConnect("MQTT", 4, 0x02, "pub"))
+	publish := packet.NewPublish()
+	publish.Topic = "t"
+	publish.Payload = "x"
+	publish.Retain = true
+	packet.WritePacket(pub, publish, false)
+	if _, ok := readPacket(t, sub).(*packet.PublishPacket); !ok {
+		t.Fatal("PUBLISH expected")
+	}
+
+	// packet is counted as sent after it's written
+	var after map[string]float64
+	sent := `mqtt_packets_sent_total{type="Publish"}`
+	waitFor(t, "sent publish", func() bool {
+		after, _ = scrape(t, hs.URL)
+		return after[sent] > before[sent]
+	})
+	for name, delta := range map[string]float64{
+		"mqtt_connections_total":                      1,
+		"mqtt_clients_connected":                      1,
+		`mqtt_packets_received_total{type="Publish"}`: 1,
+		`mqtt_packets_sent_total{type="Publish"}`:     1,
+		"mqtt_publish_fanout_sum":                     1,
+		"mqtt_publish_fanout_count":                   1,
+		"mqtt_retained_messages":                      1,
+	} {
+		if got := after[name] - before[name]; got != delta {
+			t.Errorf("%s changed by %v, want %v", name, got, delta)
+		}
+	}
+	if after["mqtt_bytes_received_total"] <= before["mqtt_bytes_received_total"] ||
+		after["mqtt_bytes_sent_total"] <= before["mqtt_bytes_sent_total"] {
+		t.Error("byte counters are not changed")
+	}
+}
@@ -2,7 +2,11 @@ package broker
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/MajaSuite/mqtt/db"
@@ -10,67 +14,386 @@ import (
 )
 
 type Broker struct {
-	debug   bool
-	channel chan packet.Packet // channel to mqtt broker engine (to push packet, received from client)
-	clients map[string]*Client // hashmap of all connected clients
+	queueSize int                // size of client outbound queue
+	quit      chan struct{}      // closed when broker is stopped
+	mu        sync.Mutex         // protect clients and their state
+	clients   map[string]*Client // hashmap of all connected clients
+	closing   bool               // broker is shutting down, new connections are refused
+	auth      Authenticator      // check credentials on connect
+	authz     Authorizer         // check access to topics, nil if access is not restricted
+	store     db.Store           // persisted users, sessions, subscriptions and retained messages
+	kick      bool               // disconnect client publishing to denied topic (drop message otherwise)
+	autoId    uint64             // counter for ids of clients connected without id
+	retained  *retainStore       // retained messages
+	stats     stats              // traffic counters
+	dump      dumpConfig         // packets logged with hex dumps
+	shared    *sharedGroups      // state of shared subscriptions
+	cluster   *cluster           // other nodes of cluster, nil if broker is standalone
 }
 
-func NewBroker(debug bool) *Broker {
+// NewBroker create broker engine keeping its data in store. If dump is set, packets of all clients are
+// logged with hex dumps.
+func NewBroker(store db.Store, dump bool, queueSize int) *Broker {
 	broker := &Broker{
-		debug:   debug,
-		channel: make(chan packet.Packet),
-		clients: make(map[string]*Client),
+		queueSize: queueSize,
+		quit:      make(chan struct{}),
+		clients:   make(map[string]*Client),
+		auth:      DBAuth{Store: store},
+		store:     store,
+		retained:  newRetainStore(store),
+		shared:    newSharedGroups(SharedRoundRobin),
 	}
 
-	go broker.broker()
+	if err := broker.retained.load(); err != nil {
+		slog.Error("error load retained messages", "err", err)
+	}
+	broker.dump.set(dump, nil, nil)
+
 	go broker.rescan()
 
 	return broker
 }
 
-// send to all subscribed clients
-func (b *Broker) publishMessage(pkt *packet.PublishPacket) {
+// check client access to topic, in-process clients have full access. Network clients can't publish to
+// $ topics.
+func (b *Broker) allowed(client *Client, topic string, access int) bool {
+	// $ topics are published only by broker itself
+	if access == db.AccessWrite && isSysTopic(topic) && client.handler == nil {
+		return false
+	}
+	if client.authz != nil {
+		return client.authz.Authorize(client.aclUser(), client.clientId, topic, access)
+	}
+	if b.authz == nil || client.handler != nil && !client.restricted {
+		return true
+	}
+
+	return b.authz.Authorize(client.aclUser(), client.clientId, topic, access)
+}
+
+// access of client to topic to check with authorize
+type accessCheck struct {
+	client *Client
+	topic  string
+	access int
+}
+
+// check access of clients to topics. Authorizer may call slow external service, so broker lock is released
+// while it's asked and clients may change meanwhile: caller must check that client is still connected. Must
+// be called with broker lock held.
+func (b *Broker) authorize(checks []accessCheck) []bool {
+	res := make([]bool, len(checks))
+	unlocked := false
+	for i, c := range checks {
+		if !unlocked && (c.client.authz != nil || b.authz != nil && (c.client.handler == nil || c.client.restricted)) {
+			b.mu.Unlock()
+			unlocked = true
+		}
+		res[i] = b.allowed(c.client, c.topic, c.access)
+	}
+	if unlocked {
+		b.mu.Lock()
+	}
+
+	return res
+}
+
+// client is still connected to broker
+func (b *Broker) active(client *Client) bool {
+	return b.clients[client.clientId] == client && !client.Stopped()
+}
+
+// send to all subscribed clients and to one client of every matched shared subscription. Subscribers are
+// collected first, then their access is checked (see authorize) and message is delivered. In cluster, client
+// of shared subscription is chosen on one node: message of other node is delivered only to shared
+// subscriptions given by groups, that node has chosen us for them.
+func (b *Broker) publishMessage(pkt *packet.PublishPacket, groups []string) {
+	type subscriber struct {
+		client *Client
+		qos    packet.QoS
+		ok     bool // matched by not shared subscription
+		subs   []packet.SubscribePayload
+	}
+
+	var subscribers []subscriber
+	var checks []accessCheck
 	for _, client := range b.clients {
-		if client != nil && client.conn != nil {
-			if client.Contains(pkt.Topic, 0) {
-				client.messageId++
-				pkt.Id = client.messageId
-				client.channel <- pkt
-
-				if pkt.QoS > 0 {
-					client.ack[fmt.Sprintf("s%d", pkt.Id)] = pkt
-				}
+		if client.bridge && client.clientId == pkt.Source() {
+			continue
+		}
+
+		qos, ok := client.match(pkt.Topic)
+		subs := client.matchShared(pkt.Topic)
+		if !ok && len(subs) == 0 {
+			continue
+		}
+		subscribers = append(subscribers, subscriber{client: client, qos: qos, ok: ok, subs: subs})
+		checks = append(checks, accessCheck{client: client, topic: pkt.Topic, access: db.AccessRead})
+	}
+	allowed := b.authorize(checks)
+
+	var deliveries uint64
+	shared := make(map[string][]sharedMember)
+	for i, s := range subscribers {
+		client, qos := s.client, s.qos
+		if !allowed[i] || b.clients[client.clientId] != client {
+			continue
+		}
+
+		if s.ok {
+			if pkt.QoS < qos {
+				qos = pkt.QoS
+			}
+			b.deliver(client, pkt, qos, client.bridge && pkt.Retain)
+			deliveries++
+		}
+
+		for _, sub := range s.subs {
+			shared[sub.Topic] = append(shared[sub.Topic], sharedMember{client: client, qos: sub.QoS})
+		}
+	}
+
+	remote := pkt.Source() == clusterSource
+	if remote {
+		for topic := range shared {
+			if !slices.Contains(groups, topic) {
+				delete(shared, topic)
 			}
 		}
 	}
+
+	var assigned map[string][]string
+	if b.cluster != nil && !remote {
+		assigned = b.cluster.assignShared(pkt, shared)
+	}
+
+	for topic, members := range shared {
+		m := b.shared.pick(topic, pkt.Source(), members)
+		qos := m.qos
+		if pkt.QoS < qos {
+			qos = pkt.QoS
+		}
+		b.deliver(m.client, pkt, qos, false)
+		deliveries++
+	}
+
+	atomic.AddUint64(&b.stats.routed, 1)
+	atomic.AddUint64(&b.stats.deliveries, deliveries)
+
+	if b.cluster != nil && !remote {
+		b.cluster.forward(pkt, assigned)
+	}
 }
 
-// send will message (on client disconnect)
-func (b *Broker) sendWill(client *Client) {
-	if client != nil {
-		if client.will != nil {
-			publish := packet.NewPublish()
-			//client.will.Flag
-			publish.Topic = client.will.Topic
-			publish.Payload = client.will.Payload
-			publish.QoS = client.will.QoS
-			//client.will.Retain
-
-			for _, c := range b.clients {
-				if c != nil && c.conn != nil {
-					client.channel <- publish
-				}
+// notify other nodes of cluster that subscriptions are changed
+func (b *Broker) subscriptionsChanged() {
+	if b.cluster != nil {
+		b.cluster.subscriptionsChanged()
+	}
+}
+
+// send copy of the message to the client with given qos. Retain flag is set only for retained messages
+// sent on new subscription.
+func (b *Broker) deliver(client *Client, pkt *packet.PublishPacket, qos packet.QoS, retain bool) {
+	publish := packet.NewPublish()
+	publish.Topic = pkt.Topic
+	publish.Payload = pkt.Payload
+	publish.QoS = qos
+	publish.Retain = retain
+
+	// in-process clients receive messages immediately, nothing to acknowledge
+	key := ""
+	if qos > 0 && client.handler == nil {
+		publish.Id = client.nextId()
+		key = fmt.Sprintf("s%d", publish.Id)
+		client.ack[key] = publish
+	}
+
+	// message of offline session stays in-flight and is sent on reconnect, dropped one is forgotten
+	if !client.send(publish) && key != "" && !client.Stopped() {
+		delete(client.ack, key)
+	}
+}
+
+// save or clear retained message and send it to subscribers
+func (b *Broker) route(pkt *packet.PublishPacket) {
+	if pkt.Retain {
+		b.retained.set(pkt)
+	}
+
+	b.publishMessage(pkt, nil)
+}
+
+// add subscriptions to client. Return granted qos for every topic. Broker lock is released while access is
+// checked (see authorize), nothing is subscribed if client is disconnected meanwhile.
+func (b *Broker) subscribe(client *Client, topics []packet.SubscribePayload) []packet.QoS {
+	checks := make([]accessCheck, len(topics))
+	malformed := make([]bool, len(topics))
+	for i, payload := range topics {
+		// access to shared subscription is checked by its topic filter
+		filter := payload.Topic
+		if strings.HasPrefix(filter, sharePrefix) {
+			_, shared, ok := parseShared(filter)
+			malformed[i] = !ok
+			filter = shared
+		}
+		checks[i] = accessCheck{client: client, topic: filter, access: db.AccessRead}
+	}
+	allowed := b.authorize(checks)
+
+	codes := []packet.QoS{}
+	for i, payload := range topics {
+		if malformed[i] {
+			client.log.Info("malformed shared subscription", "topic", payload.Topic)
+			codes = append(codes, packet.SubscribeFailure)
+			continue
+		}
+
+		if !allowed[i] || !b.active(client) {
+			client.log.Info("subscription denied", "topic", payload.Topic)
+			codes = append(codes, packet.SubscribeFailure)
+			continue
+		}
+
+		codes = append(codes, client.addSubscription(payload))
+
+		// if not clean session - save subscription
+		if client.session {
+			b.store.SaveSubscription(client.clientId, payload.Topic, payload.QoS.Int())
+		}
+	}
+	b.subscriptionsChanged()
+
+	return codes
+}
+
+// send retained messages matched by subscribed topics with granted qos (see subscribe). Message matched by
+// several topics is sent once with max of granted qos. Retained messages aren't sent to shared subscriptions.
+func (b *Broker) sendRetained(client *Client, topics []packet.SubscribePayload, codes []packet.QoS) {
+	granted := make(map[string]packet.QoS)
+	var messages []*packet.PublishPacket
+
+	for i, payload := range topics {
+		if codes[i] == packet.SubscribeFailure || strings.HasPrefix(payload.Topic, sharePrefix) {
+			continue
+		}
+
+		for _, m := range b.retained.match(payload.Topic) {
+			qos, ok := granted[m.Topic]
+			if !ok {
+				messages = append(messages, m)
+			}
+			if !ok || codes[i] > qos {
+				granted[m.Topic] = codes[i]
 			}
 		}
 	}
+
+	checks := make([]accessCheck, len(messages))
+	for i, m := range messages {
+		checks[i] = accessCheck{client: client, topic: m.Topic, access: db.AccessRead}
+	}
+	allowed := b.authorize(checks)
+
+	for i, m := range messages {
+		if !allowed[i] || b.clients[client.clientId] != client {
+			continue
+		}
+
+		qos := granted[m.Topic]
+		if m.QoS < qos {
+			qos = m.QoS
+		}
+		b.deliver(client, m, qos, true)
+	}
+}
+
+// publish will message of disconnected client as any other message, retained will is saved. Will is published
+// once, it's routed in own goroutine as broker may be in the middle of routing other message. Must be called
+// with broker lock held.
+func (b *Broker) sendWill(client *Client) {
+	will := client.will
+	if will == nil {
+		return
+	}
+	client.will = nil
+
+	publish := packet.NewPublish()
+	publish.Topic = will.Topic
+	publish.Payload = will.Payload
+	publish.QoS = will.QoS
+	publish.Retain = will.Retain
+	publish.SetSource(client.clientId)
+
+	go func() {
+		if !b.allowed(client, publish.Topic, db.AccessWrite) {
+			client.log.Info("will denied", "topic", publish.Topic)
+			return
+		}
+
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		select {
+		case <-b.quit:
+			return
+		default:
+		}
+		b.route(publish)
+	}()
+}
+
+// stop client connection, keep it in the broker if session is persisted
+func (b *Broker) disconnect(client *Client) {
+	if !client.session {
+		delete(b.clients, client.clientId)
+		b.subscriptionsChanged()
+	}
+	client.Stop()
+}
+
+// refuse new connections and stop all clients after their outbound queues are sent
+func (b *Broker) drainClients() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closing = true
+	for _, client := range b.clients {
+		client.Drain()
+	}
+}
+
+// persist state of all stateful sessions, including in-flight messages
+func (b *Broker) saveSessions() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for id, client := range b.clients {
+		if !client.session {
+			continue
+		}
+
+		inflight := make(map[string]*packet.PublishPacket)
+		for key, p := range client.ack {
+			inflight[key] = p.(*packet.PublishPacket)
+		}
+
+		if err := b.store.SaveSession(id, client.messageId, inflight); err != nil {
+			client.log.Error("error save session", "err", err)
+		}
+	}
+}
+
+func (b *Broker) close() {
+	close(b.quit)
 }
 
 func (b *Broker) rescan() {
 	for {
-		time.Sleep(time.Second * 10)
-
-		if b.debug {
-			//log.Println("rescan queue for ack")
+		select {
+		case <-b.quit:
+			return
+		case <-time.After(time.Second * 10):
 		}
 
 		//for id, event := range b.sent {
@@ -79,160 +402,128 @@ func (b *Broker) rescan() {
 	}
 }
 
-func (b *Broker) broker() {
-	for pkt := range b.channel {
-		if b.debug {
-			log.Printf("broker receive message %s from %s", pkt, pkt.Source())
-		}
-		client := b.clients[pkt.Source()]
+// handle packet received from client. Must be called with broker lock held.
+func (b *Broker) handle(client *Client, pkt packet.Packet) {
+	if !b.active(client) {
+		slog.Info("packet from unknown client ignored", "client", pkt.Source(), "type", pkt.Type().String())
+		return
+	}
 
-		switch pkt.Type() {
-		case packet.PING:
-			client.channel <- packet.NewPong()
-		case packet.DISCONNECT:
-			b.sendWill(client)
-			if !client.session {
-				delete(b.clients, pkt.Source())
-			}
-			client.Stop()
-		case packet.SUBSCRIBE:
-			retains, err := db.FetchRetain()
-
-			res := packet.NewSubAck()
-			res.Id = pkt.(*packet.SubscribePacket).Id
-
-			for _, payload := range pkt.(*packet.SubscribePacket).Topics {
-				res.ReturnCodes = append(res.ReturnCodes, client.addSubscription(payload))
-
-				if err == nil {
-					for _, m := range retains {
-						if client.Contains(m.Topic, m.QoS) {
-							client.messageId++
-							m.Id = client.messageId
-							client.channel <- m
-						}
-					}
-				}
-
-				// if not clean session - save subscription
-				if client.session {
-					db.SaveSubscription(pkt.Source(), payload.Topic, payload.QoS.Int())
-				}
-			}
+	client.log.Debug("broker receive message", "type", pkt.Type().String(), "packet", pkt.String())
 
-			client.channel <- res
-		case packet.UNSUBSCRIBE:
-			res := packet.NewUnSubAck()
-			res.Id = pkt.(*packet.UnSubscribePacket).Id
-			client.channel <- res
-			for _, subscribePayload := range pkt.(*packet.UnSubscribePacket).Topics {
-				if client.removeSubscription(subscribePayload) && b.clients[pkt.Source()].session {
-					db.DeleteSubscription(pkt.Source(), subscribePayload.Topic)
-				}
-			}
-		case packet.PUBLISH:
-			if pkt.(*packet.PublishPacket).Retain {
-				if pkt.(*packet.PublishPacket).Payload != "" {
-					db.SaveRetain(pkt.(*packet.PublishPacket).Topic, pkt.(*packet.PublishPacket).Payload, pkt.(*packet.PublishPacket).QoS.Int())
-				} else {
-					db.DeleteRetain(pkt.(*packet.PublishPacket).Topic, pkt.(*packet.PublishPacket).QoS.Int())
-				}
+	switch pkt.Type() {
+	case packet.PING:
+		client.send(packet.NewPong())
+	case packet.DISCONNECT:
+		client.will = nil // will must not be published on normal disconnect
+		b.disconnect(client)
+	case packet.SUBSCRIBE:
+		topics := pkt.(*packet.SubscribePacket).Topics
+		res := packet.NewSubAck()
+		res.Id = pkt.(*packet.SubscribePacket).Id
+		res.ReturnCodes = b.subscribe(client, topics)
+		client.send(res)
+		b.sendRetained(client, topics, res.ReturnCodes)
+	case packet.UNSUBSCRIBE:
+		res := packet.NewUnSubAck()
+		res.Id = pkt.(*packet.UnSubscribePacket).Id
+		client.send(res)
+		for _, subscribePayload := range pkt.(*packet.UnSubscribePacket).Topics {
+			if client.removeSubscription(subscribePayload) && client.session {
+				b.store.DeleteSubscription(pkt.Source(), subscribePayload.Topic)
 			}
+		}
+		b.subscriptionsChanged()
+	case packet.PUBLISH:
+		publish := pkt.(*packet.PublishPacket)
 
-			if pkt.(*packet.PublishPacket).DUP {
-				dup := client.ack[fmt.Sprintf("r%d", pkt.(*packet.PublishPacket).Id)]
-				if dup != nil {
-					//if dup.QoS() == ...
-					// ...
-				}
-			} else {
-				switch pkt.(*packet.PublishPacket).QoS {
-				case packet.AtMostOnce:
-					b.publishMessage(pkt.(*packet.PublishPacket))
-				case packet.AtLeastOnce:
-					puback := packet.NewPubAck()
-					puback.Id = pkt.(*packet.PublishPacket).Id
-					client.channel <- puback
-					b.publishMessage(pkt.(*packet.PublishPacket))
-				case packet.ExactlyOnce:
-					pubrec := packet.NewPubRec()
-					pubrec.Id = pkt.(*packet.PublishPacket).Id
-					client.channel <- pubrec
-					client.ack[fmt.Sprintf("r%d", pubrec.Id)] = pkt
-				}
-			}
-		case packet.PUBACK:
-			// we receive answer on client publish command with QOS(1); prefix to rescan is "s"
-			p := client.ack[fmt.Sprintf("s%d", pkt.(*packet.PubAckPacket).Id)]
-			if p != nil {
-				log.Printf("%s confirmed", p)
-				delete(client.ack, fmt.Sprintf("s%d", pkt.(*packet.PubAckPacket).Id))
-			} else {
-				log.Printf("packet to ack %d from %s not found", pkt.(*packet.PubAckPacket).Id, pkt.Source())
-			}
-		case packet.PUBREC: // we
-			// we receive answer on our PUBLISH with qos2,
-			p := client.ack[fmt.Sprintf("s%d", pkt.(*packet.PubRecPacket).Id)]
-			if p != nil {
-				delete(client.ack, fmt.Sprintf("s%d", pkt.(*packet.PubRecPacket).Id))
-				log.Printf("%s confirmed", p)
-
-				pubrel := packet.NewPubRel()
-				pubrel.Id = pkt.(*packet.PubRecPacket).Id
-				client.channel <- pubrel
-
-				client.ack[fmt.Sprintf("l%d", pkt.(*packet.PubRecPacket).Id)] = p
-			} else {
-				log.Printf("packet to rec %d from %s not found", pkt.(*packet.PubRecPacket).Id, pkt.Source())
+		// denied message is acknowledged as usual, but not routed
+		allowed := b.authorize([]accessCheck{{client: client, topic: publish.Topic, access: db.AccessWrite}})[0]
+		if !b.active(client) {
+			return // disconnected while access was checked
+		}
+		if !allowed {
+			client.log.Info("publish denied", "topic", publish.Topic)
+			if b.kick {
+				b.sendWill(client)
+				b.disconnect(client)
+				return
 			}
-		case packet.PUBREL:
-			// we receive answer on client send publish and client answer to pubrec
-			p := client.ack[fmt.Sprintf("r%d", pkt.(*packet.PubRelPacket).Id)]
-			if p != nil {
-				delete(client.ack, fmt.Sprintf("r%d", pkt.(*packet.PubRelPacket).Id))
-				log.Printf("%s confirmed", p)
-
-				b.publishMessage(p.(*packet.PublishPacket))
-
-				pubcomp := packet.NewPubComp()
-				pubcomp.Id = pkt.(*packet.PubRelPacket).Id
-				client.channel <- pubcomp
-			} else {
-				log.Printf("packet to rel %d from %s not found", pkt.(*packet.PubRelPacket).Id, pkt.Source())
-
-				// keep client silents
-				pubcomp := packet.NewPubComp()
-				pubcomp.Id = pkt.(*packet.PubRelPacket).Id
-				client.channel <- pubcomp
+		}
+
+		switch publish.QoS {
+		case packet.AtMostOnce:
+			if allowed {
+				b.route(publish)
 			}
-		case packet.PUBCOMP: // we
-			// we receive answer on our PUBREL
-			p := client.ack[fmt.Sprintf("l%d", pkt.(*packet.PubCompPacket).Id)]
-			if p != nil {
-				delete(client.ack, fmt.Sprintf("l%d", pkt.(*packet.PubCompPacket).Id))
-
-				for _, oc := range b.clients {
-					if oc != nil && oc.conn != nil && oc.clientId != client.clientId {
-						if oc.Contains(p.(*packet.PublishPacket).Topic, 0) {
-							oc.messageId++
-							p.(*packet.PublishPacket).Id = oc.messageId
-							oc.channel <- p
-							oc.ack[fmt.Sprintf("s%d", oc.messageId)] = p
-						}
-					}
-				}
-			} else {
-				log.Printf("packet to comp %d from %s not found", pkt.(*packet.PubCompPacket).Id, pkt.Source())
+		case packet.AtLeastOnce:
+			puback := packet.NewPubAck()
+			puback.Id = publish.Id
+			client.send(puback)
+			if allowed {
+				b.route(publish)
 			}
-		default:
-			log.Println("client unexpectedly disconnected")
-			if client != nil {
-				b.sendWill(client)
-				if !client.session {
-					delete(b.clients, pkt.Source())
-				}
-				client.Stop()
+		case packet.ExactlyOnce:
+			pubrec := packet.NewPubRec()
+			pubrec.Id = publish.Id
+			client.send(pubrec)
+
+			// duplicate of message we already have, it will be routed on PUBREL
+			if !allowed || publish.DUP && client.ack[fmt.Sprintf("r%d", pubrec.Id)] != nil {
+				break
 			}
+			client.ack[fmt.Sprintf("r%d", pubrec.Id)] = pkt
+		}
+	case packet.PUBACK:
+		// we receive answer on client publish command with QOS(1); prefix to rescan is "s"
+		p := client.ack[fmt.Sprintf("s%d", pkt.(*packet.PubAckPacket).Id)]
+		if p != nil {
+			client.log.Debug("message confirmed", "packet", p.String())
+			delete(client.ack, fmt.Sprintf("s%d", pkt.(*packet.PubAckPacket).Id))
+		} else {
+			client.log.Info("packet to ack not found", "id", pkt.(*packet.PubAckPacket).Id)
+		}
+	case packet.PUBREC: // we
+		// we receive answer on our PUBLISH with qos2,
+		p := client.ack[fmt.Sprintf("s%d", pkt.(*packet.PubRecPacket).Id)]
+		if p != nil {
+			delete(client.ack, fmt.Sprintf("s%d", pkt.(*packet.PubRecPacket).Id))
+			client.log.Debug("message confirmed", "packet", p.String())
+
+			pubrel := packet.NewPubRel()
+			pubrel.Id = pkt.(*packet.PubRecPacket).Id
+			client.send(pubrel)
+
+			client.ack[fmt.Sprintf("l%d", pkt.(*packet.PubRecPacket).Id)] = p
+		} else {
+			client.log.Info("packet to rec not found", "id", pkt.(*packet.PubRecPacket).Id)
+		}
+	case packet.PUBREL:
+		// we receive answer on client send publish and client answer to pubrec
+		p := client.ack[fmt.Sprintf("r%d", pkt.(*packet.PubRelPacket).Id)]
+		if p != nil {
+			delete(client.ack, fmt.Sprintf("r%d", pkt.(*packet.PubRelPacket).Id))
+			client.log.Debug("message confirmed", "packet", p.String())
+
+			b.route(p.(*packet.PublishPacket))
+		} else {
+			client.log.Info("packet to rel not found", "id", pkt.(*packet.PubRelPacket).Id)
+		}
+
+		// keep client silents
+		pubcomp := packet.NewPubComp()
+		pubcomp.Id = pkt.(*packet.PubRelPacket).Id
+		client.send(pubcomp)
+	case packet.PUBCOMP: // we
+		// we receive answer on our PUBREL, message delivered
+		if client.ack[fmt.Sprintf("l%d", pkt.(*packet.PubCompPacket).Id)] != nil {
+			delete(client.ack, fmt.Sprintf("l%d", pkt.(*packet.PubCompPacket).Id))
+		} else {
+			client.log.Info("packet to comp not found", "id", pkt.(*packet.PubCompPacket).Id)
 		}
+	default:
+		client.log.Info("client unexpectedly disconnected")
+		b.sendWill(client)
+		b.disconnect(client)
 	}
 }
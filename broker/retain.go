@@ -0,0 +1,260 @@
+package broker
+
+import (
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/MajaSuite/mqtt/db"
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+// cleared retained messages are remembered this long, so the clear wins over older message of cluster node
+const retainTombstoneTTL = time.Hour * 24
+
+// retained messages indexed by topic tree. Changes are written through to database. Must be used with
+// broker lock held.
+type retainStore struct {
+	store    db.Store
+	root     *retainNode
+	count    int // number of retained messages except broker status ($SYS)
+	maxCount int // max number of retained messages, 0 - unlimited
+	maxSize  int // max payload size of retained message, 0 - unlimited
+
+	// time of last change of topic in unix nanoseconds, cleared topics included (tombstones). Cluster nodes
+	// keep the newest change. Times are kept in memory only, so messages loaded from database are older
+	// than any change of other nodes.
+	changed map[string]int64
+	pruned  time.Time // when expired tombstones were removed
+}
+
+type retainNode struct {
+	children map[string]*retainNode
+	message  *packet.PublishPacket
+}
+
+func newRetainStore(store db.Store) *retainStore {
+	return &retainStore{
+		store:   store,
+		root:    &retainNode{children: make(map[string]*retainNode)},
+		changed: make(map[string]int64),
+		pruned:  time.Now(),
+	}
+}
+
+// load retained messages from database
+func (r *retainStore) load() error {
+	messages, err := r.store.FetchRetain()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range messages {
+		r.put(m)
+	}
+
+	slog.Info("loaded retained messages", "count", len(messages))
+
+	return nil
+}
+
+// set retained message of the topic, message with empty payload clears it. False returned if message
+// is not retained due to limits.
+func (r *retainStore) set(pkt *packet.PublishPacket) bool {
+	// change is stamped after previous one, even if clock of node that made it was ahead
+	return r.setAt(pkt, max(time.Now().UnixNano(), r.changed[pkt.Topic]+1))
+}
+
+// set retained message changed at given time (see set)
+func (r *retainStore) setAt(pkt *packet.PublishPacket, at int64) bool {
+	// broker status is published again after restart, it is not saved and not limited
+	sys := strings.HasPrefix(pkt.Topic, sysPrefix)
+
+	if pkt.Payload == "" {
+		if r.remove(pkt.Topic) && !sys {
+			r.store.DeleteRetain(pkt.Topic)
+		}
+		r.changed[pkt.Topic] = at
+		r.prune()
+		return true
+	}
+
+	if sys {
+		r.put(retainCopy(pkt))
+		return true
+	}
+
+	if r.maxSize > 0 && len(pkt.Payload) > r.maxSize {
+		slog.Warn("retained message is too large", "topic", pkt.Topic, "size", len(pkt.Payload))
+		return false
+	}
+
+	if r.maxCount > 0 && r.count >= r.maxCount && r.get(pkt.Topic) == nil {
+		slog.Warn("too many retained messages, message is not retained", "topic", pkt.Topic)
+		return false
+	}
+
+	message := retainCopy(pkt)
+	r.put(message)
+	r.changed[pkt.Topic] = at
+	r.store.SaveRetain(message.Topic, message.Payload, message.QoS.Int())
+
+	return true
+}
+
+// newer return true if change of the topic made at given time is newer than the last one
+func (r *retainStore) newer(topic string, at int64) bool {
+	return at > r.changed[topic]
+}
+
+// remove expired tombstones, once an hour at most
+func (r *retainStore) prune() {
+	if time.Since(r.pruned) < time.Hour {
+		return
+	}
+	r.pruned = time.Now()
+
+	expired := r.pruned.Add(-retainTombstoneTTL).UnixNano()
+	for topic, at := range r.changed {
+		if at < expired && r.get(topic) == nil {
+			delete(r.changed, topic)
+		}
+	}
+}
+
+// cleared topics with time of clear
+func (r *retainStore) tombstones() map[string]int64 {
+	res := make(map[string]int64)
+	for topic, at := range r.changed {
+		if r.get(topic) == nil {
+			res[topic] = at
+		}
+	}
+	return res
+}
+
+func (r *retainStore) put(message *packet.PublishPacket) {
+	node := r.root
+	for _, level := range strings.Split(message.Topic, "/") {
+		child, ok := node.children[level]
+		if !ok {
+			child = &retainNode{children: make(map[string]*retainNode)}
+			node.children[level] = child
+		}
+		node = child
+	}
+
+	if node.message == nil && !strings.HasPrefix(message.Topic, sysPrefix) {
+		r.count++
+	}
+	node.message = message
+}
+
+func retainCopy(pkt *packet.PublishPacket) *packet.PublishPacket {
+	message := packet.NewPublish()
+	message.Topic = pkt.Topic
+	message.Payload = pkt.Payload
+	message.QoS = pkt.QoS
+	message.Retain = true
+	return message
+}
+
+// retained message of the topic, nil if there is no one
+func (r *retainStore) get(topic string) *packet.PublishPacket {
+	node := r.root
+	for _, level := range strings.Split(topic, "/") {
+		if node = node.children[level]; node == nil {
+			return nil
+		}
+	}
+
+	return node.message
+}
+
+// remove retained message of the topic and empty nodes of its path, false if there is no message
+func (r *retainStore) remove(topic string) bool {
+	levels := strings.Split(topic, "/")
+	path := []*retainNode{r.root}
+
+	node := r.root
+	for _, level := range levels {
+		if node = node.children[level]; node == nil {
+			return false
+		}
+		path = append(path, node)
+	}
+
+	if node.message == nil {
+		return false
+	}
+	node.message = nil
+	if !strings.HasPrefix(topic, sysPrefix) {
+		r.count--
+	}
+
+	for i := len(levels) - 1; i >= 0; i-- {
+		if path[i+1].message != nil || len(path[i+1].children) > 0 {
+			break
+		}
+		delete(path[i].children, levels[i])
+	}
+
+	return true
+}
+
+// retained messages of topics matched by the filter
+func (r *retainStore) match(filter string) []*packet.PublishPacket {
+	var res []*packet.PublishPacket
+	r.root.match(strings.Split(filter, "/"), true, &res)
+	return res
+}
+
+// all retained messages
+func (r *retainStore) all() []*packet.PublishPacket {
+	var res []*packet.PublishPacket
+	r.root.collect(&res)
+	return res
+}
+
+// match filter levels below the node. Wildcards on first level don't match $ topics.
+func (n *retainNode) match(levels []string, first bool, res *[]*packet.PublishPacket) {
+	if len(levels) == 0 {
+		if n.message != nil {
+			*res = append(*res, n.message)
+		}
+		return
+	}
+
+	switch levels[0] {
+	case "#":
+		// parent level and everything below
+		if n.message != nil && !first {
+			*res = append(*res, n.message)
+		}
+		for name, child := range n.children {
+			if !first || !isSysTopic(name) {
+				child.collect(res)
+			}
+		}
+	case "+":
+		for name, child := range n.children {
+			if !first || !isSysTopic(name) {
+				child.match(levels[1:], false, res)
+			}
+		}
+	default:
+		if child := n.children[levels[0]]; child != nil {
+			child.match(levels[1:], false, res)
+		}
+	}
+}
+
+// append messages of the node and all nodes below
+func (n *retainNode) collect(res *[]*packet.PublishPacket) {
+	if n.message != nil {
+		*res = append(*res, n.message)
+	}
+	for _, child := range n.children {
+		child.collect(res)
+	}
+}
@@ -0,0 +1,176 @@
+package broker
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MajaSuite/mqtt/db"
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+func TestRetainLimitsWithSys(t *testing.T) {
+	s, _ := newTestServer(t, []Option{WithRetainLimits(10, 0), WithSysInterval(time.Millisecond * 10)})
+	b := s.broker
+
+	retained := func(topic string) string {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if m := b.retained.get(topic); m != nil {
+			return m.Payload
+		}
+		return ""
+	}
+
+	waitFor(t, "$SYS topics", func() bool { return retained("$SYS/broker/version") != "" })
+
+	for i := 0; i <= 10; i++ {
+		if err := s.Publish(fmt.Sprintf("home/%d", i), "1", 0, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		if retained(fmt.Sprintf("home/%d", i)) == "" {
+			t.Errorf("home/%d is not retained", i)
+		}
+	}
+	if retained("home/10") != "" {
+		t.Error("home/10 is retained beyond limit")
+	}
+
+	waitFor(t, "retained count 10", func() bool { return retained("$SYS/broker/retained messages/count") == "10" })
+
+	// clearing broker status doesn't change count
+	b.mu.Lock()
+	b.retained.remove("$SYS/broker/version")
+	count := b.retained.count
+	b.mu.Unlock()
+	if count != 10 {
+		t.Errorf("count %d, want 10", count)
+	}
+}
+
+// retained message is sent after SUBACK with RETAIN set, live messages are sent without it. Empty payload of
+// any qos clears retained message.
+func TestRetain(t *testing.T) {
+	store := db.NewMemory()
+	_, addr := newTestServer(t, []Option{WithStore(store)})
+
+	pub, _ := rawClient(t, addr, rawConnect("MQTT", 4, 0x02, "pub"))
+	publish := func(topic, payload string, qos packet.QoS, retain bool) {
+		t.Helper()
+		p := packet.NewPublish()
+		p.Id = 1
+		p.Topic = topic
+		p.Payload = payload
+		p.QoS = qos
+		p.Retain = retain
+		packet.WritePacket(pub, p, false)
+		if qos == packet.AtLeastOnce {
+			if _, ok := readPacket(t, pub).(*packet.PubAckPacket); !ok {
+				t.Fatal("PUBACK expected")
+			}
+		}
+	}
+	receive := func(conn net.Conn, topic, payload string, retain bool) {
+		t.Helper()
+		p, ok := readPacket(t, conn).(*packet.PublishPacket)
+		if !ok || p.Topic != topic || p.Payload != payload || p.Retain != retain {
+			t.Fatalf("got %v, want PUBLISH %s %q retain %v", p, topic, payload, retain)
+		}
+	}
+
+	publish("a/b", "x", packet.AtLeastOnce, true)
+
+	// rawSubscribe fails if retained message comes before SUBACK
+	sub, _ := rawClient(t, addr, rawConnect("MQTT", 4, 0x02, "sub"))
+	rawSubscribe(t, sub, 0, "a/#")
+	receive(sub, "a/b", "x", true)
+
+	publish("a/b", "y", packet.AtLeastOnce, true)
+	receive(sub, "a/b", "y", false)
+	publish("a/c", "z", packet.AtMostOnce, false)
+	receive(sub, "a/c", "z", false)
+
+	// retained with qos 1, cleared with qos 0
+	publish("a/b", "", packet.AtMostOnce, true)
+	receive(sub, "a/b", "", false)
+	if messages, err := store.FetchRetain(); err != nil || len(messages) != 0 {
+		t.Errorf("stored retained messages %v, %v, want none", messages, err)
+	}
+
+	other, _ := rawClient(t, addr, rawConnect("MQTT", 4, 0x02, "other"))
+	rawSubscribe(t, other, 0, "a/#")
+	publish("a/c", "live", packet.AtMostOnce, false)
+	receive(other, "a/c", "live", false)
+}
+
+// message is delivered with min of subscription and message qos, both live and retained
+func TestDeliveryQoS(t *testing.T) {
+	_, addr := newTestServer(t, nil)
+
+	pub, _ := rawClient(t, addr, rawConnect("MQTT", 4, 0x02, "pub"))
+	publish := func(topic string, qos packet.QoS, retain bool) {
+		t.Helper()
+		p := packet.NewPublish()
+		p.Id = 1
+		p.Topic = topic
+		p.Payload = topic
+		p.QoS = qos
+		p.Retain = retain
+		packet.WritePacket(pub, p, false)
+
+		switch qos {
+		case packet.AtLeastOnce:
+			if _, ok := readPacket(t, pub).(*packet.PubAckPacket); !ok {
+				t.Fatal("PUBACK expected")
+			}
+		case packet.ExactlyOnce:
+			if _, ok := readPacket(t, pub).(*packet.PubRecPacket); !ok {
+				t.Fatal("PUBREC expected")
+			}
+			pubrel := packet.NewPubRel()
+			pubrel.Id = 1
+			packet.WritePacket(pub, pubrel, false)
+			if _, ok := readPacket(t, pub).(*packet.PubCompPacket); !ok {
+				t.Fatal("PUBCOMP expected")
+			}
+		}
+	}
+
+	publish("retained/2", packet.ExactlyOnce, true)
+	publish("retained/0", packet.AtMostOnce, true)
+
+	tests := []struct {
+		sub   packet.QoS // qos of subscription
+		topic string
+		qos   packet.QoS // qos of message
+		want  packet.QoS
+	}{
+		{packet.AtLeastOnce, "live/2", packet.ExactlyOnce, packet.AtLeastOnce},
+		{packet.AtLeastOnce, "live/0", packet.AtMostOnce, packet.AtMostOnce},
+		{packet.ExactlyOnce, "live/1", packet.AtLeastOnce, packet.AtLeastOnce},
+		{packet.AtMostOnce, "live/2", packet.ExactlyOnce, packet.AtMostOnce},
+		{packet.AtLeastOnce, "retained/2", packet.ExactlyOnce, packet.AtLeastOnce},
+		{packet.ExactlyOnce, "retained/0", packet.AtMostOnce, packet.AtMostOnce},
+	}
+
+	for i, tt := range tests {
+		sub, _ := rawClient(t, addr, rawConnect("MQTT", 4, 0x02, fmt.Sprintf("sub%d", i)))
+		if codes := rawSubscribe(t, sub, tt.sub, tt.topic); len(codes) != 1 || codes[0] != tt.sub {
+			t.Fatalf("SUBACK return codes %v, want [%d]", codes, tt.sub)
+		}
+		if strings.HasPrefix(tt.topic, "live/") {
+			publish(tt.topic, tt.qos, false)
+		}
+
+		p, ok := readPacket(t, sub).(*packet.PublishPacket)
+		if !ok || p.Topic != tt.topic || p.QoS != tt.want {
+			t.Errorf("subscription qos %d, message %s qos %d: got %v, want qos %d", tt.sub, tt.topic, tt.qos, p,
+				tt.want)
+		}
+	}
+}
@@ -0,0 +1,530 @@
+package broker
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MajaSuite/mqtt/db"
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+var (
+	ErrServerClosed  = errors.New("mqtt: server closed")
+	ErrInvalidTopic  = errors.New("mqtt: invalid topic")
+	ErrUnknownClient = errors.New("mqtt: unknown client")
+)
+
+// Server is embeddable mqtt broker. It serves any number of listeners and route messages between network
+// clients and in-process subscribers.
+type Server struct {
+	dump      DumpConfig
+	queueSize int
+	store     db.Store
+	auth      Authenticator
+	authz     Authorizer
+	acl       bool
+	kick      bool
+	retainMax int
+	retainLen int
+	sysPeriod time.Duration
+	shared    string
+	broker    *Broker
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{} // running connections
+	closed    bool
+	bridges   []*Bridge
+	cluster   *cluster
+	wg        sync.WaitGroup
+	localId   uint64 // counter for in-process subscribers
+}
+
+// Option configure server
+type Option func(*Server)
+
+// WithDebug log hex dumps of packets of all clients
+func WithDebug(debug bool) Option {
+	return func(s *Server) {
+		s.dump.All = debug
+	}
+}
+
+// WithDump log hex dumps of packets of given clients and publishes to topics matched by given filters
+func WithDump(clients []string, topics []string) Option {
+	return func(s *Server) {
+		s.dump.Clients = clients
+		s.dump.Topics = topics
+	}
+}
+
+// WithQueueSize set size of outbound queue of every client. Messages are dropped when queue is full,
+// acknowledges are queued beyond the size, client which doesn't read them is disconnected.
+func WithQueueSize(size int) Option {
+	return func(s *Server) {
+		s.queueSize = size
+	}
+}
+
+// WithRetainLimits limit number of retained messages and payload size of every one, 0 - unlimited.
+// Messages beyond limits are delivered to subscribers, but not retained.
+func WithRetainLimits(count int, size int) Option {
+	return func(s *Server) {
+		s.retainMax = count
+		s.retainLen = size
+	}
+}
+
+// WithSysInterval set interval of publishing broker status to $SYS topics, 0 disables them
+func WithSysInterval(interval time.Duration) Option {
+	return func(s *Server) {
+		s.sysPeriod = interval
+	}
+}
+
+// WithSharedStrategy set how client of shared subscription group is chosen: SharedRoundRobin (default),
+// SharedRandom or SharedSticky
+func WithSharedStrategy(strategy string) Option {
+	return func(s *Server) {
+		s.shared = strategy
+	}
+}
+
+// WithStore set store keeping users, sessions, subscriptions and retained messages, by default everything is
+// kept in memory and lost on restart
+func WithStore(store db.Store) Option {
+	return func(s *Server) {
+		s.store = store
+	}
+}
+
+// WithAuthenticator set authenticator checking credentials on connect, by default users of broker
+// store are used
+func WithAuthenticator(auth Authenticator) Option {
+	return func(s *Server) {
+		s.auth = auth
+	}
+}
+
+// WithAuthorizer restrict access to topics. Client publishing to denied topic is disconnected if kick is
+// true, otherwise message is silently dropped. Subscription to denied topic filter is refused.
+func WithAuthorizer(authz Authorizer, kick bool) Option {
+	return func(s *Server) {
+		s.authz = authz
+		s.kick = kick
+	}
+}
+
+// WithACL restrict access to topics by rules from broker store, see WithAuthorizer
+func WithACL(kick bool) Option {
+	return func(s *Server) {
+		s.acl = true
+		s.kick = kick
+	}
+}
+
+func NewServer(opts ...Option) *Server {
+	s := &Server{
+		queueSize: 100,
+		sysPeriod: time.Second * 10,
+		shared:    SharedRoundRobin,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.store == nil {
+		s.store = db.NewMemory()
+	}
+	if s.auth == nil {
+		s.auth = DBAuth{Store: s.store}
+	}
+	if s.acl {
+		acl, err := LoadACL(s.store)
+		if err != nil {
+			// deny everything rather than allow
+			slog.Error("error load acl", "err", err)
+			acl = &ACL{store: s.store}
+		}
+		s.authz = acl
+	}
+
+	s.broker = NewBroker(s.store, s.dump.All, s.queueSize)
+	s.broker.dump.set(s.dump.All, s.dump.Clients, s.dump.Topics)
+	s.broker.auth = s.auth
+	s.broker.authz = s.authz
+	s.broker.kick = s.kick
+	s.broker.shared = newSharedGroups(s.shared)
+	s.broker.retained.maxCount = s.retainMax
+	s.broker.retained.maxSize = s.retainLen
+
+	if s.sysPeriod > 0 {
+		go s.broker.sys(s.sysPeriod)
+	}
+
+	return s
+}
+
+// Reload reload data of authenticator and authorizer (like acl rules) if they support it. New access rules
+// are applied to existing subscriptions too.
+func (s *Server) Reload() error {
+	for _, v := range []interface{}{s.auth, s.authz} {
+		if r, ok := v.(Reloader); ok {
+			if err := r.Reload(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Serve accept incoming connections on the listener and serve them. Serve always returns non-nil error,
+// after Shutdown it is ErrServerClosed.
+func (s *Server) Serve(l net.Listener, opts ...ListenerOption) error {
+	settings := newListener(opts)
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	slog.Info("listen on address", "addr", l.Addr().String())
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+
+			slog.Error("error accept connection", "err", err)
+			time.Sleep(time.Millisecond * 100)
+			continue
+		}
+
+		slog.Debug("accept new connection", "remote", conn.RemoteAddr().String())
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+				s.wg.Done()
+			}()
+			s.broker.newConnection(conn, settings)
+		}()
+	}
+}
+
+// ListenAndServe listen on tcp address and serve connections
+func (s *Server) ListenAndServe(addr string, opts ...ListenerOption) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l, opts...)
+}
+
+// ListenAndServeTLS listen on tcp address and serve tls connections with given certificate and key
+func (s *Server) ListenAndServeTLS(addr string, certFile string, keyFile string, opts ...ListenerOption) error {
+	config, err := NewTLSConfig(certFile, keyFile, "", false)
+	if err != nil {
+		return err
+	}
+
+	return s.ListenAndServeTLSConfig(addr, config, opts...)
+}
+
+// ListenAndServeTLSConfig listen on tcp address and serve tls connections with given config (see NewTLSConfig)
+func (s *Server) ListenAndServeTLSConfig(addr string, config *tls.Config, opts ...ListenerOption) error {
+	l, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l, opts...)
+}
+
+// Shutdown stop accepting new connections, send queued messages to clients and close connections. When
+// context is done before all queues are sent, remaining connections are closed immediately. At the end
+// state of stateful sessions, including in-flight messages, is saved to database.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.closed = true
+	for l := range s.listeners {
+		slog.Info("close listener", "addr", l.Addr().String())
+		l.Close()
+	}
+	bridges := s.bridges
+	cluster := s.cluster
+	s.mu.Unlock()
+
+	for _, br := range bridges {
+		br.Close()
+	}
+	if cluster != nil {
+		cluster.close()
+	}
+
+	s.broker.drainClients()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		slog.Warn("shutdown deadline exceeded, close remaining connections")
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		<-done
+	}
+
+	s.broker.saveSessions()
+	s.broker.close()
+
+	return err
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Publish inject message into broker as it was received from client
+func (s *Server) Publish(topic string, payload string, qos packet.QoS, retain bool) error {
+	if topic == "" || strings.ContainsAny(topic, "+#") {
+		return ErrInvalidTopic
+	}
+	if !qos.Valid() {
+		return packet.ErrInvalidQos
+	}
+	if s.isClosed() {
+		return ErrServerClosed
+	}
+
+	publish := packet.NewPublish()
+	publish.Topic = topic
+	publish.Payload = payload
+	publish.QoS = qos
+	publish.Retain = retain
+
+	s.broker.mu.Lock()
+	s.broker.route(publish)
+	s.broker.mu.Unlock()
+
+	return nil
+}
+
+// Subscription of in-process subscriber
+type Subscription struct {
+	server *Server
+	client *Client
+}
+
+// Subscribe register in-process subscriber for topic filter. Handler is called from separate goroutine for
+// every message matched the filter, including retained ones.
+func (s *Server) Subscribe(filter string, qos packet.QoS, handler Handler) (*Subscription, error) {
+	if !packet.ValidFilter(filter) {
+		return nil, ErrInvalidTopic
+	}
+	if _, _, ok := parseShared(filter); strings.HasPrefix(filter, sharePrefix) && !ok {
+		return nil, ErrInvalidTopic
+	}
+	if !qos.Valid() {
+		return nil, packet.ErrInvalidQos
+	}
+	if s.isClosed() {
+		return nil, ErrServerClosed
+	}
+
+	id := fmt.Sprintf("$local-%d", atomic.AddUint64(&s.localId, 1))
+	client := newLocalClient(id, handler, s.broker)
+
+	s.broker.mu.Lock()
+	s.broker.clients[id] = client
+	topics := []packet.SubscribePayload{{Topic: filter, QoS: qos}}
+	s.broker.sendRetained(client, topics, s.broker.subscribe(client, topics))
+	s.broker.mu.Unlock()
+
+	go client.Start()
+
+	return &Subscription{server: s, client: client}, nil
+}
+
+// Unsubscribe remove in-process subscriber, handler will not be called after that
+func (sub *Subscription) Unsubscribe() {
+	b := sub.server.broker
+
+	b.mu.Lock()
+	b.disconnect(sub.client)
+	b.mu.Unlock()
+}
+
+// ClientInfo describe client known to the broker
+type ClientInfo struct {
+	ClientID      string                    `json:"clientid"`
+	Username      string                    `json:"username,omitempty"`
+	Address       string                    `json:"address,omitempty"`
+	KeepAlive     uint16                    `json:"keepalive"`
+	Session       bool                      `json:"session"`
+	Connected     bool                      `json:"connected"`
+	Subscriptions []packet.SubscribePayload `json:"subscriptions"`
+	Queued        int                       `json:"queued"`   // packets in outbound queue
+	Inflight      int                       `json:"inflight"` // messages waiting for acknowledge
+}
+
+// Clients return all clients known to the broker, including offline clients with persisted session
+func (s *Server) Clients() []ClientInfo {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+
+	res := []ClientInfo{}
+	for id, client := range s.broker.clients {
+		if client.handler != nil {
+			continue
+		}
+
+		info := ClientInfo{
+			ClientID:      id,
+			Username:      client.username,
+			KeepAlive:     client.keepAlive,
+			Session:       client.session,
+			Connected:     !client.Stopped(),
+			Subscriptions: append([]packet.SubscribePayload{}, client.subscription...),
+			Inflight:      len(client.ack),
+		}
+		if info.Connected {
+			info.Queued = len(client.channel)
+		}
+		if client.conn != nil {
+			info.Address = client.conn.RemoteAddr().String()
+		}
+		res = append(res, info)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ClientID < res[j].ClientID })
+
+	return res
+}
+
+// Kick disconnect client, its will message is published. Persisted session is kept.
+func (s *Server) Kick(clientId string) error {
+	b := s.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	client := b.clients[clientId]
+	if client == nil || client.handler != nil || client.Stopped() {
+		return ErrUnknownClient
+	}
+
+	client.log.Info("client kicked")
+	b.sendWill(client)
+	b.disconnect(client)
+
+	return nil
+}
+
+// Dump return selection of packets logged with hex dumps
+func (s *Server) Dump() DumpConfig {
+	return s.broker.dump.get()
+}
+
+// SetDump change selection of packets logged with hex dumps, it takes effect immediately
+func (s *Server) SetDump(config DumpConfig) error {
+	for _, filter := range config.Topics {
+		if filter == "" {
+			return ErrInvalidTopic
+		}
+	}
+
+	s.broker.dump.set(config.All, config.Clients, config.Topics)
+	return nil
+}
+
+// Message is published message
+type Message struct {
+	Topic   string     `json:"topic"`
+	Payload string     `json:"payload"`
+	QoS     packet.QoS `json:"qos"`
+	Retain  bool       `json:"retain"`
+}
+
+// Retained return all retained messages sorted by topic
+func (s *Server) Retained() []Message {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+
+	res := []Message{}
+	for _, m := range s.broker.retained.all() {
+		res = append(res, Message{Topic: m.Topic, Payload: m.Payload, QoS: m.QoS, Retain: true})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Topic < res[j].Topic })
+
+	return res
+}
+
+// DeleteRetained clear retained message of the topic, false if there is no one
+func (s *Server) DeleteRetained(topic string) bool {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+
+	if s.broker.retained.get(topic) == nil {
+		return false
+	}
+
+	clear := packet.NewPublish()
+	clear.Topic = topic
+	clear.Retain = true
+	s.broker.retained.set(clear)
+	if s.broker.cluster != nil {
+		s.broker.cluster.clearRetained(topic)
+	}
+
+	return true
+}
@@ -0,0 +1,234 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MajaSuite/mqtt/db"
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+// start server on random local port, it is shut down at the end of test
+func newTestServer(t *testing.T, opts []Option, lopts ...ListenerOption) (*Server, string) {
+	t.Helper()
+
+	s := NewServer(append([]Option{WithSysInterval(0)}, opts...)...)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l, lopts...)
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+
+	return s, l.Addr().String()
+}
+
+// wait until cond is true or fail test after timeout
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second * 5)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// messages received by in-process subscriber
+type inbox struct {
+	mu       sync.Mutex
+	messages []*packet.PublishPacket
+}
+
+func (in *inbox) handler(pkt *packet.PublishPacket) {
+	in.mu.Lock()
+	in.messages = append(in.messages, pkt)
+	in.mu.Unlock()
+}
+
+func (in *inbox) payloads() []string {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	res := []string{}
+	for _, m := range in.messages {
+		res = append(res, m.Payload)
+	}
+	return res
+}
+
+// raw client of stateful session of alice subscribed to topic t with qos 1, CONNACK and SUBACK are read
+func sessionClient(t *testing.T, addr string) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	conn.Write(rawConnect("MQTT", 4, 0xc0, "device", "alice", "secret"))
+	subscribe := packet.NewSubscribe()
+	subscribe.Id = 1
+	subscribe.Topics = []packet.SubscribePayload{{Topic: "t", QoS: 1}}
+	packet.WritePacket(conn, subscribe, false)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	res := make([]byte, 4+5)
+	if _, err := io.ReadFull(conn, res); err != nil {
+		t.Fatal(err)
+	}
+	if res[3] != 0 || res[8] != 1 {
+		t.Fatalf("CONNACK and SUBACK % x", res)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	return conn
+}
+
+func sessionStore(t *testing.T) db.Store {
+	t.Helper()
+
+	store := db.NewMemory()
+	if err := store.AddUser("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// queued messages are sent before connections are closed, then sessions with in-flight messages are saved
+func TestShutdown(t *testing.T) {
+	store := sessionStore(t)
+	s, addr := newTestServer(t, []Option{WithStore(store)})
+	conn := sessionClient(t, addr)
+
+	for i := 0; i < 3; i++ {
+		s.Publish("t", fmt.Sprint(i), packet.AtLeastOnce, false)
+	}
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// client doesn't acknowledge, but everything is flushed before connection is closed
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	payloads := []string{}
+	for {
+		pkt, err := packet.ReadPacket(conn, false)
+		if err != nil {
+			break
+		}
+		if publish, ok := pkt.(*packet.PublishPacket); ok {
+			payloads = append(payloads, publish.Payload)
+		}
+	}
+	if fmt.Sprint(payloads) != "[0 1 2]" {
+		t.Errorf("flushed %v, want [0 1 2]", payloads)
+	}
+
+	messageId, inflight, err := store.FetchSession("alice")
+	if err != nil || messageId != 3 || len(inflight) != 3 || inflight["s3"] == nil || inflight["s3"].Payload != "2" {
+		t.Errorf("saved session: message id %d, in-flight %v, %v", messageId, inflight, err)
+	}
+
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Error("listener is open after shutdown")
+	}
+	if err := s.Shutdown(context.Background()); err != ErrServerClosed {
+		t.Errorf("second shutdown: got %v, want ErrServerClosed", err)
+	}
+}
+
+// client which doesn't read its queue is closed when context is done, its session is saved anyway
+func TestShutdownDeadline(t *testing.T) {
+	store := sessionStore(t)
+	s, addr := newTestServer(t, []Option{WithStore(store), WithQueueSize(4)})
+	sessionClient(t, addr)
+
+	payload := strings.Repeat("x", 1<<18)
+	for i := 0; i < 100; i++ {
+		s.Publish("t", payload, packet.AtLeastOnce, false)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	start := time.Now()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want DeadlineExceeded", err)
+	}
+	if d := time.Since(start); d > time.Second*2 {
+		t.Errorf("shutdown took %v", d)
+	}
+
+	if _, inflight, err := store.FetchSession("alice"); err != nil || len(inflight) == 0 {
+		t.Errorf("saved session: in-flight %d, %v", len(inflight), err)
+	}
+}
+
+// raw client sent CONNECT packet, it is closed at the end of test. Return connection and CONNACK.
+func rawClient(t *testing.T, addr string, connect []byte) (net.Conn, []byte) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	conn.Write(connect)
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	connack := make([]byte, 4)
+	if _, err := io.ReadFull(conn, connack); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	return conn, connack
+}
+
+// read next packet, fail test on error or timeout
+func readPacket(t *testing.T, conn net.Conn) packet.Packet {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	defer conn.SetReadDeadline(time.Time{})
+
+	pkt, err := packet.ReadPacket(conn, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkt
+}
+
+// subscribe raw client to filters with given qos, return codes of SUBACK
+func rawSubscribe(t *testing.T, conn net.Conn, qos packet.QoS, filters ...string) []packet.QoS {
+	t.Helper()
+
+	subscribe := packet.NewSubscribe()
+	subscribe.Id = 1
+	for _, filter := range filters {
+		subscribe.Topics = append(subscribe.Topics, packet.SubscribePayload{Topic: filter, QoS: qos})
+	}
+	packet.WritePacket(conn, subscribe, false)
+
+	suback, ok := readPacket(t, conn).(*packet.SubAckPacket)
+	if !ok {
+		t.Fatal("SUBACK expected")
+	}
+	return suback.ReturnCodes
+}
@@ -0,0 +1,112 @@
+package broker
+
+import (
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+// shared subscription $share/{group}/{filter}: every message matched the filter is delivered to only one
+// client of the group
+const sharePrefix = "$share/"
+
+// strategies to select client of shared subscription group
+const (
+	SharedRoundRobin = "round-robin" // clients of the group in turn
+	SharedRandom     = "random"      // random client of the group
+	SharedSticky     = "sticky"      // messages of the same publisher go to the same client while it is subscribed
+)
+
+// parseShared split shared subscription to group name and topic filter. It returns false if topic isn't
+// shared subscription or it is malformed.
+func parseShared(topic string) (string, string, bool) {
+	if !strings.HasPrefix(topic, sharePrefix) {
+		return "", "", false
+	}
+
+	group, filter, found := strings.Cut(strings.TrimPrefix(topic, sharePrefix), "/")
+	if !found || group == "" || filter == "" || strings.ContainsAny(group, "+#") {
+		return "", "", false
+	}
+
+	return group, filter, true
+}
+
+// client subscribed to shared subscription with granted qos
+type sharedMember struct {
+	client *Client
+	qos    packet.QoS
+}
+
+// state of shared subscriptions, guarded by broker lock
+type sharedGroups struct {
+	strategy string
+	next     map[string]int               // round-robin position of every shared subscription
+	sticky   map[string]map[string]string // client chosen for publisher by shared subscription
+}
+
+func newSharedGroups(strategy string) *sharedGroups {
+	return &sharedGroups{
+		strategy: strategy,
+		next:     make(map[string]int),
+		sticky:   make(map[string]map[string]string),
+	}
+}
+
+// choose client to deliver message of publisher for shared subscription. Connected clients are preferred,
+// messages to offline sessions are sent when they reconnect.
+func (s *sharedGroups) pick(topic string, publisher string, members []sharedMember) sharedMember {
+	online := []sharedMember{}
+	for _, m := range members {
+		if !m.client.Stopped() {
+			online = append(online, m)
+		}
+	}
+	if len(online) > 0 {
+		members = online
+	}
+
+	// clients are iterated in random order, keep it stable for round-robin
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].client.clientId < members[j].client.clientId
+	})
+
+	names := make([]string, len(members))
+	for i, m := range members {
+		names[i] = m.client.clientId
+	}
+	return members[s.choose(topic, publisher, names)]
+}
+
+// choose one of sorted names for message of publisher by the strategy, key identifies state of the choice.
+// It is used for clients of shared subscription and for cluster nodes having its clients.
+func (s *sharedGroups) choose(key string, publisher string, names []string) int {
+	switch s.strategy {
+	case SharedRandom:
+		return rand.IntN(len(names))
+	case SharedSticky:
+		if name, ok := s.sticky[key][publisher]; ok {
+			if i := slices.Index(names, name); i >= 0 {
+				return i
+			}
+		}
+
+		i := s.roundRobin(key, len(names))
+		if s.sticky[key] == nil {
+			s.sticky[key] = make(map[string]string)
+		}
+		s.sticky[key][publisher] = names[i]
+		return i
+	default:
+		return s.roundRobin(key, len(names))
+	}
+}
+
+func (s *sharedGroups) roundRobin(key string, n int) int {
+	i := s.next[key] % n
+	s.next[key] = i + 1
+	return i
+}
@@ -0,0 +1,102 @@
+package broker
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+// messages of topic t received by raw client before message of topic marker
+func receiveShared(t *testing.T, conn net.Conn) []string {
+	t.Helper()
+
+	var res []string
+	for {
+		p, ok := readPacket(t, conn).(*packet.PublishPacket)
+		if !ok {
+			t.Fatal("PUBLISH expected")
+		}
+		if p.Topic == "marker" {
+			return res
+		}
+		res = append(res, p.Payload)
+	}
+}
+
+// every message is delivered to one member of the group as members join and leave, retained messages aren't
+// sent to shared subscription
+func TestSharedSubscription(t *testing.T) {
+	s, addr := newTestServer(t, nil)
+	watcher := &inbox{}
+	if _, err := s.Subscribe("t", packet.AtMostOnce, watcher.handler); err != nil {
+		t.Fatal(err)
+	}
+	s.Publish("t", "retained", packet.AtMostOnce, true)
+
+	members := map[string]net.Conn{}
+	join := func(id string) {
+		conn, _ := rawClient(t, addr, rawConnect("MQTT", 4, 0x02, id))
+		if codes := rawSubscribe(t, conn, 0, "$share/g/t", "marker"); len(codes) != 2 || codes[0] != 0 {
+			t.Fatalf("SUBACK return codes %v, want [0 0]", codes)
+		}
+		members[id] = conn
+	}
+	leave := func(id string) {
+		unsubscribe := packet.NewUnSub()
+		unsubscribe.Id = 2
+		unsubscribe.Topics = []packet.SubscribePayload{{Topic: "$share/g/t"}}
+		packet.WritePacket(members[id], unsubscribe, false)
+		if _, ok := readPacket(t, members[id]).(*packet.UnSubAckPacket); !ok {
+			t.Fatal("UNSUBACK expected")
+		}
+	}
+	// publish messages, check that every one is received once and how many every member got
+	publish := func(count int, want map[string]int) {
+		t.Helper()
+		var sent []string
+		for i := 0; i < count; i++ {
+			sent = append(sent, string(rune('a'+i)))
+			s.Publish("t", sent[i], packet.AtMostOnce, false)
+		}
+		s.Publish("marker", "", packet.AtMostOnce, false)
+
+		var received []string
+		for id, conn := range members {
+			got := receiveShared(t, conn)
+			if len(got) != want[id] {
+				t.Errorf("%s received %v, want %d messages", id, got, want[id])
+			}
+			received = append(received, got...)
+		}
+		sort.Strings(received)
+		if strings.Join(received, ",") != strings.Join(sent, ",") {
+			t.Errorf("group received %v, want %v", received, sent)
+		}
+	}
+
+	join("m1")
+	join("m2")
+	publish(2, map[string]int{"m1": 1, "m2": 1})
+
+	join("m3")
+	publish(3, map[string]int{"m1": 1, "m2": 1, "m3": 1})
+
+	leave("m1")
+	publish(2, map[string]int{"m2": 1, "m3": 1})
+
+	// group without members gets nothing, message is still routed to other subscribers
+	leave("m2")
+	leave("m3")
+	watched := len(watcher.payloads())
+	s.Publish("t", "nobody", packet.AtMostOnce, false)
+	s.Publish("marker", "", packet.AtMostOnce, false)
+	for id, conn := range members {
+		if got := receiveShared(t, conn); len(got) != 0 {
+			t.Errorf("%s received %v after leaving group", id, got)
+		}
+	}
+	waitFor(t, "routed message", func() bool { return len(watcher.payloads()) == watched+1 })
+}
@@ -0,0 +1,49 @@
+package broker
+
+import (
+	"sync/atomic"
+
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+// broker counters, updated atomically from client goroutines
+type stats struct {
+	messagesReceived uint64
+	messagesSent     uint64
+	publishReceived  uint64
+	publishSent      uint64
+	bytesReceived    uint64
+	bytesSent        uint64
+	packetsReceived  [16]uint64 // by packet type
+	packetsSent      [16]uint64
+	connections      uint64 // accepted connections
+	authFailures     uint64 // connections refused by authentication
+	dropped          uint64 // messages dropped on full outbound queue
+	routed           uint64 // published messages routed to subscribers
+	deliveries       uint64 // copies of routed messages sent to subscribers
+}
+
+// count packet received from network client
+func (s *stats) received(pkt packet.Packet) {
+	atomic.AddUint64(&s.messagesReceived, 1)
+	atomic.AddUint64(&s.bytesReceived, uint64(packetSize(pkt)))
+	atomic.AddUint64(&s.packetsReceived[pkt.Type()&0x0f], 1)
+	if pkt.Type() == packet.PUBLISH {
+		atomic.AddUint64(&s.publishReceived, 1)
+	}
+}
+
+// count packet sent to network client
+func (s *stats) sent(pkt packet.Packet) {
+	atomic.AddUint64(&s.messagesSent, 1)
+	atomic.AddUint64(&s.bytesSent, uint64(packetSize(pkt)))
+	atomic.AddUint64(&s.packetsSent[pkt.Type()&0x0f], 1)
+	if pkt.Type() == packet.PUBLISH {
+		atomic.AddUint64(&s.publishSent, 1)
+	}
+}
+
+// size of packet on wire: fixed header, remaining length and packet itself
+func packetSize(pkt packet.Packet) int {
+	return 1 + len(packet.WriteLength(pkt.Length())) + pkt.Length()
+}
@@ -0,0 +1,126 @@
+package broker
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+// Version of the broker published in $SYS/broker/version, may be set on build by
+// -ldflags "-X github.com/MajaSuite/mqtt/broker.Version=..."
+var Version = "dev"
+
+// prefix of broker status topics
+const sysPrefix = "$SYS/"
+
+// check if topic is reserved for broker (starts with $)
+func isSysTopic(topic string) bool {
+	return strings.HasPrefix(topic, "$")
+}
+
+// exponential moving averages of counter rate per minute over 1, 5 and 15 minutes
+type loadAvg struct {
+	last uint64
+	avg  [3]float64
+}
+
+var loadPeriods = [3]time.Duration{time.Minute, time.Minute * 5, time.Minute * 15}
+
+func (l *loadAvg) update(value uint64, interval time.Duration) {
+	rate := float64(value-l.last) / interval.Minutes()
+	l.last = value
+
+	for i, period := range loadPeriods {
+		k := math.Exp(-interval.Seconds() / period.Seconds())
+		l.avg[i] = l.avg[i]*k + rate*(1-k)
+	}
+}
+
+// publish broker status to $SYS topics every interval. Values are retained, but only changed ones are
+// published.
+func (b *Broker) sys(interval time.Duration) {
+	started := time.Now()
+	published := make(map[string]string)
+
+	var load [4]loadAvg
+	loadNames := [4]string{"messages/received", "messages/sent", "bytes/received", "bytes/sent"}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		values := map[string]string{
+			"broker/version": "mqtt " + Version,
+			"broker/uptime":  fmt.Sprintf("%d seconds", int(time.Since(started).Seconds())),
+		}
+
+		counters := map[string]*uint64{
+			"broker/messages/received":         &b.stats.messagesReceived,
+			"broker/messages/sent":             &b.stats.messagesSent,
+			"broker/publish/messages/received": &b.stats.publishReceived,
+			"broker/publish/messages/sent":     &b.stats.publishSent,
+			"broker/bytes/received":            &b.stats.bytesReceived,
+			"broker/bytes/sent":                &b.stats.bytesSent,
+		}
+		for name, counter := range counters {
+			values[name] = strconv.FormatUint(atomic.LoadUint64(counter), 10)
+		}
+
+		for i, counter := range []*uint64{&b.stats.messagesReceived, &b.stats.messagesSent, &b.stats.bytesReceived,
+			&b.stats.bytesSent} {
+			load[i].update(atomic.LoadUint64(counter), interval)
+			for j, period := range []string{"1min", "5min", "15min"} {
+				values["broker/load/"+loadNames[i]+"/"+period] = fmt.Sprintf("%.2f", load[i].avg[j])
+			}
+		}
+
+		b.mu.Lock()
+
+		var connected, disconnected, subscriptions, inflight int
+		for _, client := range b.clients {
+			if client.handler != nil {
+				continue
+			}
+			if client.Stopped() {
+				disconnected++
+			} else {
+				connected++
+			}
+			subscriptions += len(client.subscription)
+			inflight += len(client.ack)
+		}
+
+		values["broker/clients/connected"] = strconv.Itoa(connected)
+		values["broker/clients/disconnected"] = strconv.Itoa(disconnected)
+		values["broker/clients/total"] = strconv.Itoa(connected + disconnected)
+		values["broker/subscriptions/count"] = strconv.Itoa(subscriptions)
+		values["broker/retained messages/count"] = strconv.Itoa(b.retained.count)
+		values["broker/messages/inflight"] = strconv.Itoa(inflight)
+
+		for name, value := range values {
+			if published[name] == value {
+				continue
+			}
+			published[name] = value
+
+			publish := packet.NewPublish()
+			publish.Topic = sysPrefix + name
+			publish.Payload = value
+			publish.Retain = true
+			b.route(publish)
+		}
+
+		b.mu.Unlock()
+
+		select {
+		case <-b.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package broker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+)
+
+// fields of client certificate used as username
+const (
+	IdentityCN  = "cn"  // subject common name
+	IdentitySAN = "san" // first dns name, email or uri of subject alternative names
+)
+
+// NewTLSConfig create tls config of listener with given certificate and key. When CA file is set, client
+// certificates signed by the CA are verified, with requireCert client without certificate is refused.
+func NewTLSConfig(certFile string, keyFile string, caFile string, requireCert bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("mqtt: no certificates found in " + caFile)
+		}
+
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if requireCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return config, nil
+}
+
+// username from verified client certificate, empty if connection has no such certificate
+func certIdentity(conn net.Conn, field string) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	cert := state.PeerCertificates[0]
+
+	switch field {
+	case IdentityCN:
+		return cert.Subject.CommonName
+	case IdentitySAN:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	}
+
+	return ""
+}
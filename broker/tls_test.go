@@ -0,0 +1,184 @@
+package broker
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MajaSuite/mqtt/db"
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+// certificate from template signed by parent (self-signed when parent is nil), returned with its key
+func newCert(t *testing.T, template *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	issuer, signer := template, interface{}(key)
+	if parent != nil {
+		issuer, signer = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// write certificate and key as pem files, return their paths
+func writeCert(t *testing.T, cert tls.Certificate, name string) (string, string) {
+	t.Helper()
+
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(t.TempDir(), name+".crt")
+	keyFile := filepath.Join(t.TempDir(), name+".key")
+	err1 := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	err2 := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600)
+	if err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	}
+
+	return certFile, keyFile
+}
+
+func TestCertIdentity(t *testing.T) {
+	ca := newCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	server := newCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "broker"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+	alice := newCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "alice"},
+		DNSNames:    []string{"bob.example"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+
+	caFile, _ := writeCert(t, ca, "ca")
+	certFile, keyFile := writeCert(t, server, "server")
+	config, err := NewTLSConfig(certFile, keyFile, caFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acl := NewACL([]db.ACLRule{
+		{Kind: db.ACLUser, Name: "alice", Topic: "alice/#", Access: db.AccessReadWrite},
+		{Kind: db.ACLUser, Name: "bob.example", Topic: "bob/#", Access: db.AccessReadWrite},
+		{Kind: db.ACLUser, Name: "mallory", Topic: "#", Access: db.AccessReadWrite},
+	})
+	s, _ := newTestServer(t, []Option{WithAuthorizer(acl, false)})
+
+	listen := func(field string) string {
+		l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.Serve(l, CertIdentity(field), AllowAnonymous(false))
+		return l.Addr().String()
+	}
+	cnAddr := listen(IdentityCN)
+	sanAddr := listen(IdentitySAN)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+
+	tests := []struct {
+		name     string
+		addr     string
+		cert     *tls.Certificate
+		identity string // client id and username of stateful session, empty when refused
+		code     int    // CONNACK return code
+		allowed  string // filter granted by acl
+		denied   string // filter refused by acl
+	}{
+		{"common name", cnAddr, &alice, "alice", packet.ConnectAccepted, "alice/#", "bob/#"},
+		{"alternative name", sanAddr, &alice, "bob.example", packet.ConnectAccepted, "bob/#", "alice/#"},
+		{"no certificate", cnAddr, nil, "", packet.ConnectBadUserPass, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig := &tls.Config{RootCAs: roots}
+			if tt.cert != nil {
+				tlsConfig.Certificates = []tls.Certificate{*tt.cert}
+			}
+			conn, err := tls.Dial("tcp", tt.addr, tlsConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Second * 5))
+
+			// stateful session with username and password of other user, both are ignored with certificate
+			conn.Write(rawConnect("MQTT", 4, 0xc0, "device", "mallory", "password"))
+			connack := make([]byte, 4)
+			if _, err := io.ReadFull(conn, connack); err != nil {
+				t.Fatal(err)
+			}
+			if want := []byte{0x20, 0x02, 0x00, byte(tt.code)}; !bytes.Equal(connack, want) {
+				t.Fatalf("CONNACK % x, want % x", connack, want)
+			}
+			if tt.code != packet.ConnectAccepted {
+				return
+			}
+
+			subscribe := packet.NewSubscribe()
+			subscribe.Id = 1
+			subscribe.Topics = []packet.SubscribePayload{{Topic: tt.allowed, QoS: 1}, {Topic: tt.denied, QoS: 1}}
+			packet.WritePacket(conn, subscribe, false)
+			pkt, err := packet.ReadPacket(conn, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			suback, ok := pkt.(*packet.SubAckPacket)
+			if !ok || len(suback.ReturnCodes) != 2 || suback.ReturnCodes[0] != 1 || suback.ReturnCodes[1] != 0x80 {
+				t.Fatalf("got %v, want SUBACK granted and refused", pkt)
+			}
+
+			// session is bound to identity
+			var info *ClientInfo
+			for _, c := range s.Clients() {
+				if c.ClientID == tt.identity {
+					info = &c
+				}
+			}
+			if info == nil || info.Username != tt.identity || !info.Session {
+				t.Errorf("got client %+v, want session of %s", info, tt.identity)
+			}
+		})
+	}
+}
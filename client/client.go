@@ -0,0 +1,648 @@
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+var (
+	ErrNotConnected = errors.New("mqtt: not connected")
+	ErrClosed       = errors.New("mqtt: client closed")
+	ErrTimeout      = errors.New("mqtt: timeout waiting answer from broker")
+	ErrSubscribe    = errors.New("mqtt: subscription refused")
+	ErrInflightFull = errors.New("mqtt: too many messages waiting for acknowledge")
+)
+
+// Handler receive messages matched subscription. Handlers are called one by one from separate goroutine,
+// so it is safe to publish from handler.
+type Handler func(pkt *packet.PublishPacket)
+
+type subscription struct {
+	qos     packet.QoS
+	handler Handler
+}
+
+// message sent to broker and waiting for acknowledge
+type inflight struct {
+	pkt  packet.Packet // PUBLISH, replaced by PUBREL when PUBREC is received for qos 2
+	done chan struct{}
+}
+
+// Client is mqtt 3.1.1 client
+type Client struct {
+	addr             string
+	clientId         string
+	username         string
+	password         string
+	cleanSession     bool
+	keepAlive        time.Duration
+	will             *packet.WillMessage
+	tlsConfig        *tls.Config
+	timeout          time.Duration
+	maxInflight      int // max qos 1 and 2 messages waiting for acknowledge
+	reconnect        bool
+	minDelay         time.Duration
+	maxDelay         time.Duration
+	onConnect        func(sessionPresent bool)
+	onConnectionLost func(err error)
+	debug            bool
+	log              *slog.Logger // logger with client id and broker address
+
+	mu            sync.Mutex
+	conn          net.Conn // current connection, nil if not connected
+	closed        bool
+	messageId     uint16
+	inflight      map[uint16]*inflight          // outgoing qos 1 and 2 messages
+	received      map[uint16]bool               // incoming qos 2 messages not released yet
+	waiting       map[uint16]chan packet.Packet // subscribe and unsubscribe waiting for answer
+	subscriptions map[string]subscription       // topic filter to handler
+
+	writeMu  sync.Mutex // serialize writes to connection
+	lastSent time.Time
+
+	messages chan *packet.PublishPacket // received messages to pass to handlers
+	quit     chan struct{}
+}
+
+// New create client for broker address (host:port). Client is not connected until Connect is called.
+func New(addr string, opts ...Option) *Client {
+	c := &Client{
+		addr:          addr,
+		cleanSession:  true,
+		keepAlive:     time.Second * 60,
+		timeout:       time.Second * 10,
+		maxInflight:   1000,
+		minDelay:      time.Second,
+		maxDelay:      time.Second * 30,
+		inflight:      make(map[uint16]*inflight),
+		received:      make(map[uint16]bool),
+		waiting:       make(map[uint16]chan packet.Packet),
+		subscriptions: make(map[string]subscription),
+		messages:      make(chan *packet.PublishPacket, 100),
+		quit:          make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.log = slog.With("client", c.clientId, "remote", addr)
+
+	go c.dispatch()
+
+	return c
+}
+
+// Connect to broker. In-flight messages of previous connection are sent again, subscriptions are
+// restored if broker has no session for the client.
+func (c *Client) Connect() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	if c.conn != nil {
+		c.mu.Unlock()
+		return nil
+	}
+	c.mu.Unlock()
+
+	return c.connect()
+}
+
+// Connected report if client has connection to broker
+func (c *Client) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn != nil
+}
+
+// Disconnect send DISCONNECT and close connection. Client can't be used after that.
+func (c *Client) Disconnect() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	c.closed = true
+	conn := c.conn
+	c.conn = nil
+	c.mu.Unlock()
+
+	close(c.quit)
+
+	if conn != nil {
+		err := c.write(conn, packet.NewDisconnect())
+		conn.Close()
+		return err
+	}
+
+	return nil
+}
+
+func (c *Client) connect() error {
+	var conn net.Conn
+	var err error
+
+	dialer := &net.Dialer{Timeout: c.timeout}
+	if c.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.addr, c.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	connect := packet.NewConnect()
+	connect.Version = 4
+	connect.VersionName = "MQTT"
+	connect.ClientID = c.clientId
+	connect.KeepAlive = uint16(c.keepAlive / time.Second)
+	connect.Username = c.username
+	connect.Password = c.password
+	connect.CleanSession = c.cleanSession
+	connect.Will = c.will
+
+	if err := c.write(conn, connect); err != nil {
+		conn.Close()
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(c.timeout))
+	pkt, err := packet.ReadPacket(conn, c.debug)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	connack, ok := pkt.(*packet.ConnAckPacket)
+	if !ok {
+		conn.Close()
+		return fmt.Errorf("%w: unexpected answer %s", packet.ErrConnect, pkt.Type())
+	}
+
+	if connack.ReturnCode != uint8(packet.ConnectAccepted) {
+		conn.Close()
+		return fmt.Errorf("%w: return code %d", packet.ErrConnect, connack.ReturnCode)
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		conn.Close()
+		return ErrClosed
+	}
+	c.conn = conn
+
+	// send again everything not acknowledged, keep original order
+	ids := []int{}
+	for id := range c.inflight {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+
+	resend := []packet.Packet{}
+	for _, id := range ids {
+		if publish, ok := c.inflight[uint16(id)].pkt.(*packet.PublishPacket); ok {
+			dup := *publish
+			dup.DUP = true
+			resend = append(resend, &dup)
+		} else {
+			resend = append(resend, c.inflight[uint16(id)].pkt)
+		}
+	}
+
+	// broker lost our session, subscribe again
+	var subscribe *packet.SubscribePacket
+	if !connack.Session && len(c.subscriptions) > 0 {
+		subscribe = packet.NewSubscribe()
+		subscribe.Id = c.nextId()
+		for filter, sub := range c.subscriptions {
+			subscribe.Topics = append(subscribe.Topics, packet.SubscribePayload{Topic: filter, QoS: sub.qos})
+		}
+	}
+	c.mu.Unlock()
+
+	go c.reader(conn)
+	if c.keepAlive > 0 {
+		go c.pinger(conn)
+	}
+
+	if subscribe != nil {
+		c.write(conn, subscribe)
+	}
+
+	for _, pkt := range resend {
+		c.write(conn, pkt)
+	}
+
+	if c.onConnect != nil {
+		c.onConnect(connack.Session)
+	}
+
+	return nil
+}
+
+// connection is lost, reconnect if enabled
+func (c *Client) connectionLost(conn net.Conn, err error) {
+	conn.Close()
+
+	c.mu.Lock()
+	if c.conn != conn {
+		// closed by Disconnect
+		c.mu.Unlock()
+		return
+	}
+	c.conn = nil
+	c.mu.Unlock()
+
+	c.log.Info("connection lost", "err", err)
+
+	if c.onConnectionLost != nil {
+		c.onConnectionLost(err)
+	}
+
+	if c.reconnect {
+		go c.reconnectLoop()
+	}
+}
+
+func (c *Client) reconnectLoop() {
+	delay := c.minDelay
+	for {
+		select {
+		case <-c.quit:
+			return
+		case <-time.After(delay):
+		}
+
+		err := c.connect()
+		if err == nil {
+			c.log.Info("reconnected")
+			return
+		}
+		if err == ErrClosed {
+			return
+		}
+		c.log.Warn("error reconnect", "err", err)
+
+		delay *= 2
+		if delay > c.maxDelay {
+			delay = c.maxDelay
+		}
+	}
+}
+
+func (c *Client) reader(conn net.Conn) {
+	for {
+		if c.keepAlive > 0 {
+			// broker answer ping at least once per keep alive interval
+			conn.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+		}
+
+		pkt, err := packet.ReadPacket(conn, c.debug)
+		if err != nil {
+			c.connectionLost(conn, err)
+			return
+		}
+
+		c.handle(conn, pkt)
+	}
+}
+
+// send ping when nothing was sent for half of keep alive interval
+func (c *Client) pinger(conn net.Conn) {
+	ticker := time.NewTicker(c.keepAlive / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.quit:
+			return
+		case <-ticker.C:
+		}
+
+		c.mu.Lock()
+		current := c.conn == conn
+		c.mu.Unlock()
+		if !current {
+			return
+		}
+
+		c.writeMu.Lock()
+		idle := time.Since(c.lastSent) >= c.keepAlive/2
+		c.writeMu.Unlock()
+
+		if idle {
+			c.write(conn, packet.NewPing())
+		}
+	}
+}
+
+func (c *Client) write(conn net.Conn, pkt packet.Packet) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.lastSent = time.Now()
+	return packet.WritePacket(conn, pkt, c.debug)
+}
+
+func (c *Client) handle(conn net.Conn, pkt packet.Packet) {
+	switch p := pkt.(type) {
+	case *packet.PublishPacket:
+		switch p.QoS {
+		case packet.AtMostOnce:
+			c.deliver(p)
+		case packet.AtLeastOnce:
+			c.deliver(p)
+			puback := packet.NewPubAck()
+			puback.Id = p.Id
+			c.write(conn, puback)
+		case packet.ExactlyOnce:
+			c.mu.Lock()
+			dup := c.received[p.Id]
+			c.received[p.Id] = true
+			c.mu.Unlock()
+
+			// deliver once, duplicates are only acknowledged
+			if !dup {
+				c.deliver(p)
+			}
+			pubrec := packet.NewPubRec()
+			pubrec.Id = p.Id
+			c.write(conn, pubrec)
+		}
+	case *packet.PubAckPacket:
+		c.complete(p.Id)
+	case *packet.PubRecPacket:
+		pubrel := packet.NewPubRel()
+		pubrel.Id = p.Id
+
+		c.mu.Lock()
+		if m := c.inflight[p.Id]; m != nil {
+			m.pkt = pubrel
+		}
+		c.mu.Unlock()
+
+		c.write(conn, pubrel)
+	case *packet.PubRelPacket:
+		c.mu.Lock()
+		delete(c.received, p.Id)
+		c.mu.Unlock()
+
+		pubcomp := packet.NewPubComp()
+		pubcomp.Id = p.Id
+		c.write(conn, pubcomp)
+	case *packet.PubCompPacket:
+		c.complete(p.Id)
+	case *packet.SubAckPacket:
+		c.answer(p.Id, p)
+	case *packet.UnSubAckPacket:
+		c.answer(p.Id, p)
+	case *packet.PongPacket:
+	default:
+		c.log.Warn("unexpected packet", "type", pkt.Type().String(), "packet", pkt.String())
+	}
+}
+
+// pass received message to handlers
+func (c *Client) deliver(pkt *packet.PublishPacket) {
+	select {
+	case c.messages <- pkt:
+	case <-c.quit:
+	}
+}
+
+func (c *Client) dispatch() {
+	for {
+		select {
+		case <-c.quit:
+			return
+		case pkt := <-c.messages:
+			c.mu.Lock()
+			handlers := []Handler{}
+			for filter, sub := range c.subscriptions {
+				if packet.MatchTopic(matchFilter(filter), pkt.Topic) {
+					handlers = append(handlers, sub.handler)
+				}
+			}
+			c.mu.Unlock()
+
+			for _, handler := range handlers {
+				handler(pkt)
+			}
+		}
+	}
+}
+
+// topic filter matched by messages of subscription, shared subscription "$share/{group}/{filter}" gets
+// messages of its filter
+func matchFilter(filter string) string {
+	if rest, ok := strings.CutPrefix(filter, "$share/"); ok {
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			return rest[i+1:]
+		}
+	}
+	return filter
+}
+
+// message delivered, remove it from in-flight
+func (c *Client) complete(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if m := c.inflight[id]; m != nil {
+		delete(c.inflight, id)
+		close(m.done)
+	}
+}
+
+func (c *Client) answer(id uint16, pkt packet.Packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ch := c.waiting[id]; ch != nil {
+		delete(c.waiting, id)
+		ch <- pkt
+	}
+}
+
+// next free message id, must be called with lock held
+func (c *Client) nextId() uint16 {
+	for {
+		c.messageId++
+		if c.messageId == 0 {
+			continue
+		}
+		if c.inflight[c.messageId] == nil && c.waiting[c.messageId] == nil {
+			return c.messageId
+		}
+	}
+}
+
+// Publish send message to broker. For qos 1 and 2 Publish waits until broker acknowledge the message. If
+// connection is lost, message stay in-flight and will be sent again after reconnect, even if Publish
+// returned ErrTimeout.
+func (c *Client) Publish(topic string, payload string, qos packet.QoS, retain bool) error {
+	done, err := c.PublishAsync(topic, payload, qos, retain)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-c.quit:
+		return ErrClosed
+	case <-time.After(c.timeout):
+		return ErrTimeout
+	}
+}
+
+// PublishAsync send message to broker without waiting for acknowledge, returned channel is closed when
+// broker acknowledge qos 1 or 2 message (at once for qos 0). Messages are sent in order of calls. If there
+// are too many messages waiting for acknowledge (see WithMaxInflight), ErrInflightFull is returned.
+func (c *Client) PublishAsync(topic string, payload string, qos packet.QoS, retain bool) (<-chan struct{}, error) {
+	if !qos.Valid() {
+		return nil, packet.ErrInvalidQos
+	}
+
+	publish := packet.NewPublish()
+	publish.Topic = topic
+	publish.Payload = payload
+	publish.QoS = qos
+	publish.Retain = retain
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	conn := c.conn
+	if conn == nil && (qos == packet.AtMostOnce || !c.reconnect) {
+		c.mu.Unlock()
+		return nil, ErrNotConnected
+	}
+
+	if qos == packet.AtMostOnce {
+		c.mu.Unlock()
+		if err := c.write(conn, publish); err != nil {
+			return nil, err
+		}
+		done := make(chan struct{})
+		close(done)
+		return done, nil
+	}
+
+	if len(c.inflight) >= c.maxInflight {
+		c.mu.Unlock()
+		return nil, ErrInflightFull
+	}
+
+	publish.Id = c.nextId()
+	m := &inflight{pkt: publish, done: make(chan struct{})}
+	c.inflight[publish.Id] = m
+	c.mu.Unlock()
+
+	if conn != nil {
+		if err := c.write(conn, publish); err != nil {
+			c.log.Warn("error send publish, wait for reconnect", "err", err)
+		}
+	}
+
+	return m.done, nil
+}
+
+// Subscribe to topic filter. Return qos granted by broker.
+func (c *Client) Subscribe(filter string, qos packet.QoS, handler Handler) (packet.QoS, error) {
+	if !qos.Valid() {
+		return 0, packet.ErrInvalidQos
+	}
+
+	subscribe := packet.NewSubscribe()
+	subscribe.Topics = []packet.SubscribePayload{{Topic: filter, QoS: qos}}
+
+	// handler is registered before SUBACK to receive retained messages
+	res, err := c.request(subscribe, func(id uint16) {
+		subscribe.Id = id
+		c.subscriptions[filter] = subscription{qos: qos, handler: handler}
+	})
+	if err != nil {
+		c.mu.Lock()
+		delete(c.subscriptions, filter)
+		c.mu.Unlock()
+		return 0, err
+	}
+
+	suback := res.(*packet.SubAckPacket)
+	if len(suback.ReturnCodes) == 0 || !suback.ReturnCodes[0].Valid() {
+		c.mu.Lock()
+		delete(c.subscriptions, filter)
+		c.mu.Unlock()
+		return 0, ErrSubscribe
+	}
+
+	return suback.ReturnCodes[0], nil
+}
+
+// Unsubscribe from topic filter
+func (c *Client) Unsubscribe(filter string) error {
+	unsubscribe := packet.NewUnSub()
+	unsubscribe.Topics = []packet.SubscribePayload{{Topic: filter}}
+
+	_, err := c.request(unsubscribe, func(id uint16) {
+		unsubscribe.Id = id
+		delete(c.subscriptions, filter)
+	})
+
+	return err
+}
+
+// send packet and wait for answer with the same id; prepare is called with lock held to set packet id
+func (c *Client) request(pkt packet.Packet, prepare func(id uint16)) (packet.Packet, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	conn := c.conn
+	if conn == nil {
+		c.mu.Unlock()
+		return nil, ErrNotConnected
+	}
+
+	id := c.nextId()
+	answer := make(chan packet.Packet, 1)
+	c.waiting[id] = answer
+	prepare(id)
+	c.mu.Unlock()
+
+	if err := c.write(conn, pkt); err != nil {
+		c.mu.Lock()
+		delete(c.waiting, id)
+		c.mu.Unlock()
+		return nil, err
+	}
+
+	select {
+	case res := <-answer:
+		return res, nil
+	case <-c.quit:
+		return nil, ErrClosed
+	case <-time.After(c.timeout):
+		c.mu.Lock()
+		delete(c.waiting, id)
+		c.mu.Unlock()
+		return nil, ErrTimeout
+	}
+}
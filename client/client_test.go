@@ -0,0 +1,333 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MajaSuite/mqtt/broker"
+	"github.com/MajaSuite/mqtt/client"
+	"github.com/MajaSuite/mqtt/db"
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+// start broker on random local port, it is shut down at the end of test
+func startBroker(t *testing.T, opts ...broker.Option) (*broker.Server, string) {
+	t.Helper()
+	return listenBroker(t, "127.0.0.1:0", opts...)
+}
+
+// start broker on given address, it is shut down at the end of test
+func listenBroker(t *testing.T, addr string, opts ...broker.Option) (*broker.Server, string) {
+	t.Helper()
+
+	s := broker.NewServer(append([]broker.Option{broker.WithSysInterval(0)}, opts...)...)
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+
+	return s, l.Addr().String()
+}
+
+// connected client, it is disconnected at the end of test
+func connect(t *testing.T, addr string, opts ...client.Option) *client.Client {
+	t.Helper()
+
+	c := client.New(addr, append([]client.Option{client.WithTimeout(time.Second * 5)}, opts...)...)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Disconnect() })
+
+	return c
+}
+
+// messages received by handler
+type inbox struct {
+	mu       sync.Mutex
+	messages []*packet.PublishPacket
+}
+
+func (in *inbox) handler(pkt *packet.PublishPacket) {
+	in.mu.Lock()
+	in.messages = append(in.messages, pkt)
+	in.mu.Unlock()
+}
+
+func (in *inbox) len() int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return len(in.messages)
+}
+
+func (in *inbox) payloads() []string {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	res := []string{}
+	for _, m := range in.messages {
+		res = append(res, m.Payload)
+	}
+	return res
+}
+
+// wait until cond is true or fail test after timeout
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second * 5)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestSharedSubscription(t *testing.T) {
+	_, addr := startBroker(t)
+
+	inboxes := []*inbox{{}, {}}
+	for i, in := range inboxes {
+		c := connect(t, addr, client.WithClientId(fmt.Sprintf("worker%d", i)))
+		if _, err := c.Subscribe("$share/g/jobs/#", packet.AtLeastOnce, in.handler); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pub := connect(t, addr)
+	for i := 0; i < 10; i++ {
+		if err := pub.Publish("jobs/a", fmt.Sprint(i), packet.AtLeastOnce, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor(t, "10 messages", func() bool { return inboxes[0].len()+inboxes[1].len() == 10 })
+	for i, in := range inboxes {
+		if in.len() != 5 {
+			t.Errorf("worker%d got %d messages, want 5 of round robin", i, in.len())
+		}
+	}
+}
+
+func TestConnect(t *testing.T) {
+	store := db.NewMemory()
+	if err := store.AddUser("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	_, addr := startBroker(t, broker.WithStore(store))
+
+	c := connect(t, addr, client.WithAuth("alice", "secret"))
+	if !c.Connected() {
+		t.Error("client is not connected")
+	}
+	if err := c.Disconnect(); err != nil {
+		t.Errorf("disconnect: %v", err)
+	}
+	if err := c.Connect(); err != client.ErrClosed {
+		t.Errorf("connect after disconnect: got %v, want ErrClosed", err)
+	}
+
+	c = client.New(addr, client.WithAuth("alice", "wrong"))
+	defer c.Disconnect()
+	if err := c.Connect(); !errors.Is(err, packet.ErrConnect) {
+		t.Errorf("wrong password: got %v, want ErrConnect", err)
+	}
+
+	// nobody listens on the address of closed listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	c = client.New(l.Addr().String())
+	defer c.Disconnect()
+	if err := c.Connect(); err == nil || c.Connected() {
+		t.Error("connected without broker")
+	}
+	if err := c.Publish("t", "x", packet.AtLeastOnce, false); err != client.ErrNotConnected {
+		t.Errorf("publish without connection: got %v, want ErrNotConnected", err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	s, addr := startBroker(t)
+
+	connects := make(chan bool, 10)
+	in := &inbox{}
+	c := connect(t, addr, client.WithClientId("device"), client.WithReconnect(time.Millisecond*10, time.Millisecond*50),
+		client.WithOnConnect(func(sessionPresent bool) { connects <- sessionPresent }))
+	<-connects
+	if _, err := c.Subscribe("t/#", packet.AtLeastOnce, in.handler); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Kick("device"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-connects:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for reconnect")
+	}
+
+	// broker has no session of the client, subscription is restored by client
+	waitFor(t, "subscription", func() bool {
+		for _, info := range s.Clients() {
+			if info.ClientID == "device" && len(info.Subscriptions) == 1 {
+				return true
+			}
+		}
+		return false
+	})
+	s.Publish("t/a", "after reconnect", packet.AtLeastOnce, false)
+	waitFor(t, "message", func() bool { return in.len() == 1 })
+}
+
+func TestRoundTrip(t *testing.T) {
+	_, addr := startBroker(t)
+
+	in := &inbox{}
+	sub := connect(t, addr)
+	if qos, err := sub.Subscribe("rt/#", packet.ExactlyOnce, in.handler); err != nil || qos != packet.ExactlyOnce {
+		t.Fatalf("subscribe: granted %d, %v", qos, err)
+	}
+
+	pub := connect(t, addr)
+	for _, qos := range []packet.QoS{packet.AtMostOnce, packet.AtLeastOnce, packet.ExactlyOnce} {
+		if err := pub.Publish(fmt.Sprintf("rt/%d", qos), fmt.Sprint(qos), qos, false); err != nil {
+			t.Fatalf("publish qos %d: %v", qos, err)
+		}
+		waitFor(t, fmt.Sprintf("message of qos %d", qos), func() bool { return in.len() == int(qos)+1 })
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for i, m := range in.messages {
+		if m.QoS != packet.QoS(i) || m.Topic != fmt.Sprintf("rt/%d", i) || m.Payload != fmt.Sprint(i) {
+			t.Errorf("got %s qos %d %q, want message of qos %d", m.Topic, m.QoS, m.Payload, i)
+		}
+	}
+}
+
+// messages not acknowledged by stopped broker are sent to the next one
+func TestInflightResend(t *testing.T) {
+	s, addr := startBroker(t)
+
+	c := connect(t, addr, client.WithTimeout(time.Millisecond*200),
+		client.WithReconnect(time.Millisecond*10, time.Millisecond*50))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	s.Shutdown(ctx)
+	waitFor(t, "connection lost", func() bool { return !c.Connected() })
+
+	for _, qos := range []packet.QoS{packet.AtLeastOnce, packet.ExactlyOnce} {
+		if err := c.Publish("q/t", fmt.Sprint(qos), qos, false); err != client.ErrTimeout {
+			t.Fatalf("publish qos %d without broker: got %v, want ErrTimeout", qos, err)
+		}
+	}
+
+	s, _ = listenBroker(t, addr)
+	in := &inbox{}
+	if _, err := s.Subscribe("q/#", packet.ExactlyOnce, in.handler); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "resent messages", func() bool { return in.len() == 2 })
+	if got := fmt.Sprint(in.payloads()); got != "[1 2]" {
+		t.Errorf("got %s, want [1 2]", got)
+	}
+}
+
+// messages waiting for acknowledge are limited, they are acknowledged after reconnect
+func TestInflightLimit(t *testing.T) {
+	s, addr := startBroker(t)
+
+	c := connect(t, addr, client.WithMaxInflight(2), client.WithReconnect(time.Millisecond*10, time.Millisecond*50))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	s.Shutdown(ctx)
+	waitFor(t, "connection lost", func() bool { return !c.Connected() })
+
+	var acks []<-chan struct{}
+	for i := 0; i < 2; i++ {
+		done, err := c.PublishAsync("q/t", fmt.Sprint(i), packet.AtLeastOnce, false)
+		if err != nil {
+			t.Fatalf("publish %d: %v", i, err)
+		}
+		acks = append(acks, done)
+	}
+	if _, err := c.PublishAsync("q/t", "2", packet.AtLeastOnce, false); err != client.ErrInflightFull {
+		t.Fatalf("publish beyond limit: got %v, want ErrInflightFull", err)
+	}
+
+	listenBroker(t, addr)
+	for i, done := range acks {
+		select {
+		case <-done:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("message %d is not acknowledged", i)
+		}
+	}
+	if err := c.Publish("q/t", "2", packet.AtLeastOnce, false); err != nil {
+		t.Errorf("publish after acknowledge: %v", err)
+	}
+}
+
+// messages published while client of stateful session is away are delivered on resume
+func TestSessionResume(t *testing.T) {
+	store := db.NewMemory()
+	if err := store.AddUser("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	s, addr := startBroker(t, broker.WithStore(store))
+
+	connects := make(chan bool, 10)
+	in := &inbox{}
+	c := connect(t, addr, client.WithClientId("phone"), client.WithAuth("alice", "secret"),
+		client.WithCleanSession(false), client.WithReconnect(time.Millisecond*10, time.Millisecond*50),
+		client.WithOnConnect(func(sessionPresent bool) { connects <- sessionPresent }),
+		client.WithOnConnectionLost(func(err error) {
+			// reconnect starts after callback, so message is published while client is away
+			s.Publish("news/a", "offline", packet.AtLeastOnce, false)
+		}))
+	if <-connects {
+		t.Error("session present on first connect")
+	}
+	if _, err := c.Subscribe("news/#", packet.AtLeastOnce, in.handler); err != nil {
+		t.Fatal(err)
+	}
+
+	// session is bound to username
+	if err := s.Kick("alice"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case present := <-connects:
+		if !present {
+			t.Error("session is not present on reconnect")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for reconnect")
+	}
+
+	waitFor(t, "message of session", func() bool { return in.len() == 1 })
+	if got := in.payloads()[0]; got != "offline" {
+		t.Errorf("got %q, want offline", got)
+	}
+}
@@ -0,0 +1,101 @@
+package client
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+// Option configure client
+type Option func(*Client)
+
+// WithClientId set client identifier, empty by default
+func WithClientId(id string) Option {
+	return func(c *Client) {
+		c.clientId = id
+	}
+}
+
+// WithAuth set username and password sent in CONNECT
+func WithAuth(username string, password string) Option {
+	return func(c *Client) {
+		c.username = username
+		c.password = password
+	}
+}
+
+// WithCleanSession set clean session flag (true by default). With persisted session broker keeps
+// subscriptions and in-flight messages between connections.
+func WithCleanSession(clean bool) Option {
+	return func(c *Client) {
+		c.cleanSession = clean
+	}
+}
+
+// WithKeepAlive set keep alive interval, client send ping if nothing was sent during the interval
+func WithKeepAlive(keepAlive time.Duration) Option {
+	return func(c *Client) {
+		c.keepAlive = keepAlive
+	}
+}
+
+// WithWill set will message published by broker when client unexpectedly disconnected
+func WithWill(topic string, payload string, qos packet.QoS, retain bool) Option {
+	return func(c *Client) {
+		c.will = &packet.WillMessage{Topic: topic, Payload: payload, QoS: qos, Retain: retain}
+	}
+}
+
+// WithTLS connect to broker over tls
+func WithTLS(config *tls.Config) Option {
+	return func(c *Client) {
+		c.tlsConfig = config
+	}
+}
+
+// WithTimeout set how long to wait for broker answer on connect, publish, subscribe and unsubscribe
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithMaxInflight set max number of qos 1 and 2 messages waiting for acknowledge of broker (1000 by default),
+// including messages kept to send again after reconnect. Publish fails with ErrInflightFull beyond it.
+func WithMaxInflight(n int) Option {
+	return func(c *Client) {
+		c.maxInflight = n
+	}
+}
+
+// WithReconnect enable automatic reconnect after connection is lost. Delay between attempts grows from
+// min to max.
+func WithReconnect(min time.Duration, max time.Duration) Option {
+	return func(c *Client) {
+		c.reconnect = true
+		c.minDelay = min
+		c.maxDelay = max
+	}
+}
+
+// WithOnConnect set callback called after every successful connect (including reconnects)
+func WithOnConnect(f func(sessionPresent bool)) Option {
+	return func(c *Client) {
+		c.onConnect = f
+	}
+}
+
+// WithOnConnectionLost set callback called when connection is unexpectedly lost
+func WithOnConnectionLost(f func(err error)) Option {
+	return func(c *Client) {
+		c.onConnectionLost = f
+	}
+}
+
+// WithDebug enable hex dumps of all packets
+func WithDebug(debug bool) Option {
+	return func(c *Client) {
+		c.debug = debug
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/MajaSuite/mqtt/db"
+)
+
+var accessNames = map[string]int{
+	"read":      db.AccessRead,
+	"write":     db.AccessWrite,
+	"readwrite": db.AccessReadWrite,
+}
+
+func acl(store db.Store, command string, args []string) error {
+	var rule db.ACLRule
+
+	switch command {
+	case "add", "del":
+		if len(args) < 2 {
+			usage()
+		}
+
+		rule.Kind = args[0]
+		args = args[1:]
+		switch rule.Kind {
+		case db.ACLUser, db.ACLClient:
+			rule.Name = args[0]
+			args = args[1:]
+		case db.ACLPattern:
+		default:
+			usage()
+		}
+
+		if command == "add" && len(args) != 2 || command == "del" && len(args) != 1 {
+			usage()
+		}
+		rule.Topic = args[0]
+	case "list":
+	default:
+		usage()
+	}
+
+	switch command {
+	case "add":
+		access, ok := accessNames[args[1]]
+		if !ok {
+			return fmt.Errorf("unknown access %s", args[1])
+		}
+		rule.Access = access
+
+		return store.SaveACL(rule)
+	case "del":
+		err := store.DeleteACL(rule.Kind, rule.Name, rule.Topic)
+		if errors.Is(err, db.ErrNotFound) {
+			return errors.New("rule not found")
+		}
+		return err
+	default:
+		rules, err := store.FetchACL()
+		if err != nil {
+			return err
+		}
+
+		for _, rule := range rules {
+			access := "readwrite"
+			for name, value := range accessNames {
+				if value == rule.Access {
+					access = name
+				}
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\n", rule.Kind, rule.Name, rule.Topic, access)
+		}
+		return nil
+	}
+}
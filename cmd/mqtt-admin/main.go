@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/MajaSuite/mqtt/db"
+)
+
+var (
+	dbName    = flag.String("db", "mqtt.db", "path to broker database")
+	storeKind = flag.String("store", "sqlite", "kind of broker database: sqlite or bolt")
+	cost      = flag.Int("cost", 10, "bcrypt cost of password hashes")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: mqtt-admin [-db mqtt.db] [-store sqlite] [-cost 10] <user|acl> <command> [args]
+
+user commands:
+  add <login>      add enabled user, password is read from stdin
+  del <login>      delete user
+  enable <login>   allow user to connect
+  disable <login>  deny user to connect
+  passwd <login>   change password, new password is read from stdin
+  list             list all users
+
+acl commands (send SIGHUP to broker to apply changes):
+  add user <login> <topic> <access>    allow user access to topic filter
+  add client <id> <topic> <access>     allow client id access to topic filter
+  add pattern <topic> <access>         allow any client access to topic filter
+  del user|client <name> <topic>       delete rule
+  del pattern <topic>                  delete rule
+  list                                 list all rules
+
+access is read, write or readwrite; %%u and %%c in topic are replaced by username and client id
+`)
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 2 {
+		usage()
+	}
+
+	if err := db.SetPasswordCost(*cost); err != nil {
+		log.Fatal(err)
+	}
+
+	var store db.Store
+	var err error
+	switch *storeKind {
+	case "sqlite":
+		store, err = db.OpenSQLite(*dbName)
+	case "bolt":
+		store, err = db.OpenBolt(*dbName)
+	default:
+		usage()
+	}
+	if err != nil {
+		log.Fatal("error open database: ", err)
+	}
+
+	switch args[0] {
+	case "user":
+		err = user(store, args[1], args[2:])
+	case "acl":
+		err = acl(store, args[1], args[2:])
+	default:
+		store.Close()
+		usage()
+	}
+
+	store.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
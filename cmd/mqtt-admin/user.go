@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/MajaSuite/mqtt/db"
+)
+
+func user(store db.Store, command string, args []string) error {
+	var login string
+	if command != "list" {
+		if len(args) != 1 || args[0] == "" {
+			usage()
+		}
+		login = args[0]
+		if len(login) > 64 {
+			return errors.New("login is too long, 64 characters allowed")
+		}
+	}
+
+	var err error
+	switch command {
+	case "add":
+		err = store.AddUser(login, readPassword())
+	case "del":
+		err = store.DeleteUser(login)
+	case "enable":
+		err = store.EnableUser(login, true)
+	case "disable":
+		err = store.EnableUser(login, false)
+	case "passwd":
+		err = store.SetPassword(login, readPassword())
+	case "list":
+		var users []db.User
+		if users, err = store.FetchUsers(); err == nil {
+			for _, user := range users {
+				state := "enabled"
+				if !user.Enabled {
+					state = "disabled"
+				}
+				fmt.Printf("%s\t%s\n", user.Login, state)
+			}
+		}
+	default:
+		usage()
+	}
+
+	if errors.Is(err, db.ErrNotFound) {
+		return fmt.Errorf("user %s not found", login)
+	}
+	if err != nil {
+		return fmt.Errorf("error %s user: %s", command, err)
+	}
+
+	return nil
+}
+
+// read password from the first line of stdin, so it is not visible in process list or shell history
+func readPassword() string {
+	if stat, err := os.Stdin.Stat(); err == nil && stat.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprint(os.Stderr, "password: ")
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		log.Fatal("error read password: ", err)
+	}
+
+	pass := strings.TrimRight(line, "\r\n")
+	if pass == "" {
+		log.Fatal("empty password is not allowed")
+	}
+	if len(pass) > 64 {
+		log.Fatal("password is too long, 64 characters allowed")
+	}
+
+	return pass
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/MajaSuite/mqtt/client"
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+var (
+	broker   = flag.String("broker", "localhost:1883", "broker address (host:port)")
+	clientId = flag.String("id", fmt.Sprintf("mqtt-pub-%d", os.Getpid()), "client id")
+	username = flag.String("u", "", "username")
+	password = flag.String("P", "", "password")
+	topic    = flag.String("t", "", "topic to publish to")
+	message  = flag.String("m", "", "message to publish")
+	file     = flag.String("f", "", "publish content of the file as message")
+	stdin    = flag.Bool("s", false, "publish whole stdin as message")
+	lines    = flag.Bool("l", false, "publish every line of stdin as separate message")
+	qos      = flag.Int("q", 0, "qos of the message (0, 1 or 2)")
+	retain   = flag.Bool("r", false, "retain message")
+	useTLS   = flag.Bool("tls", false, "connect over tls")
+	caFile   = flag.String("cafile", "", "path to CA certificate to verify broker (system pool if empty)")
+	cert     = flag.String("cert", "", "path to client certificate")
+	key      = flag.String("key", "", "path to client private key")
+	insecure = flag.Bool("insecure", false, "do not verify broker certificate")
+	debug    = flag.Bool("debug", false, "print debuging hex dumps")
+)
+
+func main() {
+	flag.Parse()
+
+	if *topic == "" {
+		log.Fatal("topic is required")
+	}
+	if !packet.QoS(*qos).Valid() {
+		log.Fatal(packet.ErrInvalidQos)
+	}
+
+	opts := []client.Option{
+		client.WithClientId(*clientId),
+		client.WithAuth(*username, *password),
+		client.WithDebug(*debug),
+	}
+
+	if *useTLS {
+		config, err := client.NewTLSConfig(*caFile, *cert, *key, *insecure)
+		if err != nil {
+			log.Fatal("error load tls config: ", err)
+		}
+		opts = append(opts, client.WithTLS(config))
+	}
+
+	c := client.New(*broker, opts...)
+	if err := c.Connect(); err != nil {
+		log.Fatal("error connect: ", err)
+	}
+	defer c.Disconnect()
+
+	switch {
+	case *lines:
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			publish(c, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			log.Fatal("error read stdin: ", err)
+		}
+	case *stdin:
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatal("error read stdin: ", err)
+		}
+		publish(c, string(data))
+	case *file != "":
+		data, err := os.ReadFile(*file)
+		if err != nil {
+			log.Fatal("error read file: ", err)
+		}
+		publish(c, string(data))
+	default:
+		publish(c, *message)
+	}
+}
+
+func publish(c *client.Client, payload string) {
+	if err := c.Publish(*topic, payload, packet.QoS(*qos), *retain); err != nil {
+		c.Disconnect()
+		log.Fatal("error publish: ", err)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/MajaSuite/mqtt/client"
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+// topics is repeatable -t flag
+type topics []string
+
+func (t *topics) String() string {
+	return strings.Join(*t, ",")
+}
+
+func (t *topics) Set(value string) error {
+	*t = append(*t, value)
+	return nil
+}
+
+var (
+	broker   = flag.String("broker", "localhost:1883", "broker address (host:port)")
+	clientId = flag.String("id", fmt.Sprintf("mqtt-sub-%d", os.Getpid()), "client id")
+	username = flag.String("u", "", "username")
+	password = flag.String("P", "", "password")
+	qos      = flag.Int("q", 0, "qos of subscriptions (0, 1 or 2)")
+	clean    = flag.Bool("clean", true, "clean session, with false broker keeps subscriptions and messages")
+	format   = flag.String("F", "plain", "output format: plain (payload), topic (topic and payload) or json")
+	count    = flag.Int("C", 0, "exit after receiving count messages (0 - never)")
+	useTLS   = flag.Bool("tls", false, "connect over tls")
+	caFile   = flag.String("cafile", "", "path to CA certificate to verify broker (system pool if empty)")
+	cert     = flag.String("cert", "", "path to client certificate")
+	key      = flag.String("key", "", "path to client private key")
+	insecure = flag.Bool("insecure", false, "do not verify broker certificate")
+	debug    = flag.Bool("debug", false, "print debuging hex dumps")
+	filters  topics
+)
+
+// message in json output format
+type message struct {
+	Topic   string `json:"topic"`
+	QoS     int    `json:"qos"`
+	Retain  bool   `json:"retain"`
+	Payload string `json:"payload"`
+}
+
+// printer write received messages in output format
+type printer struct {
+	w        io.Writer
+	encoder  *json.Encoder
+	format   string
+	count    int           // exit after count messages, 0 - never
+	done     chan struct{} // closed when count messages are received
+	received int
+	last     *packet.PublishPacket
+}
+
+func newPrinter(w io.Writer, format string, count int) *printer {
+	return &printer{w: w, encoder: json.NewEncoder(w), format: format, count: count, done: make(chan struct{})}
+}
+
+// handler of all subscriptions. Client calls it for every filter matched the message (-t a/# -t a/b), so
+// repeated calls with the same packet are ignored.
+func (p *printer) handle(pkt *packet.PublishPacket) {
+	if pkt == p.last || p.count > 0 && p.received >= p.count {
+		return
+	}
+	p.last = pkt
+
+	switch p.format {
+	case "plain":
+		fmt.Fprintln(p.w, pkt.Payload)
+	case "topic":
+		fmt.Fprintln(p.w, pkt.Topic, pkt.Payload)
+	case "json":
+		p.encoder.Encode(&message{Topic: pkt.Topic, QoS: pkt.QoS.Int(), Retain: pkt.Retain, Payload: pkt.Payload})
+	}
+
+	p.received++
+	if p.count > 0 && p.received == p.count {
+		close(p.done)
+	}
+}
+
+func main() {
+	flag.Var(&filters, "t", "topic filter to subscribe to (may be repeated)")
+	flag.Parse()
+
+	if len(filters) == 0 {
+		log.Fatal("at least one topic filter is required")
+	}
+	if !packet.QoS(*qos).Valid() {
+		log.Fatal(packet.ErrInvalidQos)
+	}
+	if *format != "plain" && *format != "topic" && *format != "json" {
+		log.Fatal("unknown output format ", *format)
+	}
+
+	opts := []client.Option{
+		client.WithClientId(*clientId),
+		client.WithAuth(*username, *password),
+		client.WithCleanSession(*clean),
+		client.WithReconnect(time.Second, time.Second*30),
+		client.WithDebug(*debug),
+	}
+
+	if *useTLS {
+		config, err := client.NewTLSConfig(*caFile, *cert, *key, *insecure)
+		if err != nil {
+			log.Fatal("error load tls config: ", err)
+		}
+		opts = append(opts, client.WithTLS(config))
+	}
+
+	c := client.New(*broker, opts...)
+	if err := c.Connect(); err != nil {
+		log.Fatal("error connect: ", err)
+	}
+
+	p := newPrinter(os.Stdout, *format, *count)
+	for _, filter := range filters {
+		if _, err := c.Subscribe(filter, packet.QoS(*qos), p.handle); err != nil {
+			c.Disconnect()
+			log.Fatalf("error subscribe to %s: %s", filter, err)
+		}
+	}
+
+	finish := make(chan os.Signal, 1)
+	signal.Notify(finish, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case <-finish:
+	case <-p.done:
+	}
+
+	c.Disconnect()
+}
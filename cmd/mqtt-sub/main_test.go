@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	server "github.com/MajaSuite/mqtt/broker"
+	"github.com/MajaSuite/mqtt/client"
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+func TestOverlappingFilters(t *testing.T) {
+	s := server.NewServer(server.WithSysInterval(0))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Shutdown(context.Background())
+
+	c := client.New(l.Addr().String(), client.WithTimeout(time.Second*5))
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect()
+
+	var out bytes.Buffer
+	p := newPrinter(&out, "topic", 2)
+	for _, filter := range []string{"a/#", "a/b", "+/b"} {
+		if _, err := c.Subscribe(filter, packet.AtLeastOnce, p.handle); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.Publish("a/b", "1", packet.AtLeastOnce, false)
+	s.Publish("a/c", "2", packet.AtLeastOnce, false)
+	s.Publish("a/b", "3", packet.AtLeastOnce, false)
+
+	select {
+	case <-p.done:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("timeout, printed %q", out.String())
+	}
+
+	// the last message is beyond count
+	time.Sleep(time.Millisecond * 50)
+	if got := out.String(); got != "a/b 1\na/c 2\n" {
+		t.Errorf("printed %q, want every message once", got)
+	}
+}
@@ -0,0 +1,490 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/MajaSuite/mqtt/packet"
+	bolt "go.etcd.io/bbolt"
+)
+
+var _ Store = (*Bolt)(nil)
+
+// buckets of bolt database, keys of records with several fields are joined by zero byte
+var (
+	boltUsers         = []byte("users")         // login: boltUser
+	boltACL           = []byte("acl")           // kind, name, topic: access
+	boltSubscriptions = []byte("subscriptions") // client id, topic: qos
+	boltRetained      = []byte("retained")      // topic: boltMessage
+	boltSessions      = []byte("sessions")      // client id: boltSession
+)
+
+type boltUser struct {
+	Enabled bool   `json:"enabled"`
+	Hash    string `json:"hash"`
+}
+
+type boltMessage struct {
+	Topic   string `json:"topic,omitempty"`
+	Payload []byte `json:"payload"`
+	QoS     int    `json:"qos"`
+	Retain  bool   `json:"retain,omitempty"`
+}
+
+type boltSession struct {
+	MessageId uint16                 `json:"msgid"`
+	Inflight  map[string]boltMessage `json:"inflight"`
+}
+
+// Bolt is store in embedded key-value database (bbolt), it doesn't need cgo
+type Bolt struct {
+	db *bolt.DB
+}
+
+// OpenBolt open bolt database file, it is created if it doesn't exist
+func OpenBolt(path string) (*Bolt, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltUsers, boltACL, boltSubscriptions, boltRetained, boltSessions} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Bolt{db: db}, nil
+}
+
+func (s *Bolt) Close() error {
+	if err := s.db.Close(); err != nil {
+		slog.Error("error close database", "err", err)
+		return err
+	}
+	return nil
+}
+
+func boltKey(parts ...string) []byte {
+	return []byte(strings.Join(parts, "\x00"))
+}
+
+func splitKey(key []byte) []string {
+	return strings.Split(string(key), "\x00")
+}
+
+func (s *Bolt) CheckAuth(login string, pass string) error {
+	start := time.Now()
+	var stored string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var user boltUser
+		if data := tx.Bucket(boltUsers).Get([]byte(login)); data != nil {
+			if err := json.Unmarshal(data, &user); err != nil {
+				return err
+			}
+		}
+		if user.Enabled {
+			stored = user.Hash
+		}
+		return nil
+	})
+	observe("check_auth", start)
+	if err != nil {
+		return err
+	}
+
+	upgrade, err := checkPassword(stored, pass)
+	if err != nil {
+		return err
+	}
+
+	if upgrade {
+		slog.Info("upgrade password hash", "user", login)
+		if err := s.SetPassword(login, pass); err != nil {
+			slog.Error("error upgrade password", "user", login, "err", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Bolt) AddUser(login string, pass string) error {
+	hash, err := hashPassword(pass)
+	if err != nil {
+		return err
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltUsers)
+		if b.Get([]byte(login)) != nil {
+			return ErrUserExists
+		}
+
+		data, err := json.Marshal(boltUser{Enabled: true, Hash: hash})
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(login), data)
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("saved user", "user", login)
+
+	return nil
+}
+
+func (s *Bolt) DeleteUser(login string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltUsers)
+		if b.Get([]byte(login)) == nil {
+			return ErrNotFound
+		}
+		return b.Delete([]byte(login))
+	})
+}
+
+func (s *Bolt) EnableUser(login string, enabled bool) error {
+	return s.updateUser(login, func(user *boltUser) {
+		user.Enabled = enabled
+	})
+}
+
+func (s *Bolt) SetPassword(login string, pass string) error {
+	hash, err := hashPassword(pass)
+	if err != nil {
+		return err
+	}
+
+	return s.updateUser(login, func(user *boltUser) {
+		user.Hash = hash
+	})
+}
+
+// change one user, return ErrNotFound if user doesn't exist
+func (s *Bolt) updateUser(login string, update func(user *boltUser)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltUsers)
+		data := b.Get([]byte(login))
+		if data == nil {
+			return ErrNotFound
+		}
+
+		var user boltUser
+		if err := json.Unmarshal(data, &user); err != nil {
+			return err
+		}
+		update(&user)
+
+		data, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(login), data)
+	})
+}
+
+func (s *Bolt) FetchUsers() ([]User, error) {
+	defer observe("fetch_users", time.Now())
+
+	res := []User{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUsers).ForEach(func(k, v []byte) error {
+			var user boltUser
+			if err := json.Unmarshal(v, &user); err != nil {
+				slog.Error("error fetch user", "user", string(k), "err", err)
+				return nil
+			}
+			res = append(res, User{Login: string(k), Enabled: user.Enabled})
+			return nil
+		})
+	})
+
+	return res, err
+}
+
+func (s *Bolt) SaveACL(rule ACLRule) error {
+	defer observe("save_acl", time.Now())
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltACL).Put(boltKey(rule.Kind, rule.Name, rule.Topic), []byte{byte(rule.Access)})
+	})
+	if err != nil {
+		slog.Error("error save acl", "err", err)
+		return err
+	}
+
+	slog.Info("saved acl", "kind", rule.Kind, "name", rule.Name, "topic", rule.Topic, "access", rule.Access)
+
+	return nil
+}
+
+func (s *Bolt) DeleteACL(kind string, name string, topic string) error {
+	defer observe("delete_acl", time.Now())
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltACL)
+		key := boltKey(kind, name, topic)
+		if b.Get(key) == nil {
+			return ErrNotFound
+		}
+		return b.Delete(key)
+	})
+}
+
+func (s *Bolt) FetchACL() ([]ACLRule, error) {
+	defer observe("fetch_acl", time.Now())
+
+	res := []ACLRule{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltACL).ForEach(func(k, v []byte) error {
+			parts := splitKey(k)
+			if len(parts) != 3 || len(v) != 1 {
+				slog.Error("error fetch acl", "key", string(k))
+				return nil
+			}
+			res = append(res, ACLRule{Kind: parts[0], Name: parts[1], Topic: parts[2], Access: int(v[0])})
+			return nil
+		})
+	})
+
+	return res, err
+}
+
+func (s *Bolt) SaveSubscription(id string, topic string, qos int) error {
+	defer observe("save_subscription", time.Now())
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSubscriptions).Put(boltKey(id, topic), []byte{byte(qos)})
+	})
+	if err != nil {
+		slog.Error("error save subscription data", "err", err)
+		return err
+	}
+
+	slog.Debug("saved subscription", "client", id, "topic", topic, "qos", qos)
+
+	return nil
+}
+
+func (s *Bolt) DeleteSubscription(id string, topic string) error {
+	defer observe("delete_subscription", time.Now())
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSubscriptions).Delete(boltKey(id, topic))
+	})
+	if err != nil {
+		slog.Error("error delete subscription data", "err", err)
+		return err
+	}
+
+	slog.Debug("deleted subscription", "client", id, "topic", topic)
+
+	return nil
+}
+
+func (s *Bolt) DeleteSubscriptions(id string) error {
+	defer observe("delete_subscriptions", time.Now())
+
+	prefix := boltKey(id, "")
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltSubscriptions).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("error delete subscriptions data", "err", err)
+		return err
+	}
+
+	slog.Debug("deleted subscriptions", "client", id)
+
+	return nil
+}
+
+func (s *Bolt) FetchSubscription(id string) (map[string]int, error) {
+	defer observe("fetch_subscriptions", time.Now())
+
+	res := make(map[string]int)
+	prefix := boltKey(id, "")
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltSubscriptions).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if len(v) == 1 {
+				res[string(k[len(prefix):])] = int(v[0])
+			}
+		}
+		return nil
+	})
+
+	return res, err
+}
+
+func (s *Bolt) FetchSubscriptions() ([]Subscription, error) {
+	defer observe("fetch_subscriptions", time.Now())
+
+	res := []Subscription{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSubscriptions).ForEach(func(k, v []byte) error {
+			parts := splitKey(k)
+			if len(parts) != 2 || len(v) != 1 {
+				slog.Error("error fetch subscription", "key", string(k))
+				return nil
+			}
+			res = append(res, Subscription{ID: parts[0], Topic: parts[1], QoS: int(v[0])})
+			return nil
+		})
+	})
+
+	return res, err
+}
+
+func (s *Bolt) SaveRetain(topic string, payload string, qos int) error {
+	defer observe("save_retain", time.Now())
+
+	data, err := json.Marshal(boltMessage{Payload: []byte(payload), QoS: qos})
+	if err != nil {
+		return err
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRetained).Put([]byte(topic), data)
+	})
+	if err != nil {
+		slog.Error("error save retain data", "err", err)
+		return err
+	}
+
+	slog.Debug("saved retained message", "topic", topic, "size", len(payload), "qos", qos)
+
+	return nil
+}
+
+func (s *Bolt) DeleteRetain(topic string) error {
+	defer observe("delete_retain", time.Now())
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRetained).Delete([]byte(topic))
+	})
+	if err != nil {
+		slog.Error("error delete retain data", "err", err)
+		return err
+	}
+
+	slog.Debug("deleted retained message", "topic", topic)
+
+	return nil
+}
+
+func (s *Bolt) FetchRetain() ([]*packet.PublishPacket, error) {
+	defer observe("fetch_retain", time.Now())
+
+	res := []*packet.PublishPacket{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRetained).ForEach(func(k, v []byte) error {
+			var m boltMessage
+			if err := json.Unmarshal(v, &m); err != nil {
+				slog.Error("error fetch retain", "topic", string(k), "err", err)
+				return nil
+			}
+
+			publish := packet.NewPublish()
+			publish.Retain = true
+			publish.Topic = string(k)
+			publish.QoS = packet.QoS(m.QoS)
+			publish.Payload = string(m.Payload)
+			res = append(res, publish)
+			return nil
+		})
+	})
+
+	return res, err
+}
+
+func (s *Bolt) SaveSession(id string, messageId uint16, inflight map[string]*packet.PublishPacket) error {
+	defer observe("save_session", time.Now())
+
+	session := boltSession{MessageId: messageId, Inflight: make(map[string]boltMessage)}
+	for key, publish := range inflight {
+		session.Inflight[key] = boltMessage{Topic: publish.Topic, Payload: []byte(publish.Payload),
+			QoS: publish.QoS.Int(), Retain: publish.Retain}
+	}
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSessions).Put([]byte(id), data)
+	})
+	if err != nil {
+		slog.Error("error save session data", "err", err)
+		return err
+	}
+
+	slog.Info("saved session", "client", id, "msgid", messageId, "inflight", len(inflight))
+
+	return nil
+}
+
+func (s *Bolt) FetchSession(id string) (uint16, map[string]*packet.PublishPacket, error) {
+	defer observe("fetch_session", time.Now())
+
+	var data []byte
+	s.db.View(func(tx *bolt.Tx) error {
+		// value is valid only inside transaction
+		data = bytes.Clone(tx.Bucket(boltSessions).Get([]byte(id)))
+		return nil
+	})
+	if data == nil {
+		return 0, nil, ErrNotFound
+	}
+
+	var session boltSession
+	if err := json.Unmarshal(data, &session); err != nil {
+		slog.Error("error fetch session", "err", err)
+		return 0, nil, err
+	}
+
+	res := make(map[string]*packet.PublishPacket)
+	for key, m := range session.Inflight {
+		publish := packet.NewPublish()
+		publish.Topic = m.Topic
+		publish.Payload = string(m.Payload)
+		publish.QoS = packet.QoS(m.QoS)
+		publish.Retain = m.Retain
+		res[key] = publish
+	}
+
+	return session.MessageId, res, nil
+}
+
+func (s *Bolt) DeleteSession(id string) error {
+	defer observe("delete_session", time.Now())
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSessions).Delete([]byte(id))
+	})
+	if err != nil {
+		slog.Error("error delete session data", "err", err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,341 @@
+package db
+
+import (
+	"log/slog"
+	"sort"
+	"sync"
+
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+var _ Store = (*Memory)(nil)
+
+// Memory is store keeping everything in memory, data is lost on restart. It is useful for tests and brokers
+// which don't need persistence.
+type Memory struct {
+	mu            sync.Mutex
+	users         map[string]*memoryUser
+	acl           map[ACLRule]bool // rules by kind, name, topic and access
+	subscriptions map[string]map[string]int
+	retained      map[string]*packet.PublishPacket
+	sessions      map[string]*memorySession
+}
+
+type memoryUser struct {
+	enabled bool
+	hash    string
+}
+
+type memorySession struct {
+	messageId uint16
+	inflight  map[string]*packet.PublishPacket
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		users:         make(map[string]*memoryUser),
+		acl:           make(map[ACLRule]bool),
+		subscriptions: make(map[string]map[string]int),
+		retained:      make(map[string]*packet.PublishPacket),
+		sessions:      make(map[string]*memorySession),
+	}
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+// copy of message, store never shares packets with the broker
+func memoryCopy(pkt *packet.PublishPacket) *packet.PublishPacket {
+	publish := packet.NewPublish()
+	publish.Topic = pkt.Topic
+	publish.Payload = pkt.Payload
+	publish.QoS = pkt.QoS
+	publish.Retain = pkt.Retain
+	return publish
+}
+
+func (m *Memory) CheckAuth(login string, pass string) error {
+	m.mu.Lock()
+	var stored string
+	if user := m.users[login]; user != nil && user.enabled {
+		stored = user.hash
+	}
+	m.mu.Unlock()
+
+	upgrade, err := checkPassword(stored, pass)
+	if err != nil {
+		return err
+	}
+
+	if upgrade {
+		slog.Info("upgrade password hash", "user", login)
+		if err := m.SetPassword(login, pass); err != nil {
+			slog.Error("error upgrade password", "user", login, "err", err)
+		}
+	}
+
+	return nil
+}
+
+func (m *Memory) AddUser(login string, pass string) error {
+	hash, err := hashPassword(pass)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.users[login] != nil {
+		return ErrUserExists
+	}
+	m.users[login] = &memoryUser{enabled: true, hash: hash}
+
+	return nil
+}
+
+func (m *Memory) DeleteUser(login string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.users[login] == nil {
+		return ErrNotFound
+	}
+	delete(m.users, login)
+
+	return nil
+}
+
+func (m *Memory) EnableUser(login string, enabled bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user := m.users[login]
+	if user == nil {
+		return ErrNotFound
+	}
+	user.enabled = enabled
+
+	return nil
+}
+
+func (m *Memory) SetPassword(login string, pass string) error {
+	hash, err := hashPassword(pass)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user := m.users[login]
+	if user == nil {
+		return ErrNotFound
+	}
+	user.hash = hash
+
+	return nil
+}
+
+func (m *Memory) FetchUsers() ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := []User{}
+	for login, user := range m.users {
+		res = append(res, User{Login: login, Enabled: user.enabled})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Login < res[j].Login })
+
+	return res, nil
+}
+
+func (m *Memory) SaveACL(rule ACLRule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// rule with the same kind, name and topic is replaced
+	for r := range m.acl {
+		if r.Kind == rule.Kind && r.Name == rule.Name && r.Topic == rule.Topic {
+			delete(m.acl, r)
+		}
+	}
+	m.acl[rule] = true
+
+	return nil
+}
+
+func (m *Memory) DeleteACL(kind string, name string, topic string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for r := range m.acl {
+		if r.Kind == kind && r.Name == name && r.Topic == topic {
+			delete(m.acl, r)
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (m *Memory) FetchACL() ([]ACLRule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := []ACLRule{}
+	for r := range m.acl {
+		res = append(res, r)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Kind != res[j].Kind {
+			return res[i].Kind < res[j].Kind
+		}
+		if res[i].Name != res[j].Name {
+			return res[i].Name < res[j].Name
+		}
+		return res[i].Topic < res[j].Topic
+	})
+
+	return res, nil
+}
+
+func (m *Memory) SaveSubscription(id string, topic string, qos int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.subscriptions[id] == nil {
+		m.subscriptions[id] = make(map[string]int)
+	}
+	m.subscriptions[id][topic] = qos
+
+	return nil
+}
+
+func (m *Memory) DeleteSubscription(id string, topic string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.subscriptions[id], topic)
+	if len(m.subscriptions[id]) == 0 {
+		delete(m.subscriptions, id)
+	}
+
+	return nil
+}
+
+func (m *Memory) DeleteSubscriptions(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.subscriptions, id)
+
+	return nil
+}
+
+func (m *Memory) FetchSubscription(id string) (map[string]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := make(map[string]int)
+	for topic, qos := range m.subscriptions[id] {
+		res[topic] = qos
+	}
+
+	return res, nil
+}
+
+func (m *Memory) FetchSubscriptions() ([]Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := []Subscription{}
+	for id, topics := range m.subscriptions {
+		for topic, qos := range topics {
+			res = append(res, Subscription{ID: id, Topic: topic, QoS: qos})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].ID != res[j].ID {
+			return res[i].ID < res[j].ID
+		}
+		return res[i].Topic < res[j].Topic
+	})
+
+	return res, nil
+}
+
+func (m *Memory) SaveRetain(topic string, payload string, qos int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	publish := packet.NewPublish()
+	publish.Topic = topic
+	publish.Payload = payload
+	publish.QoS = packet.QoS(qos)
+	publish.Retain = true
+	m.retained[topic] = publish
+
+	return nil
+}
+
+func (m *Memory) DeleteRetain(topic string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.retained, topic)
+
+	return nil
+}
+
+func (m *Memory) FetchRetain() ([]*packet.PublishPacket, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := []*packet.PublishPacket{}
+	for _, publish := range m.retained {
+		res = append(res, memoryCopy(publish))
+	}
+
+	return res, nil
+}
+
+func (m *Memory) SaveSession(id string, messageId uint16, inflight map[string]*packet.PublishPacket) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session := &memorySession{messageId: messageId, inflight: make(map[string]*packet.PublishPacket)}
+	for key, publish := range inflight {
+		session.inflight[key] = memoryCopy(publish)
+	}
+	m.sessions[id] = session
+
+	return nil
+}
+
+func (m *Memory) FetchSession(id string) (uint16, map[string]*packet.PublishPacket, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session := m.sessions[id]
+	if session == nil {
+		return 0, nil, ErrNotFound
+	}
+
+	res := make(map[string]*packet.PublishPacket)
+	for key, publish := range session.inflight {
+		res[key] = memoryCopy(publish)
+	}
+
+	return session.messageId, res, nil
+}
+
+func (m *Memory) DeleteSession(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, id)
+
+	return nil
+}
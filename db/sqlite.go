@@ -2,13 +2,16 @@ package db
 
 import (
 	"database/sql"
-	"errors"
+	"log/slog"
+	"time"
+
 	"github.com/MajaSuite/mqtt/packet"
 	_ "github.com/mattn/go-sqlite3"
-	"log"
 )
 
 const (
+	// users allowed to connect: ena - user is enabled, login - username in CONNECT, pass - bcrypt hash of
+	// password (plaintext passwords of old databases are replaced by hash on first successful login)
 	createAuth = `CREATE TABLE IF NOT EXISTS auth (
 		ena bool default false,
 		login varchar2(64) not null,
@@ -24,93 +27,129 @@ const (
 		payload varchar2(128),
 		qos number,
 		UNIQUE(topic));`
-
-	insertRetain       = `INSERT OR REPLACE INTO retain (topic, payload, qos) VALUES (?, ?, ?);`
-	deleteRetain       = `DELETE FROM retain WHERE topic = ? AND qos = ?;`
-	fetchRetain        = `SELECT topic, payload, qos FROM retain;`
-	insertSubscr       = `INSERT INTO subscr (id, topic, qos) VALUES (?, ?, ?);`
-	deleteSubscription = `DELETE FROM subscr WHERE id = ? AND topic = ?;`
-	fetchSubscription  = `SELECT topic, qos FROM subscr WHERE id = ?;`
-	auth               = `SELECT login FROM auth WHERE ena = true AND login = ? AND pass = ?;`
+	createSession = `CREATE TABLE IF NOT EXISTS session (
+		id varchar2(64) not null,
+		msgid number,
+		UNIQUE(id));`
+	createInflight = `CREATE TABLE IF NOT EXISTS inflight (
+		id varchar2(64) not null,
+		ack varchar2(8) not null,
+		topic varchar2(128),
+		payload varchar2(128),
+		qos number,
+		retain bool default false,
+		UNIQUE(id, ack));`
+	// topic access rules: kind - user, client or pattern (any client), name - username or client id (empty
+	// for pattern), topic - topic filter where %u and %c are replaced by username and client id,
+	// access - 1 read, 2 write, 3 read and write
+	createACL = `CREATE TABLE IF NOT EXISTS acl (
+		kind varchar2(8) not null,
+		name varchar2(64) default '',
+		topic varchar2(128) not null,
+		access number not null,
+		UNIQUE(kind, name, topic));`
+
+	insertRetain        = `INSERT OR REPLACE INTO retain (topic, payload, qos) VALUES (?, ?, ?);`
+	deleteRetain        = `DELETE FROM retain WHERE topic = ?;`
+	fetchRetain         = `SELECT topic, payload, qos FROM retain;`
+	insertSubscr        = `INSERT OR REPLACE INTO subscr (id, topic, qos) VALUES (?, ?, ?);`
+	deleteSubscription  = `DELETE FROM subscr WHERE id = ? AND topic = ?;`
+	fetchSubscription   = `SELECT topic, qos FROM subscr WHERE id = ?;`
+	fetchSubscriptions  = `SELECT id, topic, qos FROM subscr ORDER BY id, topic;`
+	deleteSubscriptions = `DELETE FROM subscr WHERE id = ?;`
+	insertSession       = `INSERT OR REPLACE INTO session (id, msgid) VALUES (?, ?);`
+	deleteSession       = `DELETE FROM session WHERE id = ?;`
+	fetchSession        = `SELECT msgid FROM session WHERE id = ?;`
+	insertInflight      = `INSERT INTO inflight (id, ack, topic, payload, qos, retain) VALUES (?, ?, ?, ?, ?, ?);`
+	deleteInflight      = `DELETE FROM inflight WHERE id = ?;`
+	fetchInflight       = `SELECT ack, topic, payload, qos, retain FROM inflight WHERE id = ?;`
+	insertUser          = `INSERT INTO auth (ena, login, pass) VALUES (?, ?, ?);`
+	deleteUser          = `DELETE FROM auth WHERE login = ?;`
+	enableUser          = `UPDATE auth SET ena = ? WHERE login = ?;`
+	updatePassword      = `UPDATE auth SET pass = ? WHERE login = ?;`
+	fetchUsers          = `SELECT login, ena FROM auth ORDER BY login;`
+	insertACL           = `INSERT OR REPLACE INTO acl (kind, name, topic, access) VALUES (?, ?, ?, ?);`
+	deleteACL           = `DELETE FROM acl WHERE kind = ? AND name = ? AND topic = ?;`
+	fetchACL            = `SELECT kind, name, topic, access FROM acl ORDER BY kind, name, topic;`
+	auth                = `SELECT pass FROM auth WHERE ena = true AND login = ?;`
 )
 
-var (
-	ErrNotFound = errors.New("empty result set")
-	db          *sql.DB
-)
+var _ Store = (*SQLite)(nil)
 
-func Open(dbName string) error {
-	var err error
+// SQLite is store in sqlite database
+type SQLite struct {
+	db *sql.DB
+}
 
-	db, err = sql.Open("sqlite3", dbName)
+// OpenSQLite open sqlite database, tables are created if they don't exist
+func OpenSQLite(dbName string) (*SQLite, error) {
+	db, err := sql.Open("sqlite3", dbName)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// create database
-	auth, err := db.Prepare(createAuth)
-	if err != nil {
-		panic(err)
+	for _, table := range []string{createAuth, createRetain, createSubs, createSession, createInflight, createACL} {
+		if _, err := db.Exec(table); err != nil {
+			db.Close()
+			return nil, err
+		}
 	}
-	auth.Exec()
 
-	ret, err := db.Prepare(createRetain)
-	if err != nil {
-		panic(err)
-	}
-	ret.Exec()
+	return &SQLite{db: db}, nil
+}
 
-	subs, err := db.Prepare(createSubs)
-	if err != nil {
-		panic(err)
+func (s *SQLite) Close() error {
+	if err := s.db.Close(); err != nil {
+		slog.Error("error close database", "err", err)
+		return err
 	}
-	subs.Exec()
-
 	return nil
 }
 
-func Close() {
-	db.Close()
-}
+func (s *SQLite) SaveRetain(topic string, payload string, qos int) error {
+	defer observe("save_retain", time.Now())
 
-func SaveRetain(topic string, payload string, qos int) error {
-	statement, err := db.Prepare(insertRetain)
+	statement, err := s.db.Prepare(insertRetain)
 	if err != nil {
-		log.Printf("error prepare retain: %s", err)
+		slog.Error("error prepare retain", "err", err)
 		return err
 	}
 
 	if _, err = statement.Exec(topic, payload, qos); err != nil {
-		log.Printf("error save retain data: %s", err)
+		slog.Error("error save retain data", "err", err)
 		return err
 	}
 
-	log.Printf("saved retain message {topic: %s, payload: %s, qos: %d}", topic, payload, qos)
+	slog.Debug("saved retained message", "topic", topic, "size", len(payload), "qos", qos)
 
 	return nil
 }
 
-func DeleteRetain(topic string, qos int) error {
-	statement, err := db.Prepare(deleteRetain)
+func (s *SQLite) DeleteRetain(topic string) error {
+	defer observe("delete_retain", time.Now())
+
+	statement, err := s.db.Prepare(deleteRetain)
 	if err != nil {
-		log.Printf("error delete retain: %s", err)
+		slog.Error("error delete retain", "err", err)
 		return err
 	}
 
-	if _, err = statement.Exec(topic, qos); err != nil {
-		log.Printf("error delete retain data: %s", err)
+	if _, err = statement.Exec(topic); err != nil {
+		slog.Error("error delete retain data", "err", err)
 		return err
 	}
 
-	log.Printf("delete retain for topic %s qos %d", topic, qos)
+	slog.Debug("deleted retained message", "topic", topic)
 
 	return nil
 }
 
-func FetchRetain() ([]*packet.PublishPacket, error) {
-	query, err := db.Query(fetchRetain)
+func (s *SQLite) FetchRetain() ([]*packet.PublishPacket, error) {
+	defer observe("fetch_retain", time.Now())
+
+	query, err := s.db.Query(fetchRetain)
 	if err != nil {
-		log.Printf("error prepare fetch retain: %s", err)
+		slog.Error("error prepare fetch retain", "err", err)
 		return nil, err
 	}
 	defer query.Close()
@@ -122,7 +161,8 @@ func FetchRetain() ([]*packet.PublishPacket, error) {
 		var qos int
 
 		if err := query.Scan(&topic, &payload, &qos); err != nil {
-			log.Printf("error fetch retain: %s", err)
+			slog.Error("error fetch retain", "err", err)
+			continue
 		}
 
 		publish := packet.NewPublish()
@@ -140,44 +180,50 @@ func FetchRetain() ([]*packet.PublishPacket, error) {
 	return res, nil
 }
 
-func SaveSubscription(id string, topic string, qos int) error {
-	statement, err := db.Prepare(insertSubscr)
+func (s *SQLite) SaveSubscription(id string, topic string, qos int) error {
+	defer observe("save_subscription", time.Now())
+
+	statement, err := s.db.Prepare(insertSubscr)
 	if err != nil {
-		log.Printf("error prepare subscription: %s", err)
+		slog.Error("error prepare subscription", "err", err)
 		return err
 	}
 
 	if _, err = statement.Exec(id, topic, qos); err != nil {
-		log.Printf("error save subscription data: %s", err)
+		slog.Error("error save subscription data", "err", err)
 		return err
 	}
 
-	log.Printf("saved subscription {id: %s, topic: %s, qos: %d}", id, topic, qos)
+	slog.Debug("saved subscription", "client", id, "topic", topic, "qos", qos)
 
 	return nil
 }
 
-func DeleteSubscription(id string, topic string) error {
-	statement, err := db.Prepare(deleteSubscription)
+func (s *SQLite) DeleteSubscription(id string, topic string) error {
+	defer observe("delete_subscription", time.Now())
+
+	statement, err := s.db.Prepare(deleteSubscription)
 	if err != nil {
-		log.Printf("error delete subscription: %s", err)
+		slog.Error("error delete subscription", "err", err)
 		return err
 	}
 
 	if _, err = statement.Exec(id, topic); err != nil {
-		log.Printf("error delete subscription data: %s", err)
+		slog.Error("error delete subscription data", "err", err)
 		return err
 	}
 
-	log.Printf("delete subscription for client-id %s", id)
+	slog.Debug("deleted subscription", "client", id, "topic", topic)
 
 	return nil
 }
 
-func FetchSubcription(id string) (map[string]int, error) {
-	query, err := db.Query(fetchSubscription, id)
+func (s *SQLite) FetchSubscription(id string) (map[string]int, error) {
+	defer observe("fetch_subscriptions", time.Now())
+
+	query, err := s.db.Query(fetchSubscription, id)
 	if err != nil {
-		log.Printf("error prepare fetch subscription: %s", err)
+		slog.Error("error prepare fetch subscription", "err", err)
 		return nil, err
 	}
 	defer query.Close()
@@ -188,7 +234,7 @@ func FetchSubcription(id string) (map[string]int, error) {
 		var topic string
 		var qos int
 		if err := query.Scan(&topic, &qos); err != nil {
-			log.Printf("error fetch subscription: %s", err)
+			slog.Error("error fetch subscription", "err", err)
 		}
 		res[topic] = qos
 	}
@@ -200,16 +246,303 @@ func FetchSubcription(id string) (map[string]int, error) {
 	return res, nil
 }
 
-// TODO use bcrypt to store passwords
-func CheckAuth(login string, pass string) error {
-	var res string
-	if err := db.QueryRow(auth, login, pass).Scan(&res); err != nil {
+// FetchSubscriptions return persisted subscriptions of all clients
+func (s *SQLite) FetchSubscriptions() ([]Subscription, error) {
+	defer observe("fetch_subscriptions", time.Now())
+
+	query, err := s.db.Query(fetchSubscriptions)
+	if err != nil {
+		slog.Error("error prepare fetch subscriptions", "err", err)
+		return nil, err
+	}
+	defer query.Close()
+
+	res := []Subscription{}
+	for query.Next() {
+		var s Subscription
+		if err := query.Scan(&s.ID, &s.Topic, &s.QoS); err != nil {
+			slog.Error("error fetch subscription", "err", err)
+			continue
+		}
+		res = append(res, s)
+	}
+
+	return res, query.Err()
+}
+
+func (s *SQLite) DeleteSubscriptions(id string) error {
+	defer observe("delete_subscriptions", time.Now())
+
+	if _, err := s.db.Exec(deleteSubscriptions, id); err != nil {
+		slog.Error("error delete subscriptions data", "err", err)
+		return err
+	}
+
+	slog.Debug("deleted subscriptions", "client", id)
+
+	return nil
+}
+
+// SaveSession replace persisted session state: last message id and in-flight messages keyed by
+// broker acknowledge key
+func (s *SQLite) SaveSession(id string, messageId uint16, inflight map[string]*packet.PublishPacket) error {
+	defer observe("save_session", time.Now())
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		slog.Error("error begin save session", "err", err)
+		return err
+	}
+
+	if _, err = tx.Exec(insertSession, id, messageId); err != nil {
+		slog.Error("error save session data", "err", err)
+		tx.Rollback()
+		return err
+	}
+
+	if _, err = tx.Exec(deleteInflight, id); err != nil {
+		slog.Error("error delete inflight data", "err", err)
+		tx.Rollback()
+		return err
+	}
+
+	for key, publish := range inflight {
+		if _, err = tx.Exec(insertInflight, id, key, publish.Topic, publish.Payload, publish.QoS.Int(), publish.Retain); err != nil {
+			slog.Error("error save inflight data", "err", err)
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		slog.Error("error commit session", "err", err)
+		return err
+	}
+
+	slog.Info("saved session", "client", id, "msgid", messageId, "inflight", len(inflight))
+
+	return nil
+}
+
+// FetchSession return persisted session state saved by SaveSession
+func (s *SQLite) FetchSession(id string) (uint16, map[string]*packet.PublishPacket, error) {
+	defer observe("fetch_session", time.Now())
+
+	var messageId uint16
+	if err := s.db.QueryRow(fetchSession, id).Scan(&messageId); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil, ErrNotFound
+		}
+		slog.Error("error fetch session", "err", err)
+		return 0, nil, err
+	}
+
+	query, err := s.db.Query(fetchInflight, id)
+	if err != nil {
+		slog.Error("error prepare fetch inflight", "err", err)
+		return 0, nil, err
+	}
+	defer query.Close()
+
+	res := make(map[string]*packet.PublishPacket)
+
+	for query.Next() {
+		var key, topic, payload string
+		var qos int
+		var retain bool
+		if err := query.Scan(&key, &topic, &payload, &qos, &retain); err != nil {
+			slog.Error("error fetch inflight", "err", err)
+			continue
+		}
+
+		publish := packet.NewPublish()
+		publish.Topic = topic
+		publish.Payload = payload
+		publish.QoS = packet.QoS(qos)
+		publish.Retain = retain
+		res[key] = publish
+	}
+
+	if query.Err() != nil {
+		return 0, nil, ErrNotFound
+	}
+
+	return messageId, res, nil
+}
+
+// DeleteSession remove persisted session state, subscriptions are kept
+func (s *SQLite) DeleteSession(id string) error {
+	defer observe("delete_session", time.Now())
+
+	if _, err := s.db.Exec(deleteSession, id); err != nil {
+		slog.Error("error delete session data", "err", err)
 		return err
 	}
 
-	if res == login {
-		return nil
+	if _, err := s.db.Exec(deleteInflight, id); err != nil {
+		slog.Error("error delete inflight data", "err", err)
+		return err
 	}
 
-	return ErrNotFound
+	return nil
+}
+
+func (s *SQLite) CheckAuth(login string, pass string) error {
+	var stored string
+	start := time.Now()
+	err := s.db.QueryRow(auth, login).Scan(&stored)
+	observe("check_auth", start)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	upgrade, err := checkPassword(stored, pass)
+	if err != nil {
+		return err
+	}
+
+	if upgrade {
+		slog.Info("upgrade password hash", "user", login)
+		if err := s.SetPassword(login, pass); err != nil {
+			slog.Error("error upgrade password", "user", login, "err", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *SQLite) AddUser(login string, pass string) error {
+	hash, err := hashPassword(pass)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.db.Exec(insertUser, true, login, hash); err != nil {
+		if isUniqueError(err) {
+			return ErrUserExists
+		}
+		slog.Error("error save user", "err", err)
+		return err
+	}
+
+	slog.Info("saved user", "user", login)
+
+	return nil
+}
+
+func (s *SQLite) DeleteUser(login string) error {
+	return s.updateUser(deleteUser, login)
+}
+
+func (s *SQLite) EnableUser(login string, enabled bool) error {
+	return s.updateUser(enableUser, enabled, login)
+}
+
+func (s *SQLite) SetPassword(login string, pass string) error {
+	hash, err := hashPassword(pass)
+	if err != nil {
+		return err
+	}
+
+	return s.updateUser(updatePassword, hash, login)
+}
+
+// execute statement changing one user, return ErrNotFound if user doesn't exist
+func (s *SQLite) updateUser(query string, args ...interface{}) error {
+	res, err := s.db.Exec(query, args...)
+	if err != nil {
+		slog.Error("error update user", "err", err)
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *SQLite) FetchUsers() ([]User, error) {
+	defer observe("fetch_users", time.Now())
+
+	query, err := s.db.Query(fetchUsers)
+	if err != nil {
+		slog.Error("error prepare fetch users", "err", err)
+		return nil, err
+	}
+	defer query.Close()
+
+	res := []User{}
+
+	for query.Next() {
+		var user User
+		if err := query.Scan(&user.Login, &user.Enabled); err != nil {
+			slog.Error("error fetch user", "err", err)
+			continue
+		}
+		res = append(res, user)
+	}
+
+	if query.Err() != nil {
+		return nil, ErrNotFound
+	}
+
+	return res, nil
+}
+
+func (s *SQLite) SaveACL(rule ACLRule) error {
+	defer observe("save_acl", time.Now())
+
+	if _, err := s.db.Exec(insertACL, rule.Kind, rule.Name, rule.Topic, rule.Access); err != nil {
+		slog.Error("error save acl", "err", err)
+		return err
+	}
+
+	slog.Info("saved acl", "kind", rule.Kind, "name", rule.Name, "topic", rule.Topic, "access", rule.Access)
+
+	return nil
+}
+
+func (s *SQLite) DeleteACL(kind string, name string, topic string) error {
+	defer observe("delete_acl", time.Now())
+
+	res, err := s.db.Exec(deleteACL, kind, name, topic)
+	if err != nil {
+		slog.Error("error delete acl", "err", err)
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *SQLite) FetchACL() ([]ACLRule, error) {
+	defer observe("fetch_acl", time.Now())
+
+	query, err := s.db.Query(fetchACL)
+	if err != nil {
+		slog.Error("error prepare fetch acl", "err", err)
+		return nil, err
+	}
+	defer query.Close()
+
+	res := []ACLRule{}
+
+	for query.Next() {
+		var rule ACLRule
+		if err := query.Scan(&rule.Kind, &rule.Name, &rule.Topic, &rule.Access); err != nil {
+			slog.Error("error fetch acl", "err", err)
+			continue
+		}
+		res = append(res, rule)
+	}
+
+	if query.Err() != nil {
+		return nil, ErrNotFound
+	}
+
+	return res, nil
 }
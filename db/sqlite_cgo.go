@@ -0,0 +1,10 @@
+//go:build cgo
+
+package db
+
+import "github.com/mattn/go-sqlite3"
+
+func isUniqueError(err error) bool {
+	sqliteErr, ok := err.(sqlite3.Error)
+	return ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
@@ -0,0 +1,8 @@
+//go:build !cgo
+
+package db
+
+// sqlite driver doesn't work without cgo, database can't be opened at all
+func isUniqueError(err error) bool {
+	return false
+}
@@ -0,0 +1,44 @@
+package db
+
+import (
+	"sync"
+	"time"
+)
+
+// OpStats is number and total duration of database operations of one kind
+type OpStats struct {
+	Count    uint64
+	Duration time.Duration
+}
+
+var (
+	statsMu sync.Mutex
+	opStats = make(map[string]*OpStats)
+)
+
+// record duration of operation started at start
+func observe(op string, start time.Time) {
+	d := time.Since(start)
+
+	statsMu.Lock()
+	s := opStats[op]
+	if s == nil {
+		s = &OpStats{}
+		opStats[op] = s
+	}
+	s.Count++
+	s.Duration += d
+	statsMu.Unlock()
+}
+
+// Stats return statistics of database operations by operation name
+func Stats() map[string]OpStats {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	res := make(map[string]OpStats, len(opStats))
+	for op, s := range opStats {
+		res[op] = *s
+	}
+	return res
+}
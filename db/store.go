@@ -0,0 +1,156 @@
+package db
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/MajaSuite/mqtt/packet"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrNotFound    = errors.New("empty result set")
+	ErrInvalidCost = errors.New("invalid bcrypt cost")
+	ErrUserExists  = errors.New("user already exists")
+	passwordCost   = bcrypt.DefaultCost
+
+	// hash compared when user is not found, so response time doesn't reveal existing users. It has the same
+	// cost as real hashes, it is made on first use and again when cost is changed.
+	dummyMu   sync.Mutex
+	dummyHash []byte
+)
+
+const (
+	ACLUser    = "user"
+	ACLClient  = "client"
+	ACLPattern = "pattern"
+
+	AccessRead      = 1
+	AccessWrite     = 2
+	AccessReadWrite = AccessRead | AccessWrite
+)
+
+// ACLRule is topic access rule: kind - user, client or pattern (any client), name - username or client id
+// (empty for pattern), topic - topic filter where %u and %c are replaced by username and client id
+type ACLRule struct {
+	Kind   string
+	Name   string
+	Topic  string
+	Access int
+}
+
+// Subscription is persisted subscription of stateful session
+type Subscription struct {
+	ID    string
+	Topic string
+	QoS   int
+}
+
+// User is user allowed to connect
+type User struct {
+	Login   string
+	Enabled bool
+}
+
+// Store keeps broker data between restarts. Methods are safe for concurrent use. Operations changing one
+// user or acl rule return ErrNotFound when it doesn't exist, FetchSession returns ErrNotFound when there is
+// no saved session.
+type Store interface {
+	// users, passwords are kept as bcrypt hashes
+	CheckAuth(login string, pass string) error
+	AddUser(login string, pass string) error
+	DeleteUser(login string) error
+	EnableUser(login string, enabled bool) error
+	SetPassword(login string, pass string) error
+	FetchUsers() ([]User, error)
+
+	// topic access rules
+	SaveACL(rule ACLRule) error
+	DeleteACL(kind string, name string, topic string) error
+	FetchACL() ([]ACLRule, error)
+
+	// subscriptions of stateful sessions
+	SaveSubscription(id string, topic string, qos int) error
+	DeleteSubscription(id string, topic string) error
+	DeleteSubscriptions(id string) error
+	FetchSubscription(id string) (map[string]int, error)
+	FetchSubscriptions() ([]Subscription, error)
+
+	// retained messages
+	SaveRetain(topic string, payload string, qos int) error
+	DeleteRetain(topic string) error
+	FetchRetain() ([]*packet.PublishPacket, error)
+
+	// state of stateful session saved on shutdown: last message id and in-flight messages keyed by broker
+	// acknowledge key
+	SaveSession(id string, messageId uint16, inflight map[string]*packet.PublishPacket) error
+	FetchSession(id string) (uint16, map[string]*packet.PublishPacket, error)
+	DeleteSession(id string) error
+
+	Close() error
+}
+
+// SetPasswordCost set bcrypt cost for new password hashes. Hashes with other cost are upgraded on next
+// successful login.
+func SetPasswordCost(cost int) error {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return ErrInvalidCost
+	}
+	dummyMu.Lock()
+	passwordCost = cost
+	dummyHash = nil
+	dummyMu.Unlock()
+	return nil
+}
+
+// DummyPasswordHash return hash with current cost to compare password of unknown user with, so response
+// time doesn't reveal existing users.
+func DummyPasswordHash() []byte {
+	dummyMu.Lock()
+	defer dummyMu.Unlock()
+
+	if dummyHash == nil {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), passwordCost)
+	}
+	return dummyHash
+}
+
+func hashPassword(pass string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), passwordCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func isHash(pass string) bool {
+	return strings.HasPrefix(pass, "$2a$") || strings.HasPrefix(pass, "$2b$") || strings.HasPrefix(pass, "$2y$")
+}
+
+// check password against stored hash, upgrade is true when hash should be replaced: it is plaintext
+// password of old database or its cost differs from current one. Empty stored means user is not found.
+func checkPassword(stored string, pass string) (bool, error) {
+	if stored == "" {
+		bcrypt.CompareHashAndPassword(DummyPasswordHash(), []byte(pass))
+		return false, ErrNotFound
+	}
+
+	if !isHash(stored) {
+		// digests of the same size, so comparison time doesn't reveal password length
+		storedSum, passSum := sha256.Sum256([]byte(stored)), sha256.Sum256([]byte(pass))
+		if subtle.ConstantTimeCompare(storedSum[:], passSum[:]) != 1 {
+			return false, ErrNotFound
+		}
+		return true, nil
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(stored), []byte(pass)); err != nil {
+		return false, ErrNotFound
+	}
+
+	cost, err := bcrypt.Cost([]byte(stored))
+	return err == nil && cost != passwordCost, nil
+}
@@ -0,0 +1,255 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/MajaSuite/mqtt/packet"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestDummyHashCost(t *testing.T) {
+	defer SetPasswordCost(bcrypt.DefaultCost)
+
+	for _, cost := range []int{bcrypt.MinCost, bcrypt.MinCost + 1} {
+		if err := SetPasswordCost(cost); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := bcrypt.Cost(DummyPasswordHash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != cost {
+			t.Errorf("dummy hash cost %d, want %d", got, cost)
+		}
+	}
+
+	if err := SetPasswordCost(bcrypt.MaxCost + 1); err != ErrInvalidCost {
+		t.Errorf("got %v, want ErrInvalidCost", err)
+	}
+}
+
+func TestStores(t *testing.T) {
+	defer SetPasswordCost(bcrypt.DefaultCost)
+	SetPasswordCost(bcrypt.MinCost)
+
+	t.Run("memory", func(t *testing.T) {
+		testStore(t, NewMemory())
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		s, err := OpenSQLite(filepath.Join(t.TempDir(), "mqtt.db"))
+		if err != nil {
+			t.Skip("sqlite is not available:", err)
+		}
+		testStore(t, s)
+	})
+	t.Run("bolt", func(t *testing.T) {
+		s, err := OpenBolt(filepath.Join(t.TempDir(), "mqtt.bolt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		testStore(t, s)
+	})
+}
+
+// bcrypt hash of user as it is stored
+func storedHash(t *testing.T, s Store, login string) string {
+	t.Helper()
+
+	var hash string
+	var err error
+	switch s := s.(type) {
+	case *Memory:
+		s.mu.Lock()
+		hash = s.users[login].hash
+		s.mu.Unlock()
+	case *SQLite:
+		err = s.db.QueryRow(`SELECT pass FROM auth WHERE login = ?;`, login).Scan(&hash)
+	case *Bolt:
+		var user boltUser
+		err = s.db.View(func(tx *bolt.Tx) error {
+			return json.Unmarshal(tx.Bucket(boltUsers).Get([]byte(login)), &user)
+		})
+		hash = user.Hash
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+// user with plaintext password as it is kept in old databases
+func seedPlaintext(t *testing.T, s Store, login string, pass string) {
+	t.Helper()
+
+	var err error
+	switch s := s.(type) {
+	case *Memory:
+		s.mu.Lock()
+		s.users[login] = &memoryUser{enabled: true, hash: pass}
+		s.mu.Unlock()
+	case *SQLite:
+		_, err = s.db.Exec(insertUser, true, login, pass)
+	case *Bolt:
+		err = s.db.Update(func(tx *bolt.Tx) error {
+			data, err := json.Marshal(boltUser{Enabled: true, Hash: pass})
+			if err != nil {
+				return err
+			}
+			return tx.Bucket(boltUsers).Put([]byte(login), data)
+		})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// messages as sorted text: topic, payload, qos and retain flag
+func messagesText(messages map[string]*packet.PublishPacket) string {
+	res := []string{}
+	for key, m := range messages {
+		res = append(res, fmt.Sprintf("%s: %s %q %d %v", key, m.Topic, m.Payload, m.QoS, m.Retain))
+	}
+	sort.Strings(res)
+	return fmt.Sprint(res)
+}
+
+// conformance of store implementation to Store contract
+func testStore(t *testing.T, s Store) {
+	defer s.Close()
+
+	check := func(what string, got error, want error) {
+		t.Helper()
+		if got != want {
+			t.Errorf("%s: got %v, want %v", what, got, want)
+		}
+	}
+
+	// users
+	check("add user", s.AddUser("alice", "secret"), nil)
+	check("add existing user", s.AddUser("alice", "other"), ErrUserExists)
+	check("check auth", s.CheckAuth("alice", "secret"), nil)
+	check("wrong password", s.CheckAuth("alice", "wrong"), ErrNotFound)
+	check("unknown user", s.CheckAuth("bob", "secret"), ErrNotFound)
+	check("disable user", s.EnableUser("alice", false), nil)
+	check("disabled user", s.CheckAuth("alice", "secret"), ErrNotFound)
+	check("enable user", s.EnableUser("alice", true), nil)
+	check("delete unknown user", s.DeleteUser("bob"), ErrNotFound)
+	check("enable unknown user", s.EnableUser("bob", true), ErrNotFound)
+	check("set password of unknown user", s.SetPassword("bob", "secret"), ErrNotFound)
+
+	if users, err := s.FetchUsers(); err != nil || !reflect.DeepEqual(users, []User{{Login: "alice", Enabled: true}}) {
+		t.Errorf("fetch users: got %v, %v", users, err)
+	}
+
+	// hash is upgraded to current cost on login
+	SetPasswordCost(bcrypt.MinCost + 1)
+	check("check auth with other cost", s.CheckAuth("alice", "secret"), nil)
+	SetPasswordCost(bcrypt.MinCost)
+	if cost, err := bcrypt.Cost([]byte(storedHash(t, s, "alice"))); err != nil || cost != bcrypt.MinCost+1 {
+		t.Errorf("hash cost after login: got %d, %v, want %d", cost, err, bcrypt.MinCost+1)
+	}
+	check("check auth of upgraded hash", s.CheckAuth("alice", "secret"), nil)
+
+	// plaintext password of old database is replaced by hash
+	seedPlaintext(t, s, "carol", "plain")
+	check("wrong plaintext password", s.CheckAuth("carol", "plai"), ErrNotFound)
+	check("plaintext password", s.CheckAuth("carol", "plain"), nil)
+	if hash := storedHash(t, s, "carol"); bcrypt.CompareHashAndPassword([]byte(hash), []byte("plain")) != nil {
+		t.Errorf("plaintext password is not rehashed: %q", hash)
+	}
+	check("check auth of rehashed password", s.CheckAuth("carol", "plain"), nil)
+	check("delete user", s.DeleteUser("carol"), nil)
+
+	check("set password", s.SetPassword("alice", "new"), nil)
+	check("new password", s.CheckAuth("alice", "new"), nil)
+	check("old password", s.CheckAuth("alice", "secret"), ErrNotFound)
+	check("delete user", s.DeleteUser("alice"), nil)
+	check("deleted user", s.CheckAuth("alice", "new"), ErrNotFound)
+
+	// acl, rule with the same kind, name and topic is replaced
+	check("save acl", s.SaveACL(ACLRule{Kind: ACLUser, Name: "alice", Topic: "a/#", Access: AccessRead}), nil)
+	check("replace acl", s.SaveACL(ACLRule{Kind: ACLUser, Name: "alice", Topic: "a/#", Access: AccessReadWrite}), nil)
+	check("save pattern", s.SaveACL(ACLRule{Kind: ACLPattern, Topic: "%c/#", Access: AccessWrite}), nil)
+	want := []ACLRule{
+		{Kind: ACLPattern, Topic: "%c/#", Access: AccessWrite},
+		{Kind: ACLUser, Name: "alice", Topic: "a/#", Access: AccessReadWrite},
+	}
+	if rules, err := s.FetchACL(); err != nil || !reflect.DeepEqual(rules, want) {
+		t.Errorf("fetch acl: got %v, %v, want %v", rules, err, want)
+	}
+	check("delete acl", s.DeleteACL(ACLUser, "alice", "a/#"), nil)
+	check("delete unknown acl", s.DeleteACL(ACLUser, "alice", "a/#"), ErrNotFound)
+
+	// subscriptions, id which is prefix of other id keeps them apart
+	check("save subscription", s.SaveSubscription("a", "t1", 1), nil)
+	check("save subscription", s.SaveSubscription("a", "t2", 2), nil)
+	check("save subscription", s.SaveSubscription("ab", "t1", 0), nil)
+	check("replace subscription", s.SaveSubscription("a", "t1", 2), nil)
+	if subs, err := s.FetchSubscription("a"); err != nil || !reflect.DeepEqual(subs, map[string]int{"t1": 2, "t2": 2}) {
+		t.Errorf("fetch subscription: got %v, %v", subs, err)
+	}
+	wantSubs := []Subscription{{ID: "a", Topic: "t1", QoS: 2}, {ID: "a", Topic: "t2", QoS: 2}, {ID: "ab", Topic: "t1"}}
+	if subs, err := s.FetchSubscriptions(); err != nil || !reflect.DeepEqual(subs, wantSubs) {
+		t.Errorf("fetch subscriptions: got %v, %v, want %v", subs, err, wantSubs)
+	}
+	check("delete subscription", s.DeleteSubscription("a", "t2"), nil)
+	if subs, err := s.FetchSubscription("a"); err != nil || !reflect.DeepEqual(subs, map[string]int{"t1": 2}) {
+		t.Errorf("fetch subscription after delete: got %v, %v", subs, err)
+	}
+	check("delete subscriptions", s.DeleteSubscriptions("a"), nil)
+	if subs, err := s.FetchSubscription("a"); err != nil || len(subs) != 0 {
+		t.Errorf("fetch deleted subscriptions: got %v, %v", subs, err)
+	}
+	if subs, err := s.FetchSubscription("ab"); err != nil || !reflect.DeepEqual(subs, map[string]int{"t1": 0}) {
+		t.Errorf("subscriptions of other id: got %v, %v", subs, err)
+	}
+
+	// retained messages
+	check("save retain", s.SaveRetain("t/a", "1", 1), nil)
+	check("replace retain", s.SaveRetain("t/a", "2", 0), nil)
+	check("save retain", s.SaveRetain("t/b", "3", 1), nil)
+	check("delete retain", s.DeleteRetain("t/b"), nil)
+	retained := map[string]*packet.PublishPacket{}
+	messages, err := s.FetchRetain()
+	for _, m := range messages {
+		retained[m.Topic] = m
+	}
+	if got := messagesText(retained); err != nil || got != `[t/a: t/a "2" 0 true]` {
+		t.Errorf("fetch retain: got %s, %v", got, err)
+	}
+
+	// session
+	if _, _, err := s.FetchSession("a"); err != ErrNotFound {
+		t.Errorf("fetch unknown session: got %v, want ErrNotFound", err)
+	}
+	inflight := map[string]*packet.PublishPacket{}
+	for i, key := range []string{"s1", "r2"} {
+		publish := packet.NewPublish()
+		publish.Id = uint16(i + 1)
+		publish.Topic = "t/" + key
+		publish.Payload = "payload " + key
+		publish.QoS = packet.QoS(i + 1)
+		publish.Retain = i == 0
+		inflight[key] = publish
+	}
+	check("save session", s.SaveSession("a", 7, inflight), nil)
+	if id, got, err := s.FetchSession("a"); err != nil || id != 7 || messagesText(got) != messagesText(inflight) {
+		t.Errorf("fetch session: got %d %s, %v, want 7 %s", id, messagesText(got), err, messagesText(inflight))
+	}
+	delete(inflight, "r2")
+	check("replace session", s.SaveSession("a", 8, inflight), nil)
+	if id, got, err := s.FetchSession("a"); err != nil || id != 8 || messagesText(got) != messagesText(inflight) {
+		t.Errorf("fetch replaced session: got %d %s, %v, want 8 %s", id, messagesText(got), err, messagesText(inflight))
+	}
+	check("delete session", s.DeleteSession("a"), nil)
+	if _, _, err := s.FetchSession("a"); err != ErrNotFound {
+		t.Errorf("fetch deleted session: got %v, want ErrNotFound", err)
+	}
+}
@@ -1,5 +1,11 @@
 module github.com/MajaSuite/mqtt
 
-go 1.14
+go 1.26.0
 
-require github.com/mattn/go-sqlite3 v1.14.5
+require (
+	github.com/mattn/go-sqlite3 v1.14.5
+	go.etcd.io/bbolt v1.4.3
+	golang.org/x/crypto v0.57.0
+)
+
+require golang.org/x/sys v0.48.0 // indirect
@@ -1,40 +1,263 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
-	"log"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/MajaSuite/mqtt/broker"
 	"github.com/MajaSuite/mqtt/db"
 )
 
 var (
-	cert  = flag.String("cert", "broker.crt", "path to broker certificate")
-	key   = flag.String("key", "broker.key", "path to broker private key")
-	debug = flag.Bool("debug", false, "print debuging hex dumps")
+	listen    = flag.String("listen", "0.0.0.0:1883", "address to listen for tcp connections")
+	listenTLS = flag.String("tls", "", "address to listen for tls connections (disabled if empty)")
+	httpAddr  = flag.String("http", "", "address to listen for http requests: /metrics, /admin/, /publish/, /subscribe (disabled if empty)")
+	adminKey  = flag.String("admin-token", "", "bearer token of admin api (disabled if empty)")
+	cert      = flag.String("cert", "broker.crt", "path to broker certificate")
+	key       = flag.String("key", "broker.key", "path to broker private key")
+	caFile    = flag.String("cafile", "", "path to CA certificate to verify tls client certificates")
+	certReq   = flag.Bool("require-cert", false, "refuse tls clients without valid certificate")
+	certID    = flag.String("cert-identity", "", "take username from client certificate: cn or san")
+	storeKind = flag.String("store", "sqlite", "storage of users, sessions and retained messages: sqlite, bolt or memory")
+	dbName    = flag.String("db", "mqtt.db", "path to database")
+	cost      = flag.Int("bcrypt-cost", 10, "bcrypt cost of password hashes")
+	passwd    = flag.String("passwd", "", "authenticate users of htpasswd file (bcrypt) instead of database")
+	authURL   = flag.String("auth-url", "", "authenticate users by http service instead of database")
+	jwtKey    = flag.String("jwt-key", "", "authenticate clients by jwt in password, checked by keys of the file (jwks, pem or secret)")
+	jwtAud    = flag.String("jwt-aud", "", "required audience of jwt")
+	acl       = flag.Bool("acl", false, "restrict access to topics by acl rules from database")
+	aclURL    = flag.String("acl-url", "", "restrict access to topics by http service")
+	anonymous = flag.Bool("anonymous", true, "accept clients without username on tcp listener")
+	anonTLS   = flag.Bool("tls-anonymous", true, "accept clients without username on tls listener")
+	anonRole  = flag.String("anonymous-role", "", "username used to check access to topics of anonymous clients")
+	anonPub   = flag.Bool("publish-anonymous", false, "accept http publish requests without username")
+	aclKick   = flag.Bool("acl-kick", false, "disconnect client publishing to denied topic instead of dropping message")
+	retainMax = flag.Int("retain-max", 0, "max number of retained messages (0 - unlimited)")
+	retainLen = flag.Int("retain-max-size", 0, "max payload size of retained message (0 - unlimited)")
+	sysPeriod = flag.Duration("sys-interval", time.Second*10, "interval of publishing broker status to $SYS topics (0 - disabled)")
+	bridges   = flag.String("bridge", "", "path to json file with bridges to remote brokers")
+	clusterAt = flag.String("cluster-listen", "", "address to accept connections of cluster nodes (cluster disabled if empty)")
+	peers     = flag.String("cluster-peers", "", "comma separated addresses of all other cluster nodes")
+	nodeName  = flag.String("cluster-node", "", "unique name of cluster node (host name by default)")
+	secret    = flag.String("cluster-secret", "", "shared secret of cluster nodes, required with -cluster-listen")
+	shared    = flag.String("shared-strategy", broker.SharedRoundRobin, "choice of client of shared subscription group: round-robin, random or sticky")
+	logLevel  = flag.String("log-level", "info", "log level: debug, info, warn or error")
+	logFormat = flag.String("log-format", "text", "log format: text or json")
+	dumpIDs   = flag.String("dump-client", "", "comma separated ids of clients to log hex dumps of their packets")
+	dumpTopic = flag.String("dump-topic", "", "comma separated topic filters to log hex dumps of matched publishes")
+	timeout   = flag.Duration("shutdown-timeout", time.Second*10, "time to send queued messages to clients on shutdown")
 )
 
 func main() {
 	flag.Parse()
-	log.Println("starting broker")
 
-	log.Println("initialize database")
-	if err := db.Open("mqtt.db"); err != nil {
-		panic(err)
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		fatal("unknown log level", err)
+	}
+	handlerOpts := &slog.HandlerOptions{Level: level}
+	switch *logFormat {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, handlerOpts)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, handlerOpts)))
+	default:
+		fatal("unknown log format", errors.New(*logFormat))
+	}
+
+	// only one authenticator and one authorizer is used, conflicting flags are not resolved silently
+	authenticators := 0
+	for _, value := range []string{*passwd, *jwtKey, *authURL} {
+		if value != "" {
+			authenticators++
+		}
+	}
+	if authenticators > 1 {
+		fatal("conflicting flags", errors.New("only one of -passwd, -jwt-key and -auth-url may be set"))
+	}
+	if *acl && *aclURL != "" {
+		fatal("conflicting flags", errors.New("only one of -acl and -acl-url may be set"))
+	}
+
+	slog.Info("starting broker")
+
+	if err := db.SetPasswordCost(*cost); err != nil {
+		fatal("error set password cost", err)
+	}
+
+	var store db.Store
+	switch *storeKind {
+	case "sqlite":
+		slog.Info("initialize database", "path", *dbName)
+		sqlite, err := db.OpenSQLite(*dbName)
+		if err != nil {
+			fatal("error open database", err)
+		}
+		store = sqlite
+	case "bolt":
+		slog.Info("initialize database", "path", *dbName)
+		bolt, err := db.OpenBolt(*dbName)
+		if err != nil {
+			fatal("error open database", err)
+		}
+		store = bolt
+	case "memory":
+		store = db.NewMemory()
+	default:
+		fatal("unknown store", errors.New(*storeKind))
+	}
+
+	if *shared != broker.SharedRoundRobin && *shared != broker.SharedRandom && *shared != broker.SharedSticky {
+		fatal("unknown shared subscription strategy", errors.New(*shared))
+	}
+
+	opts := []broker.Option{broker.WithStore(store), broker.WithDump(split(*dumpIDs), split(*dumpTopic)),
+		broker.WithRetainLimits(*retainMax, *retainLen), broker.WithSysInterval(*sysPeriod),
+		broker.WithSharedStrategy(*shared)}
+
+	if *passwd != "" {
+		auth, err := broker.NewFileAuth(*passwd)
+		if err != nil {
+			fatal("error load password file", err)
+		}
+		opts = append(opts, broker.WithAuthenticator(auth))
+	}
+
+	if *jwtKey != "" {
+		auth, err := broker.NewJWTAuth(*jwtKey, *jwtAud)
+		if err != nil {
+			fatal("error load jwt keys", err)
+		}
+		opts = append(opts, broker.WithAuthenticator(auth))
+	}
+
+	if *authURL != "" || *aclURL != "" {
+		auth := broker.NewHTTPAuth(*authURL, *aclURL, time.Minute)
+		if *authURL != "" {
+			opts = append(opts, broker.WithAuthenticator(auth))
+		}
+		if *aclURL != "" {
+			opts = append(opts, broker.WithAuthorizer(auth, *aclKick))
+		}
+	}
+
+	if *acl {
+		opts = append(opts, broker.WithACL(*aclKick))
+	}
+	server := broker.NewServer(opts...)
+
+	go func() {
+		if err := server.ListenAndServe(*listen, broker.AllowAnonymous(*anonymous),
+			broker.AnonymousRole(*anonRole)); err != broker.ErrServerClosed {
+			fatal("error start listener", err)
+		}
+	}()
+
+	if *listenTLS != "" {
+		if *certID != "" && *certID != broker.IdentityCN && *certID != broker.IdentitySAN {
+			fatal("unknown certificate identity", errors.New(*certID))
+		}
+
+		config, err := broker.NewTLSConfig(*cert, *key, *caFile, *certReq)
+		if err != nil {
+			fatal("error load tls config", err)
+		}
+
+		go func() {
+			if err := server.ListenAndServeTLSConfig(*listenTLS, config, broker.AllowAnonymous(*anonTLS),
+				broker.AnonymousRole(*anonRole), broker.CertIdentity(*certID)); err != broker.ErrServerClosed {
+				fatal("error start tls listener", err)
+			}
+		}()
+	}
+
+	if *httpAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", server.MetricsHandler())
+		mux.Handle("/publish/", server.PublishHandler(broker.AllowAnonymous(*anonPub),
+			broker.AnonymousRole(*anonRole)))
+		mux.Handle("/subscribe", server.SubscribeHandler(broker.AllowAnonymous(*anonymous),
+			broker.AnonymousRole(*anonRole)))
+		if *adminKey != "" {
+			mux.Handle("/admin/", http.StripPrefix("/admin", server.AdminHandler(*adminKey)))
+		}
+
+		go func() {
+			if err := http.ListenAndServe(*httpAddr, mux); err != nil {
+				fatal("error start http listener", err)
+			}
+		}()
+	}
+
+	if *bridges != "" {
+		configs, err := broker.LoadBridges(*bridges)
+		if err != nil {
+			fatal("error load bridges", err)
+		}
+		for _, config := range configs {
+			if _, err := server.Bridge(config); err != nil {
+				fatal("error start bridge "+config.Name, err)
+			}
+		}
 	}
 
-	server := broker.NewListener(*debug, *key, *cert)
-	if server == nil {
-		log.Panic("error start listener")
+	if *clusterAt != "" {
+		if *nodeName == "" {
+			*nodeName, _ = os.Hostname()
+		}
+		if err := server.JoinCluster(broker.ClusterConfig{Node: *nodeName, Listen: *clusterAt,
+			Peers: split(*peers), Secret: *secret}); err != nil {
+			fatal("error join cluster", err)
+		}
 	}
 
-	server.Manage()
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			if err := server.Reload(); err != nil {
+				slog.Error("error reload", "err", err)
+			}
+		}
+	}()
 
 	finish := make(chan os.Signal, 1)
 	signal.Notify(finish, syscall.SIGINT, syscall.SIGTERM)
 	<-finish
-	log.Println("finished")
+
+	slog.Info("shutdown broker")
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("error shutdown broker", "err", err)
+	}
+
+	slog.Info("close database")
+	store.Close()
+
+	slog.Info("finished")
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+// split comma separated list, empty items are skipped
+func split(list string) []string {
+	res := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
 }
@@ -3,7 +3,7 @@ package packet
 import (
 	"fmt"
 	"github.com/MajaSuite/mqtt/utils"
-	"log"
+	"strings"
 )
 
 type ConnPacket struct {
@@ -40,11 +40,15 @@ func (c *ConnPacket) Length() int {
 		1 /*flag*/ +
 		2 /*keepalive*/ +
 		2 /*cliendid len*/ +
-		len(c.ClientID) +
-		2 /*username len*/ +
-		len(c.Username) +
-		2 /*pass len*/ +
-		len(c.Password)
+		len(c.ClientID)
+
+	if len(c.Username) > 0 {
+		l += 2 /*username len*/ + len(c.Username)
+	}
+
+	if len(c.Password) > 0 {
+		l += 2 /*pass len*/ + len(c.Password)
+	}
 
 	if c.Will != nil {
 		return c.Will.Length() + l
@@ -53,7 +57,13 @@ func (c *ConnPacket) Length() int {
 	return l
 }
 
+// Unpack decode CONNECT. ErrUnsupportedVersion means valid packet of other protocol level, which should
+// be answered by CONNACK, on other errors connection should be closed without answer.
 func (c *ConnPacket) Unpack(buf []byte) error {
+	if c.Header&0x0f != 0 {
+		return ErrMalformedPacket
+	}
+
 	versionLen, offset, err := utils.ReadInt16(buf, 0)
 	if err != nil {
 		return err
@@ -63,6 +73,10 @@ func (c *ConnPacket) Unpack(buf []byte) error {
 	if err != nil {
 		return err
 	}
+	// MQIsdp is name of 3.1 protocol
+	if c.VersionName != "MQTT" && c.VersionName != "MQIsdp" {
+		return ErrProtocolError
+	}
 
 	c.Version, offset, err = utils.ReadInt8(buf, offset)
 	if err != nil {
@@ -71,7 +85,7 @@ func (c *ConnPacket) Unpack(buf []byte) error {
 	if c.Version != byte(4) {
 		return ErrUnsupportedVersion
 	}
-	if c.Version == 4 && c.VersionName != "MQTT" {
+	if c.VersionName != "MQTT" {
 		return ErrProtocolError
 	}
 
@@ -81,13 +95,13 @@ func (c *ConnPacket) Unpack(buf []byte) error {
 	}
 
 	if flag&0x01 != 0 {
-		return ErrUnknownPacket
+		return ErrMalformedPacket
 	}
 
 	usernameFlag := ((flag >> 7) & 0x1) == 1
 	passwordFlag := ((flag >> 6) & 0x1) == 1
 	if !usernameFlag && passwordFlag {
-		return ErrUnknownPacket
+		return ErrMalformedPacket
 	}
 
 	willFlag := ((flag >> 2) & 0x1) == 1
@@ -95,10 +109,10 @@ func (c *ConnPacket) Unpack(buf []byte) error {
 	willQoS := QoS((flag >> 3) & 0x3)
 
 	if !willQoS.Valid() {
-		return ErrUnknownPacket
+		return ErrMalformedPacket
 	}
 	if !willFlag && (willRetain || willQoS != 0) {
-		return ErrUnknownPacket
+		return ErrMalformedPacket
 	}
 
 	c.CleanSession = ((flag >> 1) & 0x1) == 1
@@ -112,9 +126,6 @@ func (c *ConnPacket) Unpack(buf []byte) error {
 	if err != nil {
 		return err
 	}
-	if clidLen == 0 && !c.CleanSession {
-		return ErrUnknownPacket
-	}
 
 	c.ClientID, offset, err = utils.ReadString(buf, offset, int(clidLen))
 	if err != nil {
@@ -122,7 +133,6 @@ func (c *ConnPacket) Unpack(buf []byte) error {
 	}
 
 	if willFlag {
-		log.Println("will is set")
 		var willTopicLen, willMessageLen uint16
 		var willTopic, willMessage string
 
@@ -131,12 +141,21 @@ func (c *ConnPacket) Unpack(buf []byte) error {
 			return err
 		}
 		willTopic, offset, err = utils.ReadString(buf, offset, int(willTopicLen))
+		if err != nil {
+			return err
+		}
+		if willTopic == "" || strings.ContainsAny(willTopic, "+#") {
+			return ErrMalformedPacket
+		}
 
 		willMessageLen, offset, err = utils.ReadInt16(buf, offset)
 		if err != nil {
 			return err
 		}
 		willMessage, offset, err = utils.ReadString(buf, offset, int(willMessageLen))
+		if err != nil {
+			return err
+		}
 
 		c.Will = &WillMessage{
 			QoS:       willQoS,
@@ -148,24 +167,30 @@ func (c *ConnPacket) Unpack(buf []byte) error {
 		}
 	}
 
-	loginLen, offset, err := utils.ReadInt16(buf, offset)
-	if err != nil {
-		return err
-	}
+	if usernameFlag {
+		var loginLen uint16
+		loginLen, offset, err = utils.ReadInt16(buf, offset)
+		if err != nil {
+			return err
+		}
 
-	c.Username, offset, err = utils.ReadString(buf, offset, int(loginLen))
-	if err != nil {
-		return err
+		c.Username, offset, err = utils.ReadString(buf, offset, int(loginLen))
+		if err != nil {
+			return err
+		}
 	}
 
-	passLen, offset, err := utils.ReadInt16(buf, offset)
-	if err != nil {
-		return err
-	}
+	if passwordFlag {
+		var passLen uint16
+		passLen, offset, err = utils.ReadInt16(buf, offset)
+		if err != nil {
+			return err
+		}
 
-	c.Password, offset, err = utils.ReadString(buf, offset, int(passLen))
-	if err != nil {
-		return err
+		c.Password, offset, err = utils.ReadString(buf, offset, int(passLen))
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -213,8 +238,13 @@ func (c *ConnPacket) Pack() []byte {
 		offset += c.Will.Length()
 	}
 
-	offset = utils.WriteString(buf, offset, c.Username)
-	offset = utils.WriteString(buf, offset, c.Password)
+	if len(c.Username) > 0 {
+		offset = utils.WriteString(buf, offset, c.Username)
+	}
+
+	if len(c.Password) > 0 {
+		offset = utils.WriteString(buf, offset, c.Password)
+	}
 
 	return buf
 }
@@ -224,6 +254,11 @@ func (c *ConnPacket) String() string {
 	if c.Will != nil {
 		will = ", will: " + c.Will.String()
 	}
+	// password is never printed
+	var pass string
+	if c.Password != "" {
+		pass = "***"
+	}
 	return fmt.Sprintf("connect: {ver: %d, keepalive: %d, clean: %v, clientid: %s%s, login: %s, pass: %s}", c.Version,
-		c.KeepAlive, c.CleanSession, c.ClientID, will, c.Username, c.Password)
+		c.KeepAlive, c.CleanSession, c.ClientID, will, c.Username, pass)
 }
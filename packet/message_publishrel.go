@@ -43,7 +43,7 @@ func (p *PubRelPacket) Pack() []byte {
 	offset := 0
 	buf := make([]byte, 4)
 
-	offset = utils.WriteInt8(buf, offset, byte(PUBREL)<<4)
+	offset = utils.WriteInt8(buf, offset, byte(PUBREL)<<4|0x2)
 	offset = utils.WriteInt8(buf, offset, byte(p.Length()))
 	offset = utils.WriteInt16(buf, offset, p.Id)
 
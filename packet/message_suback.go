@@ -6,6 +6,9 @@ import (
 	"github.com/MajaSuite/mqtt/utils"
 )
 
+// SubscribeFailure is return code of refused subscription
+const SubscribeFailure QoS = 0x80
+
 type SubAckPacket struct {
 	PacketImpl
 	Header      byte
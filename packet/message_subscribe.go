@@ -6,8 +6,8 @@ import (
 )
 
 type SubscribePayload struct {
-	QoS   QoS
-	Topic string
+	QoS   QoS    `json:"qos"`
+	Topic string `json:"topic"`
 }
 
 func (p *SubscribePayload) Length() int {
@@ -58,13 +58,18 @@ func (s *SubscribePacket) Length() int {
 }
 
 func (s *SubscribePacket) Unpack(buf []byte) error {
+	// reserved bits of fixed header are 0010
+	if s.Header&0x0f != 0x2 {
+		return ErrMalformedPacket
+	}
+
 	id, offset, err := utils.ReadInt16(buf, 0)
 	if err != nil {
 		return err
 	}
 	s.Id = id
 
-	for left := len(buf) - 2; left > 0; {
+	for offset < len(buf) {
 		var topicLen uint16
 		topicLen, offset, err = utils.ReadInt16(buf, offset)
 		if err != nil {
@@ -79,9 +84,20 @@ func (s *SubscribePacket) Unpack(buf []byte) error {
 
 		var qos uint8
 		qos, offset, err = utils.ReadInt8(buf, offset)
+		if err != nil {
+			return err
+		}
+
+		if !ValidFilter(topic) || !QoS(qos).Valid() {
+			return ErrMalformedPacket
+		}
 
 		s.Topics = append(s.Topics, SubscribePayload{Topic: topic, QoS: QoS(qos)})
-		left -= offset
+	}
+
+	// subscribe without topic filters is protocol violation
+	if len(s.Topics) == 0 {
+		return ErrMalformedPacket
 	}
 
 	return nil
@@ -91,7 +107,7 @@ func (s *SubscribePacket) Pack() []byte {
 	lenBuff := WriteLength(s.Length())
 	buf := make([]byte, 1+len(lenBuff)+s.Length())
 
-	offset := utils.WriteInt8(buf, 0, byte(SUBSCRIBE)<<4)
+	offset := utils.WriteInt8(buf, 0, byte(SUBSCRIBE)<<4|0x2)
 	offset = utils.WriteBytes(buf, offset, lenBuff)
 	offset = utils.WriteInt16(buf, offset, s.Id)
 
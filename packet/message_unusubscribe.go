@@ -30,7 +30,7 @@ func (u *UnSubscribePacket) Type() Type {
 func (u *UnSubscribePacket) Length() int {
 	var l int
 	for _, p := range u.Topics {
-		l += p.Length()
+		l += 2 /*topic len*/ + len(p.Topic)
 	}
 	return 2 /*id*/ + l
 }
@@ -42,10 +42,9 @@ func (u *UnSubscribePacket) Unpack(buf []byte) error {
 	}
 	u.Id = id
 
-	for left := len(buf) - 2; left > 0; {
+	for offset < len(buf) {
 		var topicLen uint16
 		var topic string
-		var qos uint8
 
 		topicLen, offset, err = utils.ReadInt16(buf, offset)
 		if err != nil {
@@ -57,10 +56,8 @@ func (u *UnSubscribePacket) Unpack(buf []byte) error {
 			return err
 		}
 
-		qos, offset, err = utils.ReadInt8(buf, offset)
-
-		u.Topics = append(u.Topics, SubscribePayload{Topic: topic, QoS: QoS(qos)})
-		left -= 2 + len(topic) + 1
+		// unsubscribe has no qos, only topic filters
+		u.Topics = append(u.Topics, SubscribePayload{Topic: topic})
 	}
 
 	return nil
@@ -70,14 +67,12 @@ func (u *UnSubscribePacket) Pack() []byte {
 	lenBuff := WriteLength(u.Length())
 	buf := make([]byte, 1+len(lenBuff)+u.Length())
 
-	offset := utils.WriteInt8(buf, 0, byte(UNSUBSCRIBE)<<4)
+	offset := utils.WriteInt8(buf, 0, byte(UNSUBSCRIBE)<<4|0x2)
 	offset = utils.WriteBytes(buf, offset, lenBuff)
 	offset = utils.WriteInt16(buf, offset, u.Id)
 
 	for _, t := range u.Topics {
-		data := t.Pack()
-		copy(buf[offset:], data)
-		offset += len(data)
+		offset = utils.WriteString(buf, offset, t.Topic)
 	}
 
 	return buf
@@ -5,7 +5,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"strings"
 	"time"
@@ -35,6 +35,7 @@ var (
 	ErrInvalidPacketLength = errors.New("invalid packet Len")
 	ErrUnknownPacket       = errors.New("unknown packet type")
 	ErrUnsupportedVersion  = errors.New("unsupported mqtt version")
+	ErrMalformedPacket     = errors.New("malformed packet")
 	ErrConnect             = errors.New("error connect to broker")
 )
 
@@ -124,7 +125,7 @@ func Create(buf byte) Packet {
 
 func ReadPacket(conn net.Conn, debug bool) (Packet, error) {
 	header := make([]byte, 2)
-	if n, err := conn.Read(header); n < 2 || err != nil {
+	if n, err := io.ReadFull(conn, header); n < 2 || err != nil {
 		return nil, io.ErrUnexpectedEOF
 	}
 
@@ -157,41 +158,41 @@ func ReadPacket(conn net.Conn, debug bool) (Packet, error) {
 	}
 
 	if debug {
-		log.Printf("read: header: 0x%x, %d bytes\n", header[0], packetLength)
+		slog.Info("read packet header", "header", header[0], "length", packetLength)
 	}
 
 	pkt := Create(header[0])
 	if pkt == nil {
 		if debug {
-			log.Println("read: error create packet")
+			slog.Info("read: error create packet", "header", header[0])
 		}
 		return nil, ErrUnknownPacket
 	}
 
+	payload := make([]byte, packetLength)
 	if packetLength != 0 {
-		payload := make([]byte, packetLength)
-		if n, err := conn.Read(payload); n < packetLength || err != nil {
+		if n, err := io.ReadFull(conn, payload); err != nil {
 			if debug {
-				log.Printf("read only %d bytes, try to read last one\n", n)
-			}
-			last, err := conn.Read(payload[n:])
-			if err != nil {
-				return nil, io.ErrUnexpectedEOF
-			}
-			if debug {
-				log.Printf("read last %d bytes, seems fine now\n", last)
+				slog.Info("read: packet is truncated", "read", n, "length", packetLength)
 			}
+			return nil, io.ErrUnexpectedEOF
 		}
 
 		if debug {
-			log.Printf("read packet payload:\n%s", hex.Dump(payload))
+			slog.Info("read packet payload", "dump", hex.Dump(payload))
 		}
+	}
 
-		pkt.Unpack(payload)
+	// packet is returned with decode error, so caller may answer to it (e.g. CONNACK to wrong version)
+	if err := pkt.Unpack(payload); err != nil {
+		if debug {
+			slog.Info("read: error decode packet", "type", pkt.Type().String(), "err", err)
+		}
+		return pkt, err
 	}
 
 	if debug {
-		log.Println("read packet (decoded):", pkt.String())
+		slog.Info("read packet", "type", pkt.Type().String(), "packet", pkt.String())
 	}
 
 	return pkt, nil
@@ -201,7 +202,7 @@ func WritePacket(conn net.Conn, pkt Packet, debug bool) error {
 	packed := pkt.Pack()
 
 	if debug {
-		log.Printf("write:\n%s", hex.Dump(packed))
+		slog.Info("write packet", "type", pkt.Type().String(), "dump", hex.Dump(packed))
 	}
 
 	conn.SetWriteDeadline(time.Now().Add(time.Second * 3))
@@ -227,41 +228,45 @@ func WriteLength(len int) []byte {
 	return buf
 }
 
+// ValidFilter check topic filter syntax: it is not empty, "+" and "#" take whole level, "#" is the last one.
+func ValidFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if level == "#" && i != len(levels)-1 || level != "+" && level != "#" && strings.ContainsAny(level, "+#") {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchTopic check if topic matches the filter: "+" matches exactly one level, "#" matches any number of
+// levels including parent one. Topics started with $ are not matched by wildcard on the first level.
 func MatchTopic(mask string, topic string) bool {
-	t := strings.Split(topic, "/")
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(mask, "+") || strings.HasPrefix(mask, "#")) {
+		return false
+	}
 
-	var found bool
-	var i int = 0 // start from first level
 	maskPart := strings.Split(mask, "/")
+	t := strings.Split(topic, "/")
 
-	for {
-		if len(maskPart) <= i || len(t) <= i {
-			break
+	for i, level := range maskPart {
+		if level == "#" {
+			return true
 		}
 
-		if maskPart[i] == "#" {
-			found = true
-			break
+		if len(t) <= i {
+			return false
 		}
 
 		// match at this level
-		if maskPart[i] == "*" || maskPart[i] == t[i] {
-			if len(t) == i+1 {
-				if len(t) == len(maskPart) {
-					found = true
-					break
-				}
-				break
-			}
-
-			// try next level
-			i++
-			continue
+		if level != "+" && level != t[i] {
+			return false
 		}
-
-		// doesn't match
-		break
 	}
 
-	return found
+	return len(maskPart) == len(t)
 }